@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// authTransport logs requests in: with a bearer token saved for the host, or
+// by answering a server's Basic or Digest challenge with the request's own
+// login or the one saved for its host. Digest challenges are remembered per
+// host, so the parts of a download after the first answer them up front.
+type authTransport struct {
+	base  http.RoundTripper
+	creds *credentialStore
+
+	challenges map[string]*digestChallenge
+	basicHosts map[string]bool
+	mu         sync.Mutex
+}
+
+func newAuthTransport(base http.RoundTripper, creds *credentialStore) *authTransport {
+	return &authTransport{base: base, creds: creds, challenges: make(map[string]*digestChallenge), basicHosts: make(map[string]bool)}
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	//A task's own login comes as Basic auth, it may still have to be answered with Digest
+	user, pass, hasLogin := req.BasicAuth()
+	var token string
+	if !hasLogin && req.Header.Get("Authorization") == "" && t.creds != nil {
+		if cred, ok := t.creds.lookup(req.URL); ok {
+			user, pass, token = cred.Username, cred.Password, cred.Token
+			hasLogin = user != ""
+		}
+	}
+
+	switch {
+	case token != "":
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+token)
+		return t.base.RoundTrip(req)
+	case !hasLogin:
+		return t.base.RoundTrip(req)
+	case req.URL.Scheme == "ftp" || req.URL.Scheme == "ftps":
+		//FTP logs in with the request's Basic auth
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(user, pass)
+		return t.base.RoundTrip(req)
+	}
+
+	host := req.URL.Host
+	first := req.Clone(req.Context())
+	t.mu.Lock()
+	challenge, basic := t.challenges[host], t.basicHosts[host]
+	t.mu.Unlock()
+	if challenge != nil {
+		first.Header.Set("Authorization", t.answer(challenge, req.Method, req.URL.RequestURI(), user, pass))
+	} else if basic {
+		first.SetBasicAuth(user, pass)
+	}
+
+	res, err := t.base.RoundTrip(first)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	//Only bodyless requests can be sent again, which is all the downloader makes
+	if req.Body != nil && req.Body != http.NoBody {
+		return res, nil
+	}
+
+	retry := req.Clone(req.Context())
+	if c := parseDigestChallenge(res.Header.Values("WWW-Authenticate")); c != nil {
+		t.mu.Lock()
+		t.challenges[host] = c
+		t.mu.Unlock()
+		retry.Header.Set("Authorization", t.answer(c, req.Method, req.URL.RequestURI(), user, pass))
+	} else if offersBasic(res.Header.Values("WWW-Authenticate")) && first.Header.Get("Authorization") == "" {
+		t.mu.Lock()
+		t.basicHosts[host] = true
+		t.mu.Unlock()
+		retry.SetBasicAuth(user, pass)
+	} else {
+		//The login was sent and turned down
+		return res, nil
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+	return t.base.RoundTrip(retry)
+}
+
+// answer builds the Authorization header for a challenge, counting the
+// nonce's uses since every request has to use it with a new count.
+func (t *authTransport) answer(c *digestChallenge, method string, uri string, user string, pass string) string {
+	t.mu.Lock()
+	c.nc++
+	nc := c.nc
+	t.mu.Unlock()
+	return c.authorization(method, uri, user, pass, nc)
+}
+
+// digestChallenge is a Digest WWW-Authenticate challenge (RFC 7616).
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       bool // the server supports qop=auth
+	nc        int
+}
+
+func (c *digestChallenge) newHash() hash.Hash {
+	if strings.HasPrefix(strings.ToUpper(c.algorithm), "SHA-256") {
+		return sha256.New()
+	}
+	return md5.New()
+}
+
+func (c *digestChallenge) authorization(method string, uri string, user string, pass string, nc int) string {
+	h := func(s string) string {
+		hasher := c.newHash()
+		hasher.Write([]byte(s))
+		return hex.EncodeToString(hasher.Sum(nil))
+	}
+	cnonceBytes := make([]byte, 8)
+	rand.Read(cnonceBytes)
+	cnonce := hex.EncodeToString(cnonceBytes)
+	count := fmt.Sprintf("%08x", nc)
+
+	ha1 := h(user + ":" + c.realm + ":" + pass)
+	if strings.HasSuffix(strings.ToLower(c.algorithm), "-sess") {
+		ha1 = h(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	var response string
+	if c.qop {
+		response = h(strings.Join([]string{ha1, c.nonce, count, cnonce, "auth", ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + c.nonce + ":" + ha2)
+	}
+
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`, user, c.realm, c.nonce, uri, response)
+	if c.algorithm != "" {
+		header += ", algorithm=" + c.algorithm
+	}
+	if c.opaque != "" {
+		header += fmt.Sprintf(`, opaque="%s"`, c.opaque)
+	}
+	if c.qop {
+		header += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s"`, count, cnonce)
+	}
+	return header
+}
+
+// parseDigestChallenge picks the Digest challenge out of a response's
+// WWW-Authenticate headers, the strongest one if there are several.
+func parseDigestChallenge(headers []string) *digestChallenge {
+	var best *digestChallenge
+	for _, header := range headers {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(header), " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+		attrs := parseAuthParams(params)
+		c := &digestChallenge{realm: attrs["realm"], nonce: attrs["nonce"], opaque: attrs["opaque"], algorithm: attrs["algorithm"]}
+		switch strings.ToUpper(c.algorithm) {
+		case "", "MD5", "MD5-SESS", "SHA-256", "SHA-256-SESS":
+		default:
+			continue
+		}
+		if c.nonce == "" {
+			continue
+		}
+		if qop, ok := attrs["qop"]; ok {
+			options := strings.Split(qop, ",")
+			for i := range options {
+				options[i] = strings.TrimSpace(options[i])
+			}
+			if !slices.Contains(options, "auth") {
+				continue
+			}
+			c.qop = true
+		}
+		if best == nil || strings.HasPrefix(strings.ToUpper(c.algorithm), "SHA-256") {
+			best = c
+		}
+	}
+	return best
+}
+
+func offersBasic(headers []string) bool {
+	for _, header := range headers {
+		scheme, _, _ := strings.Cut(strings.TrimSpace(header), " ")
+		if strings.EqualFold(scheme, "Basic") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuthParams splits the parameters of a challenge, such as
+// realm="files", qop="auth,auth-int", nonce="abc", into their values.
+func parseAuthParams(s string) map[string]string {
+	attrs := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ,")
+		name, rest, found := strings.Cut(s, "=")
+		if !found {
+			return attrs
+		}
+		var value string
+		rest = strings.TrimSpace(rest)
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+		s = rest
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// digestServer asks for SHA-256 Digest auth with qop=auth and checks the
+// answers the way a server would, counting the challenges it had to send.
+type digestServer struct {
+	user, pass string
+	mu         sync.Mutex
+	challenged int
+	counts     map[string]bool // nonce counts seen, a reused one is a replay
+}
+
+func (ds *digestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	scheme, params, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	attrs := parseAuthParams(params)
+	if scheme == "Digest" && attrs["nonce"] == "n0nce" && !ds.counts[attrs["nc"]] {
+		h := func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		}
+		ha1 := h(ds.user + ":files:" + ds.pass)
+		ha2 := h(r.Method + ":" + r.URL.RequestURI())
+		want := h(strings.Join([]string{ha1, "n0nce", attrs["nc"], attrs["cnonce"], "auth", ha2}, ":"))
+		if attrs["response"] == want && attrs["uri"] == r.URL.RequestURI() && attrs["opaque"] == "op" {
+			ds.counts[attrs["nc"]] = true
+			fmt.Fprint(w, "secret file")
+			return
+		}
+	}
+	ds.challenged++
+	w.Header().Add("WWW-Authenticate", `Basic realm="files"`)
+	w.Header().Add("WWW-Authenticate", `Digest realm="files", qop="auth,auth-int", algorithm=MD5, nonce="n0nce", opaque="op"`)
+	w.Header().Add("WWW-Authenticate", `Digest realm="files", qop="auth,auth-int", algorithm=SHA-256, nonce="n0nce", opaque="op"`)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func TestAuthTransportDigest(t *testing.T) {
+	ds := &digestServer{user: "joe", pass: "secret", counts: make(map[string]bool)}
+	srv := httptest.NewServer(ds)
+	defer srv.Close()
+	client := &http.Client{Transport: newAuthTransport(http.DefaultTransport, nil)}
+
+	for i := range 3 {
+		req, _ := http.NewRequest("GET", srv.URL+"/files/a.bin?part="+fmt.Sprint(i), nil)
+		req.SetBasicAuth("joe", "secret")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("request %d got %d", i, res.StatusCode)
+		}
+	}
+	//Only the first request had to be turned down, the rest answered up front
+	if ds.challenged != 1 {
+		t.Errorf("server sent %d challenges, want 1", ds.challenged)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/files/a.bin", nil)
+	req.SetBasicAuth("joe", "wrong")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong password got %d", res.StatusCode)
+	}
+}
+
+func TestAuthTransportSavedLogins(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); ok && user == "joe" && pass == "secret" {
+			fmt.Fprint(w, "basic")
+			return
+		}
+		if r.Header.Get("Authorization") == "Bearer t0ken" {
+			fmt.Fprint(w, "bearer")
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="files"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	u, _ := neturl.Parse(srv.URL)
+
+	creds := newCredentialStore("credentials.json", "credentials.key")
+	client := &http.Client{Transport: newAuthTransport(http.DefaultTransport, creds)}
+	get := func() string {
+		res, err := client.Get(srv.URL + "/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Sprintf("%d %s", res.StatusCode, body)
+	}
+
+	if got := get(); got != "401 " {
+		t.Errorf("no saved login got %q", got)
+	}
+	if err := creds.set(hostCredential{Host: u.Hostname(), Username: "joe", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(); got != "200 basic" {
+		t.Errorf("saved login got %q", got)
+	}
+	//A login for the host and port wins over one for the host alone
+	if err := creds.set(hostCredential{Host: u.Host, Token: "t0ken"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(); got != "200 bearer" {
+		t.Errorf("saved token got %q", got)
+	}
+}
+
+func TestParseDigestChallenge(t *testing.T) {
+	if c := parseDigestChallenge([]string{`Digest realm="r", nonce="n", qop="auth-int"`}); c != nil {
+		t.Errorf("took a challenge without qop=auth: %+v", c)
+	}
+	if c := parseDigestChallenge([]string{`Digest realm="r", nonce="n", algorithm=SHA-512-256`}); c != nil {
+		t.Errorf("took an unsupported algorithm: %+v", c)
+	}
+	if c := parseDigestChallenge([]string{`Digest realm="r"`}); c != nil {
+		t.Errorf("took a challenge without nonce: %+v", c)
+	}
+	c := parseDigestChallenge([]string{`Basic realm="r"`, `Digest realm="r, with comma", nonce="n", qop="auth"`})
+	if c == nil || c.realm != "r, with comma" || !c.qop || c.algorithm != "" {
+		t.Errorf("challenge is %+v", c)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Strongest first, used to pick one digest when a server offers several
+var checksumAlgos = []string{"sha512", "sha256", "sha1", "md5"}
+
+// checksum is an expected digest of a whole file, kept as "algo:hex".
+type checksum struct {
+	Algo string
+	Hex  string
+}
+
+func (c checksum) String() string {
+	if c.Algo == "" {
+		return ""
+	}
+	return c.Algo + ":" + c.Hex
+}
+
+func (c checksum) newHash() hash.Hash {
+	switch c.Algo {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// parseChecksum accepts "sha256:<hex>" (also "sha-256=<hex>") or a bare hex
+// digest, in which case the algorithm is guessed from its length.
+func parseChecksum(s string) (checksum, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return checksum{}, nil
+	}
+
+	algo, digest, found := strings.Cut(s, ":")
+	if !found {
+		algo, digest, found = strings.Cut(s, "=")
+	}
+	if !found {
+		digest = s
+		switch len(s) {
+		case 32:
+			algo = "md5"
+		case 40:
+			algo = "sha1"
+		case 64:
+			algo = "sha256"
+		case 128:
+			algo = "sha512"
+		default:
+			return checksum{}, fmt.Errorf("cannot tell the algorithm of a %d character digest", len(s))
+		}
+	}
+
+	c := checksum{Algo: normalizeAlgo(algo), Hex: strings.ToLower(strings.TrimSpace(digest))}
+	if c.newHash() == nil {
+		return checksum{}, fmt.Errorf("unsupported checksum algorithm %q", algo)
+	}
+	raw, err := hex.DecodeString(c.Hex)
+	if err != nil || len(raw) != c.newHash().Size() {
+		return checksum{}, fmt.Errorf("invalid %s digest", c.Algo)
+	}
+	return c, nil
+}
+
+func normalizeAlgo(algo string) string {
+	algo = strings.ToLower(strings.TrimSpace(algo))
+	algo = strings.ReplaceAll(algo, "-", "")
+	if algo == "sha" {
+		return "sha1"
+	}
+	return algo
+}
+
+// serverChecksum picks the strongest digest a server advertised for the
+// whole file in the Repr-Digest, Digest, Content-MD5 or x-goog-hash headers.
+func serverChecksum(header http.Header) (checksum, bool) {
+	found := make(map[string]string)
+	add := func(algo string, b64 string) {
+		algo = normalizeAlgo(algo)
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+		if err != nil {
+			return
+		}
+		c := checksum{Algo: algo, Hex: hex.EncodeToString(raw)}
+		if h := c.newHash(); h != nil && h.Size() == len(raw) {
+			found[algo] = c.Hex
+		}
+	}
+
+	//RFC 9530: sha-256=:base64:
+	for _, v := range header.Values("Repr-Digest") {
+		for _, item := range strings.Split(v, ",") {
+			if algo, value, ok := strings.Cut(strings.TrimSpace(item), "="); ok {
+				add(algo, strings.Trim(value, ":"))
+			}
+		}
+	}
+	//RFC 3230: SHA-256=base64
+	for _, v := range header.Values("Digest") {
+		for _, item := range strings.Split(v, ",") {
+			if algo, value, ok := strings.Cut(strings.TrimSpace(item), "="); ok {
+				add(algo, value)
+			}
+		}
+	}
+	if v := header.Get("Content-MD5"); v != "" {
+		add("md5", v)
+	}
+	//Google Cloud Storage: crc32c=...,md5=...
+	for _, v := range header.Values("X-Goog-Hash") {
+		for _, item := range strings.Split(v, ",") {
+			if algo, value, ok := strings.Cut(strings.TrimSpace(item), "="); ok && strings.EqualFold(algo, "md5") {
+				add(algo, value)
+			}
+		}
+	}
+
+	for _, algo := range checksumAlgos {
+		if digest, ok := found[algo]; ok {
+			return checksum{Algo: algo, Hex: digest}, true
+		}
+	}
+	return checksum{}, false
+}
+
+// verifyFile hashes the file at filePath and compares it to the expected digest.
+func verifyFile(filePath string, expected checksum) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	h := expected.newHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != expected.Hex {
+		return fmt.Errorf("%s mismatch: expected %s, got %s", expected.Algo, expected.Hex, actual)
+	}
+	return nil
+}
+
+// Sidecar files publishers put next to an artifact, in the order we try them.
+// A per-file sidecar holds one digest, a SUMS file lists many files.
+var sidecarSuffixes = []string{".sha512", ".sha256", ".sha1", ".md5"}
+var sumsFiles = []string{"SHA512SUMS", "SHA256SUMS", "SHA1SUMS", "MD5SUMS"}
+
+// findSidecarChecksum looks for a published checksum next to downloadUrl and
+// returns it with the URL it came from. An empty checksum means none was found.
+func findSidecarChecksum(ctx context.Context, client *http.Client, downloadUrl string, fileName string, opts requestOptions) (checksum, string) {
+	u, err := neturl.Parse(downloadUrl)
+	if err != nil {
+		return checksum{}, ""
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	names := []string{path.Base(u.Path), fileName}
+
+	for _, suffix := range sidecarSuffixes {
+		candidate := *u
+		candidate.Path += suffix
+		algo := strings.TrimPrefix(suffix, ".")
+		if c, ok := fetchSidecar(ctx, client, candidate.String(), algo, nil, opts); ok {
+			return c, candidate.String()
+		}
+	}
+	for _, sums := range sumsFiles {
+		candidate := *u
+		candidate.Path = path.Join(path.Dir(u.Path), sums)
+		algo := strings.ToLower(strings.TrimSuffix(sums, "SUMS"))
+		if c, ok := fetchSidecar(ctx, client, candidate.String(), algo, names, opts); ok {
+			return c, candidate.String()
+		}
+	}
+	return checksum{}, ""
+}
+
+func fetchSidecar(ctx context.Context, client *http.Client, sidecarUrl string, algo string, names []string, opts requestOptions) (checksum, bool) {
+	req, err := http.NewRequestWithContext(ctx, "GET", sidecarUrl, nil)
+	if err != nil {
+		return checksum{}, false
+	}
+	//Sidecars behind the same login or session as the file need its headers too
+	opts.apply(req)
+	res, err := client.Do(req)
+	if err != nil {
+		log.Println("Checksum file fetch failed:", err)
+		return checksum{}, false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return checksum{}, false
+	}
+
+	//Checksum files are tiny, anything bigger is an HTML error page or worse
+	return parseSumsFile(io.LimitReader(res.Body, 1024*1024), algo, names)
+}
+
+// parseSumsFile reads GNU ("<hex>  name", "<hex> *name") and BSD
+// ("SHA256 (name) = <hex>") style lines and returns the digest listed for
+// one of names. With no names, as for a <file>.sha256 sidecar, the first
+// digest in the file is taken whatever name it carries.
+func parseSumsFile(r io.Reader, algo string, names []string) (checksum, bool) {
+	matches := func(name string) bool {
+		if len(names) == 0 {
+			return true
+		}
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "*"), "./")
+		for _, n := range names {
+			if n != "" && name == n {
+				return true
+			}
+		}
+		return false
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if head, digest, ok := strings.Cut(line, ") = "); ok {
+			lineAlgo, name, _ := strings.Cut(head, " (")
+			if c, err := parseChecksum(lineAlgo + ":" + digest); err == nil && matches(name) {
+				return c, true
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		c, err := parseChecksum(algo + ":" + fields[0])
+		if err == nil && matches(strings.Join(fields[1:], " ")) {
+			return c, true
+		}
+	}
+	return checksum{}, false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestChecksumMismatchLeavesNoFile(t *testing.T) {
+	content := bytes.Repeat([]byte("pulldown"), 300*1024)
+	sum := sha256.Sum256(content)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+	fileUrl := srv.URL + "/file.bin"
+
+	tests := []struct {
+		name        string
+		directWrite bool
+		checksum    string
+		wantStatus  string
+		wantFiles   []string
+	}{
+		{"parts, verified", false, "sha256:" + hex.EncodeToString(sum[:]), "Completed", []string{"file.bin"}},
+		{"parts, mismatch", false, "sha256:" + hex.EncodeToString(make([]byte, 32)), "Error", nil},
+		{"direct, verified", true, "sha256:" + hex.EncodeToString(sum[:]), "Completed", []string{"file.bin"}},
+		{"direct, mismatch", true, "sha256:" + hex.EncodeToString(make([]byte, 32)), "Error", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dm := newTestManager(t)
+			dm.settings.DirectWrite = tt.directWrite
+			dm.Tasks = []Task{{ID: fileUrl, Url: fileUrl, Status: "Downloading", Checksum: tt.checksum}}
+			dm.processDownload(context.Background(), fileUrl, fileUrl)
+
+			if got := dm.Tasks[0].Status; got != tt.wantStatus {
+				t.Fatalf("task ended %s, want %s", got, tt.wantStatus)
+			}
+			entries, _ := os.ReadDir("downloads")
+			var files []string
+			for _, e := range entries {
+				files = append(files, e.Name())
+			}
+			if len(files) != len(tt.wantFiles) || (len(files) > 0 && files[0] != tt.wantFiles[0]) {
+				t.Errorf("download directory holds %v, want %v", files, tt.wantFiles)
+			}
+			if _, err := os.Stat(manifestFileName(fileUrl)); err == nil {
+				t.Error("manifest left behind")
+			}
+		})
+	}
+}
+
+func TestSidecarUsesTaskLogin(t *testing.T) {
+	const digest = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "alice" || pass != "hunter2" || r.Header.Get("Cookie") != "session=abc" {
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/files/app.tar.gz.sha256" {
+			w.Write([]byte(digest + "  app.tar.gz\n"))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	fileUrl := srv.URL + "/files/app.tar.gz?token=1"
+	opts := requestOptions{username: "alice", password: "hunter2", header: http.Header{"Cookie": {"session=abc"}}}
+	got, source := findSidecarChecksum(context.Background(), srv.Client(), fileUrl, "app.tar.gz", opts)
+	if got != (checksum{Algo: "sha256", Hex: digest}) || source != srv.URL+"/files/app.tar.gz.sha256" {
+		t.Errorf("got %v from %q", got, source)
+	}
+
+	if got, _ := findSidecarChecksum(context.Background(), srv.Client(), fileUrl, "app.tar.gz", requestOptions{}); got.Algo != "" {
+		t.Errorf("found %v without the login", got)
+	}
+}
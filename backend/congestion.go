@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// minAutoLimit is the least auto and snail mode hold downloads to.
+const minAutoLimit = 50 * 1024
+
+// congestionDetector finds a limit for auto mode from our own downloads,
+// for when the machine's counters can't tell how busy the link is. Requests
+// taking twice as long to be answered as at best, or the speed halving
+// while the same tasks keep running, mean something else is using the link:
+// the limit drops below our speed then. While the limit holds us back
+// without either sign it is raised step by step, and once we no longer come
+// near it, it is let go.
+type congestionDetector struct {
+	limit       int64         // 0 for none
+	baseLatency time.Duration // the best lately, drifting up over time
+	lastSpeed   float64
+	lastActive  int
+
+	latencySum   time.Duration // since the last update
+	latencyCount int
+
+	mu sync.Mutex
+}
+
+// observeLatency records how long a request took to be answered.
+func (cd *congestionDetector) observeLatency(d time.Duration) {
+	cd.mu.Lock()
+	cd.latencySum += d
+	cd.latencyCount++
+	cd.mu.Unlock()
+}
+
+// update takes our speed since the last update and the number of tasks
+// downloading, and returns the limit to apply.
+func (cd *congestionDetector) update(ourSpeed float64, active int) int64 {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+
+	inflated := false
+	if cd.latencyCount > 0 {
+		mean := cd.latencySum / time.Duration(cd.latencyCount)
+		cd.latencySum, cd.latencyCount = 0, 0
+		if cd.baseLatency == 0 || mean < cd.baseLatency {
+			cd.baseLatency = mean
+		} else {
+			inflated = mean > 2*cd.baseLatency && mean-cd.baseLatency > 100*time.Millisecond
+			//A path that got slower for good becomes the new normal
+			cd.baseLatency += cd.baseLatency / 50
+		}
+	}
+
+	binding := cd.limit > 0 && ourSpeed >= 0.9*float64(cd.limit)
+	collapsed := !binding && active > 0 && active == cd.lastActive && ourSpeed < cd.lastSpeed/2
+	cd.lastSpeed, cd.lastActive = ourSpeed, active
+
+	switch {
+	case (inflated || collapsed) && ourSpeed > 0:
+		cd.limit = max(int64(ourSpeed*0.8), minAutoLimit)
+	case binding:
+		cd.limit += cd.limit/10 + 64*1024
+	case cd.limit > 0 && ourSpeed < float64(cd.limit)/2:
+		//Fewer tasks or a faster link, there is nothing left to hold back
+		cd.limit = 0
+	}
+	return cd.limit
+}
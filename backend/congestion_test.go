@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCongestionDetector(t *testing.T) {
+	const mb = 1024 * 1024
+	cd := &congestionDetector{}
+	steps := []struct {
+		name    string
+		latency time.Duration // 0 for no requests in the step
+		speed   float64
+		active  int
+		want    int64
+	}{
+		{name: "first reading sets the base latency", latency: 20 * time.Millisecond, speed: mb, active: 2, want: 0},
+		{name: "a little slower is fine", latency: 35 * time.Millisecond, speed: mb, active: 2, want: 0},
+		{name: "inflated latency holds us below our speed", latency: 300 * time.Millisecond, speed: mb, active: 2, want: mb * 8 / 10},
+		{name: "a binding limit is raised", latency: 20 * time.Millisecond, speed: mb * 8 / 10, active: 2, want: mb*8/10 + mb*8/100 + 64*1024},
+		{name: "speed halving with the same tasks is congestion", speed: 300 * 1024, active: 2, want: 240 * 1024},
+		{name: "no requests and no change keeps the limit", speed: 200 * 1024, active: 2, want: 240 * 1024},
+		{name: "fewer tasks far below the limit let it go", speed: 60 * 1024, active: 1, want: 0},
+		{name: "nothing to hold back stays unlimited", speed: 60 * 1024, active: 1, want: 0},
+		{name: "inflation at a crawl keeps the floor", latency: 500 * time.Millisecond, speed: 10 * 1024, active: 1, want: minAutoLimit},
+	}
+	for _, step := range steps {
+		if step.latency > 0 {
+			cd.observeLatency(step.latency)
+			cd.observeLatency(step.latency)
+		}
+		if got := cd.update(step.speed, step.active); got != step.want {
+			t.Fatalf("%s: limit %d, want %d", step.name, got, step.want)
+		}
+	}
+}
+
+func TestCongestionNeedsTraffic(t *testing.T) {
+	cd := &congestionDetector{}
+	cd.observeLatency(10 * time.Millisecond)
+	cd.update(0, 0)
+	cd.observeLatency(time.Second)
+	if got := cd.update(0, 0); got != 0 {
+		t.Errorf("limited to %d with nothing downloading", got)
+	}
+}
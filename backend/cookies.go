@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/publicsuffix"
+)
+
+// storedCookie is one cookie of the jar as saved in cookies.json.
+type storedCookie struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain"`   // without a leading dot
+	HostOnly bool      `json:"hostOnly"` // sent to Domain only, not its subdomains
+	Path     string    `json:"path"`
+	Secure   bool      `json:"secure"`
+	HttpOnly bool      `json:"httpOnly"`
+	Expires  time.Time `json:"expires,omitzero"` // zero for session cookies, which are kept until cleared
+}
+
+func (c *storedCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !c.Expires.After(now)
+}
+
+// matches reports whether c goes with a request for u.
+func (c *storedCookie) matches(u *neturl.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	if c.HostOnly {
+		if host != c.Domain {
+			return false
+		}
+	} else if host != c.Domain && (!strings.HasSuffix(host, "."+c.Domain) || net.ParseIP(host) != nil) {
+		return false
+	}
+	if c.Secure && u.Scheme != "https" && u.Scheme != "ftps" {
+		return false
+	}
+
+	reqPath := u.Path
+	if reqPath == "" {
+		reqPath = "/"
+	}
+	if reqPath == c.Path {
+		return true
+	}
+	return strings.HasPrefix(reqPath, c.Path) && (strings.HasSuffix(c.Path, "/") || reqPath[len(c.Path)] == '/')
+}
+
+// cookieJar is the jar of the shared HTTP clients. It holds imported
+// cookies and the ones servers set, and keeps them in a file across runs.
+type cookieJar struct {
+	cookies  []storedCookie
+	fileName string
+	mu       sync.Mutex
+}
+
+func newCookieJar(fileName string) *cookieJar {
+	return &cookieJar{fileName: fileName}
+}
+
+// Cookies returns the cookies to send with a request for u, longer paths
+// first.
+func (j *cookieJar) Cookies(u *neturl.URL) []*http.Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	var found []*storedCookie
+	for i := range j.cookies {
+		if c := &j.cookies[i]; !c.expired(now) && c.matches(u) {
+			found = append(found, c)
+		}
+	}
+	sort.SliceStable(found, func(a, b int) bool {
+		return len(found[a].Path) > len(found[b].Path)
+	})
+
+	cookies := make([]*http.Cookie, len(found))
+	for i, c := range found {
+		cookies[i] = &http.Cookie{Name: c.Name, Value: c.Value}
+	}
+	return cookies
+}
+
+// isPublicSuffix reports whether domain is one under which anyone can
+// register names, by the Public Suffix List.
+func isPublicSuffix(domain string) bool {
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+	return suffix == domain
+}
+
+// SetCookies keeps the cookies a server set in its response to u.
+func (j *cookieJar) SetCookies(u *neturl.URL, cookies []*http.Cookie) {
+	host := strings.ToLower(u.Hostname())
+	now := time.Now()
+
+	var changed []storedCookie
+	for _, hc := range cookies {
+		c := storedCookie{Name: hc.Name, Value: hc.Value, Domain: host, HostOnly: true, Path: hc.Path, Secure: hc.Secure, HttpOnly: hc.HttpOnly}
+		if domain := strings.ToLower(strings.TrimPrefix(hc.Domain, ".")); domain != "" && domain != host {
+			//A server may only set cookies for itself and the domains above it, and not for a public suffix like com or co.uk
+			if !strings.HasSuffix(host, "."+domain) || isPublicSuffix(domain) || net.ParseIP(host) != nil {
+				continue
+			}
+			c.Domain, c.HostOnly = domain, false
+		} else if domain != "" && !isPublicSuffix(domain) {
+			//A host that is itself a public suffix only gets its own cookies
+			c.HostOnly = false
+		}
+		if c.Path == "" || !strings.HasPrefix(c.Path, "/") {
+			c.Path = path.Dir(u.Path)
+			if c.Path == "." {
+				c.Path = "/"
+			}
+		}
+		switch {
+		case hc.MaxAge < 0:
+			c.Expires = now
+		case hc.MaxAge > 0:
+			c.Expires = now.Add(time.Duration(hc.MaxAge) * time.Second)
+		case !hc.Expires.IsZero():
+			c.Expires = hc.Expires
+		}
+		changed = append(changed, c)
+	}
+	if len(changed) > 0 {
+		j.add(changed)
+	}
+}
+
+// add stores cookies in place of the ones with the same name, domain and
+// path, and saves the jar if that changed anything. Expired cookies delete
+// their stored counterpart.
+func (j *cookieJar) add(cookies []storedCookie) int {
+	j.mu.Lock()
+	now := time.Now()
+	dirty := false
+	for _, c := range cookies {
+		found := false
+		for i := range j.cookies {
+			old := &j.cookies[i]
+			if old.Name == c.Name && old.Domain == c.Domain && old.Path == c.Path {
+				if *old != c {
+					*old = c
+					dirty = true
+				}
+				found = true
+				break
+			}
+		}
+		if !found && !c.expired(now) {
+			j.cookies = append(j.cookies, c)
+			dirty = true
+		}
+	}
+	if dirty {
+		j.saveLocked()
+	}
+	total := len(j.cookies)
+	j.mu.Unlock()
+	return total
+}
+
+// remove drops every cookie for domain and its subdomains, or all of them
+// when domain is empty, and returns how many it dropped.
+func (j *cookieJar) remove(domain string) int {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	kept := j.cookies[:0]
+	for _, c := range j.cookies {
+		if domain != "" && c.Domain != domain && !strings.HasSuffix(c.Domain, "."+domain) {
+			kept = append(kept, c)
+		}
+	}
+	removed := len(j.cookies) - len(kept)
+	j.cookies = kept
+	if removed > 0 {
+		j.saveLocked()
+	}
+	return removed
+}
+
+// saveLocked writes the unexpired cookies to the jar's file. The caller
+// holds j.mu.
+func (j *cookieJar) saveLocked() {
+	now := time.Now()
+	live := j.cookies[:0]
+	for _, c := range j.cookies {
+		if !c.expired(now) {
+			live = append(live, c)
+		}
+	}
+	j.cookies = live
+
+	bytes, err := json.MarshalIndent(j.cookies, "", " ")
+	if err != nil {
+		log.Println("Error marshalling cookies:", err)
+		return
+	}
+	//Cookies are logins, keep them away from other users
+	if err := writeFileAtomic(j.fileName, bytes, 0600); err != nil {
+		log.Println("Error saving cookies:", err)
+	}
+}
+
+func (j *cookieJar) load() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	bytes, err := os.ReadFile(j.fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Error reading cookie jar:", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(bytes, &j.cookies); err != nil {
+		log.Println("Error parsing", j.fileName, err)
+	}
+}
+
+// parseCookies reads a Netscape cookies.txt or the JSON export of a browser
+// extension (EditThisCookie, Cookie-Editor), DevTools or Playwright.
+func parseCookies(data []byte) ([]storedCookie, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, errors.New("no cookies in file")
+	}
+	if trimmed[0] == '[' || trimmed[0] == '{' {
+		return parseCookieExport(trimmed)
+	}
+	return parseNetscapeCookies(bytes.NewReader(trimmed))
+}
+
+// parseNetscapeCookies reads the tab separated format of curl and wget:
+// domain, include subdomains, path, secure, expiry, name and value.
+func parseNetscapeCookies(r io.Reader) ([]storedCookie, error) {
+	var cookies []storedCookie
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := false
+		if rest, ok := strings.CutPrefix(line, "#HttpOnly_"); ok {
+			line, httpOnly = rest, true
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) == 6 {
+			//Cookies without a value drop the last field
+			fields = append(fields, "")
+		}
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: expected 7 tab separated fields, got %d", lineNo, len(fields))
+		}
+		c := storedCookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Domain:   strings.ToLower(strings.TrimPrefix(fields[0], ".")),
+			HostOnly: !strings.EqualFold(fields[1], "TRUE"),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry %q", lineNo, fields[4])
+		}
+		if expiry > 0 {
+			c.Expires = time.Unix(expiry, 0)
+		}
+		cookies = append(cookies, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(cookies) == 0 {
+		return nil, errors.New("no cookies in file")
+	}
+	return cookies, nil
+}
+
+// exportedCookie covers the fields of the common JSON cookie exports.
+type exportedCookie struct {
+	Name           string  `json:"name"`
+	Value          string  `json:"value"`
+	Domain         string  `json:"domain"`
+	HostOnly       *bool   `json:"hostOnly"`
+	Path           string  `json:"path"`
+	Secure         bool    `json:"secure"`
+	HttpOnly       bool    `json:"httpOnly"`
+	Session        bool    `json:"session"`
+	ExpirationDate float64 `json:"expirationDate"` // browser extensions
+	Expires        float64 `json:"expires"`        // DevTools and Playwright, -1 for session cookies
+}
+
+func parseCookieExport(data []byte) ([]storedCookie, error) {
+	var exported []exportedCookie
+	if data[0] == '{' {
+		//Playwright's storage state wraps them
+		var state struct {
+			Cookies []exportedCookie `json:"cookies"`
+		}
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, err
+		}
+		exported = state.Cookies
+	} else if err := json.Unmarshal(data, &exported); err != nil {
+		return nil, err
+	}
+
+	var cookies []storedCookie
+	for _, e := range exported {
+		if e.Name == "" || e.Domain == "" {
+			continue
+		}
+		c := storedCookie{
+			Name:     e.Name,
+			Value:    e.Value,
+			Domain:   strings.ToLower(strings.TrimPrefix(e.Domain, ".")),
+			HostOnly: !strings.HasPrefix(e.Domain, "."),
+			Path:     e.Path,
+			Secure:   e.Secure,
+			HttpOnly: e.HttpOnly,
+		}
+		if e.HostOnly != nil {
+			c.HostOnly = *e.HostOnly
+		}
+		if c.Path == "" {
+			c.Path = "/"
+		}
+		expiry := e.ExpirationDate
+		if expiry == 0 {
+			expiry = e.Expires
+		}
+		if !e.Session && expiry > 0 {
+			seconds, fraction := math.Modf(expiry)
+			c.Expires = time.Unix(int64(seconds), int64(fraction*1e9))
+		}
+		cookies = append(cookies, c)
+	}
+	if len(cookies) == 0 {
+		return nil, errors.New("no cookies in file")
+	}
+	return cookies, nil
+}
+
+// ImportCookiesHandler adds the cookies of an uploaded cookies.txt or JSON
+// export, sent as the "file" field of a form or as the raw body, to the jar.
+func (dm *DownloadManager) ImportCookiesHandler(c *gin.Context) {
+	var body io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, 16*1024*1024))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cookies, err := parseCookies(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cookie file: " + err.Error()})
+		return
+	}
+
+	total := dm.cookies.add(cookies)
+	log.Println("Imported", len(cookies), "cookies")
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Cookies imported",
+		"imported": len(cookies),
+		"total":    total,
+	})
+}
+
+// ListCookiesHandler lists the cookies in the jar, without their values.
+func (dm *DownloadManager) ListCookiesHandler(c *gin.Context) {
+	dm.cookies.mu.Lock()
+	defer dm.cookies.mu.Unlock()
+
+	now := time.Now()
+	list := make([]gin.H, 0, len(dm.cookies.cookies))
+	for _, cookie := range dm.cookies.cookies {
+		if cookie.expired(now) {
+			continue
+		}
+		entry := gin.H{
+			"name":     cookie.Name,
+			"domain":   cookie.Domain,
+			"hostOnly": cookie.HostOnly,
+			"path":     cookie.Path,
+			"secure":   cookie.Secure,
+		}
+		if !cookie.Expires.IsZero() {
+			entry["expires"] = cookie.Expires
+		}
+		list = append(list, entry)
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// ClearCookiesHandler removes the cookies of the domain query parameter, or
+// all of them without one.
+func (dm *DownloadManager) ClearCookiesHandler(c *gin.Context) {
+	removed := dm.cookies.remove(c.Query("domain"))
+	c.JSON(http.StatusOK, gin.H{"message": "Cookies removed", "removed": removed})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	neturl "net/url"
+	"os"
+	"testing"
+)
+
+func TestCookieJarSetCookies(t *testing.T) {
+	t.Chdir(t.TempDir())
+	j := newCookieJar("cookies.json")
+	u, _ := neturl.Parse("https://shop.example.co.uk/cart")
+	j.SetCookies(u, []*http.Cookie{
+		{Name: "site", Value: "1", Domain: "example.co.uk"},
+		{Name: "suffix", Value: "2", Domain: ".co.uk"},
+		{Name: "tld", Value: "3", Domain: "uk"},
+		{Name: "other", Value: "4", Domain: "other.co.uk"},
+	})
+
+	//Only the cookie for the site itself may reach its other hosts
+	other, _ := neturl.Parse("https://www.example.co.uk/")
+	if got := j.Cookies(other); len(got) != 1 || got[0].Name != "site" {
+		t.Errorf("cookies for %s are %v", other, got)
+	}
+	stranger, _ := neturl.Parse("https://bank.co.uk/")
+	if got := j.Cookies(stranger); len(got) != 0 {
+		t.Errorf("cookies set for a public suffix reached %s: %v", stranger, got)
+	}
+
+	//A host that is a public suffix itself keeps its cookies to itself
+	suffix, _ := neturl.Parse("https://github.io/")
+	j.SetCookies(suffix, []*http.Cookie{{Name: "own", Value: "5", Domain: "github.io"}})
+	if got := j.Cookies(suffix); len(got) != 1 || got[0].Name != "own" {
+		t.Errorf("cookies for %s are %v", suffix, got)
+	}
+	page, _ := neturl.Parse("https://someone.github.io/")
+	if got := j.Cookies(page); len(got) != 0 {
+		t.Errorf("cookies of a public suffix reached %s: %v", page, got)
+	}
+
+	if info, err := os.Stat("cookies.json"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("cookies.json is not private: %v", err)
+	}
+}
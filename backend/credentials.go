@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hostCredential is the login for one host: a username and password,
+// answered to Basic and Digest challenges, or a bearer token.
+type hostCredential struct {
+	Host     string `json:"host"` // "example.com" or "example.com:8443"
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// credentialStore keeps the per-host logins in a file next to
+// settings.json, with passwords and tokens encrypted by a key of its own.
+type credentialStore struct {
+	creds    map[string]hostCredential
+	fileName string
+	keyFile  string
+	key      []byte
+	mu       sync.Mutex
+}
+
+func newCredentialStore(fileName string, keyFile string) *credentialStore {
+	return &credentialStore{creds: make(map[string]hostCredential), fileName: fileName, keyFile: keyFile}
+}
+
+// lookup returns the login for the host of u, one saved with the port
+// taking precedence over one for the host name alone.
+func (cs *credentialStore) lookup(u *neturl.URL) (hostCredential, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cred, ok := cs.creds[strings.ToLower(u.Host)]; ok {
+		return cred, true
+	}
+	cred, ok := cs.creds[strings.ToLower(u.Hostname())]
+	return cred, ok
+}
+
+func (cs *credentialStore) set(cred hostCredential) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cred.Host = strings.ToLower(cred.Host)
+	cs.creds[cred.Host] = cred
+	return cs.saveLocked()
+}
+
+func (cs *credentialStore) remove(host string) (bool, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	host = strings.ToLower(host)
+	if _, ok := cs.creds[host]; !ok {
+		return false, nil
+	}
+	delete(cs.creds, host)
+	return true, cs.saveLocked()
+}
+
+// encryptionKey reads the store's key, making one on first use. Only this
+// user can read it, like the SSH keys next to it in a home directory would.
+func (cs *credentialStore) encryptionKey() ([]byte, error) {
+	if cs.key != nil {
+		return cs.key, nil
+	}
+	key, err := os.ReadFile(cs.keyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(cs.keyFile, key, 0600); err != nil {
+			return nil, fmt.Errorf("saving key: %w", err)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s is not a 256 bit key", cs.keyFile)
+	}
+	cs.key = key
+	return key, nil
+}
+
+func (cs *credentialStore) newGCM() (cipher.AEAD, error) {
+	key, err := cs.encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts a secret with AES-256-GCM as base64(nonce | ciphertext).
+func seal(gcm cipher.AEAD, secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+func unseal(gcm cipher.AEAD, sealed string) (string, error) {
+	if sealed == "" {
+		return "", nil
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", errors.New("malformed secret")
+	}
+	secret, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("secret does not decrypt with the current key")
+	}
+	return string(secret), nil
+}
+
+// saveLocked writes the store with its secrets sealed. The caller holds
+// cs.mu.
+func (cs *credentialStore) saveLocked() error {
+	gcm, err := cs.newGCM()
+	if err != nil {
+		return err
+	}
+	saved := make([]hostCredential, 0, len(cs.creds))
+	for _, cred := range cs.creds {
+		if cred.Password, err = seal(gcm, cred.Password); err != nil {
+			return err
+		}
+		if cred.Token, err = seal(gcm, cred.Token); err != nil {
+			return err
+		}
+		saved = append(saved, cred)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Host < saved[j].Host })
+
+	bytes, err := json.MarshalIndent(saved, "", " ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cs.fileName, bytes, 0600)
+}
+
+func (cs *credentialStore) load() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	bytes, err := os.ReadFile(cs.fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Error reading credentials:", err)
+		}
+		return
+	}
+	var saved []hostCredential
+	if err := json.Unmarshal(bytes, &saved); err != nil {
+		log.Println("Error parsing", cs.fileName, err)
+		return
+	}
+	gcm, err := cs.newGCM()
+	if err != nil {
+		log.Println("Error loading credential key:", err)
+		return
+	}
+	for _, cred := range saved {
+		password, err := unseal(gcm, cred.Password)
+		if err == nil {
+			cred.Password = password
+			cred.Token, err = unseal(gcm, cred.Token)
+		}
+		if err != nil {
+			log.Println("Skipping credentials for", cred.Host+":", err)
+			continue
+		}
+		cs.creds[cred.Host] = cred
+	}
+}
+
+// parseNetrc reads the machine entries of a .netrc file. The default entry
+// is skipped, it would hand the login to every host.
+func parseNetrc(r io.Reader) ([]hostCredential, error) {
+	scanner := bufio.NewScanner(r)
+	var tokens []string
+	inMacro := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		//A macro definition runs until the next empty line
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i, field := range fields {
+			if field == "macdef" {
+				fields = fields[:i]
+				inMacro = true
+				break
+			}
+		}
+		tokens = append(tokens, fields...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var creds []hostCredential
+	current := -1 //index of the machine being read, -1 in the default entry
+	for i := 0; i < len(tokens); i++ {
+		var value string
+		if i+1 < len(tokens) {
+			value = tokens[i+1]
+		}
+		switch tokens[i] {
+		case "machine":
+			creds = append(creds, hostCredential{Host: strings.ToLower(value)})
+			current = len(creds) - 1
+			i++
+		case "default":
+			current = -1
+		case "login":
+			if current >= 0 {
+				creds[current].Username = value
+			}
+			i++
+		case "password":
+			if current >= 0 {
+				creds[current].Password = value
+			}
+			i++
+		case "account", "port":
+			i++
+		}
+	}
+
+	valid := creds[:0]
+	for _, cred := range creds {
+		if cred.Host != "" && cred.Username != "" {
+			valid = append(valid, cred)
+		}
+	}
+	return valid, nil
+}
+
+// netrcPath is $NETRC, or .netrc in the home directory.
+func netrcPath() (string, error) {
+	if p := os.Getenv("NETRC"); p != "" {
+		return p, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".netrc"), nil
+}
+
+// ListCredentialsHandler lists the saved hosts, never their secrets.
+func (dm *DownloadManager) ListCredentialsHandler(c *gin.Context) {
+	dm.credentials.mu.Lock()
+	defer dm.credentials.mu.Unlock()
+
+	list := make([]gin.H, 0, len(dm.credentials.creds))
+	for _, cred := range dm.credentials.creds {
+		list = append(list, gin.H{
+			"host":        cred.Host,
+			"username":    cred.Username,
+			"hasPassword": cred.Password != "",
+			"hasToken":    cred.Token != "",
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i]["host"].(string) < list[j]["host"].(string) })
+	c.JSON(http.StatusOK, list)
+}
+
+// SaveCredentialHandler adds or replaces the login of a host.
+func (dm *DownloadManager) SaveCredentialHandler(c *gin.Context) {
+	var cred hostCredential
+	if err := c.ShouldBindJSON(&cred); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cred.Host = strings.TrimSpace(cred.Host)
+	if cred.Host == "" || strings.ContainsAny(cred.Host, "/ @") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "host must be a host name, optionally with a port"})
+		return
+	}
+	if cred.Token == "" && cred.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Either a username or a token is required"})
+		return
+	}
+
+	if err := dm.credentials.set(cred); err != nil {
+		log.Println("Error saving credentials:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot save credentials"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Credentials saved"})
+}
+
+// DeleteCredentialHandler forgets the login of the host query parameter.
+func (dm *DownloadManager) DeleteCredentialHandler(c *gin.Context) {
+	removed, err := dm.credentials.remove(c.Query("host"))
+	if err != nil {
+		log.Println("Error saving credentials:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot save credentials"})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No credentials for that host"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Credentials deleted"})
+}
+
+// ImportNetrcHandler imports the .netrc in the request body, or the user's
+// own one when the body is empty.
+func (dm *DownloadManager) ImportNetrcHandler(c *gin.Context) {
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, 1024*1024))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		p, err := netrcPath()
+		if err == nil {
+			data, err = os.ReadFile(p)
+		}
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No .netrc found: " + err.Error()})
+			return
+		}
+	}
+
+	creds, err := parseNetrc(strings.NewReader(string(data)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid .netrc: " + err.Error()})
+		return
+	}
+	for _, cred := range creds {
+		if err := dm.credentials.set(cred); err != nil {
+			log.Println("Error saving credentials:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot save credentials"})
+			return
+		}
+	}
+	log.Println("Imported", len(creds), "logins from .netrc")
+	c.JSON(http.StatusOK, gin.H{"message": "Credentials imported", "imported": len(creds)})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	neturl "net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseNetrc(t *testing.T) {
+	creds, err := parseNetrc(strings.NewReader(`# work
+machine Files.Example.com login joe password s3cret
+machine ftp.example.com
+	login anon
+	account ignored password guest
+
+macdef init
+cd /pub
+machine macro.example.com login nobody password none
+
+default login everyone password everywhere
+machine nologin.example.com password only
+machine last.example.com login last port 21`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []hostCredential{
+		{Host: "files.example.com", Username: "joe", Password: "s3cret"},
+		{Host: "ftp.example.com", Username: "anon", Password: "guest"},
+		{Host: "last.example.com", Username: "last"},
+	}
+	if len(creds) != len(want) {
+		t.Fatalf("got %+v, want %+v", creds, want)
+	}
+	for i := range want {
+		if creds[i] != want[i] {
+			t.Errorf("entry %d is %+v, want %+v", i, creds[i], want[i])
+		}
+	}
+}
+
+func TestCredentialStoreSealsSecrets(t *testing.T) {
+	t.Chdir(t.TempDir())
+	cs := newCredentialStore("credentials.json", "credentials.key")
+	if err := cs.set(hostCredential{Host: "Example.com", Username: "joe", Password: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.set(hostCredential{Host: "api.example.com:8443", Token: "t0ken"}); err != nil {
+		t.Fatal(err)
+	}
+
+	bytes, err := os.ReadFile("credentials.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(bytes), "hunter2") || strings.Contains(string(bytes), "t0ken") {
+		t.Errorf("credentials.json holds secrets in the clear:\n%s", bytes)
+	}
+	for _, name := range []string{"credentials.json", "credentials.key"} {
+		if info, err := os.Stat(name); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("%s is not private: %v", name, err)
+		}
+	}
+
+	loaded := newCredentialStore("credentials.json", "credentials.key")
+	loaded.load()
+	u, _ := neturl.Parse("https://EXAMPLE.com/file")
+	if cred, ok := loaded.lookup(u); !ok || cred.Password != "hunter2" {
+		t.Errorf("lookup of %s gave %+v, %v", u, cred, ok)
+	}
+	u, _ = neturl.Parse("https://api.example.com:8443/v1")
+	if cred, ok := loaded.lookup(u); !ok || cred.Token != "t0ken" {
+		t.Errorf("lookup of %s gave %+v, %v", u, cred, ok)
+	}
+	u, _ = neturl.Parse("https://api.example.com/v1")
+	if cred, ok := loaded.lookup(u); ok {
+		t.Errorf("login for another port used: %+v", cred)
+	}
+
+	if removed, err := loaded.remove("example.com"); !removed || err != nil {
+		t.Errorf("remove gave %v, %v", removed, err)
+	}
+	if removed, _ := loaded.remove("example.com"); removed {
+		t.Error("removed a host twice")
+	}
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The parts of an MPD (ISO/IEC 23009-1) needed to list the segments of one
+// representation. Segment information on an AdaptationSet applies to every
+// Representation in it that has none of its own.
+type mpdDoc struct {
+	Type     string      `xml:"type,attr"`
+	Duration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURL  string      `xml:"BaseURL"`
+	Periods  []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Duration       string             `xml:"duration,attr"`
+	BaseURL        string             `xml:"BaseURL"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	MimeType        string              `xml:"mimeType,attr"`
+	ContentType     string              `xml:"contentType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	Id              string              `xml:"id,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	Bandwidth       int64               `xml:"bandwidth,attr"`
+	Width           int                 `xml:"width,attr"`
+	Height          int                 `xml:"height,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+}
+
+type mpdSegmentTemplate struct {
+	Media          string `xml:"media,attr"`
+	Initialization string `xml:"initialization,attr"`
+	StartNumber    string `xml:"startNumber,attr"`
+	Timescale      int64  `xml:"timescale,attr"`
+	Duration       int64  `xml:"duration,attr"`
+	Timeline       []mpdS `xml:"SegmentTimeline>S"`
+}
+
+// mpdS is one SegmentTimeline entry: r more segments of duration d from t.
+type mpdS struct {
+	T *int64 `xml:"t,attr"`
+	D int64  `xml:"d,attr"`
+	R int64  `xml:"r,attr"`
+}
+
+type mpdSegmentList struct {
+	Initialization *mpdUrl         `xml:"Initialization"`
+	SegmentUrls    []mpdSegmentUrl `xml:"SegmentURL"`
+}
+
+type mpdSegmentUrl struct {
+	Media      string `xml:"media,attr"`
+	MediaRange string `xml:"mediaRange,attr"`
+}
+
+type mpdSegmentBase struct {
+	IndexRange     string  `xml:"indexRange,attr"`
+	Initialization *mpdUrl `xml:"Initialization"`
+}
+
+type mpdUrl struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr"`
+}
+
+// dashRepresentation is a representation with everything it inherits
+// resolved, ready to list its segments.
+type dashRepresentation struct {
+	streamVariant
+	Id       string
+	MimeType string
+	BaseUrl  *neturl.URL
+	Template *mpdSegmentTemplate
+	List     *mpdSegmentList
+	Base     *mpdSegmentBase
+}
+
+func (r *dashRepresentation) kind() string {
+	kind, _, _ := strings.Cut(r.MimeType, "/")
+	return kind
+}
+
+// extension returns the file extension for the representation's container.
+func (r *dashRepresentation) extension() string {
+	switch {
+	case strings.HasSuffix(r.MimeType, "webm"):
+		return ".webm"
+	case r.kind() == "audio":
+		return ".m4a"
+	}
+	return ".mp4"
+}
+
+func parseMPD(data []byte) (*mpdDoc, error) {
+	var doc mpdDoc
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid MPD: %w", err)
+	}
+	if len(doc.Periods) == 0 {
+		return nil, errors.New("MPD has no periods")
+	}
+	return &doc, nil
+}
+
+// representations lists the representations of the first period.
+func (doc *mpdDoc) representations(mpdUrl *neturl.URL) ([]dashRepresentation, error) {
+	join := func(base *neturl.URL, ref string) (*neturl.URL, error) {
+		ref = strings.TrimSpace(ref)
+		if ref == "" {
+			return base, nil
+		}
+		return base.Parse(ref)
+	}
+
+	if len(doc.Periods) > 1 {
+		log.Println("MPD has", len(doc.Periods), "periods, only the first is downloaded")
+	}
+	period := doc.Periods[0]
+	periodBase, err := join(mpdUrl, doc.BaseURL)
+	if err == nil {
+		periodBase, err = join(periodBase, period.BaseURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var reps []dashRepresentation
+	for _, as := range period.AdaptationSets {
+		asBase, err := join(periodBase, as.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range as.Representations {
+			rep := dashRepresentation{
+				streamVariant: streamVariant{Bandwidth: r.Bandwidth, Width: r.Width, Height: r.Height},
+				Id:            r.Id,
+				MimeType:      r.MimeType,
+				Template:      r.SegmentTemplate,
+				List:          r.SegmentList,
+				Base:          r.SegmentBase,
+			}
+			if rep.MimeType == "" {
+				rep.MimeType = as.MimeType
+			}
+			if rep.MimeType == "" && as.ContentType != "" {
+				rep.MimeType = as.ContentType + "/mp4"
+			}
+			if rep.Template == nil && rep.List == nil && rep.Base == nil {
+				rep.Template, rep.List, rep.Base = as.SegmentTemplate, as.SegmentList, as.SegmentBase
+			}
+			rep.BaseUrl, err = join(asBase, r.BaseURL)
+			if err != nil {
+				return nil, err
+			}
+			reps = append(reps, rep)
+		}
+	}
+	return reps, nil
+}
+
+// periodSeconds is how long the first period runs, 0 if the MPD does not say.
+func (doc *mpdDoc) periodSeconds() float64 {
+	if d := parseISODuration(doc.Periods[0].Duration); d > 0 {
+		return d
+	}
+	return parseISODuration(doc.Duration)
+}
+
+var isoDuration = regexp.MustCompile(`^PT?(?:(\d+)D)?T?(?:(\d+)H)?(?:(\d+)M)?(?:([\d.]+)S)?$`)
+
+// parseISODuration reads the "PT1H2M3.5S" durations MPDs use.
+func parseISODuration(s string) float64 {
+	m := isoDuration.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0
+	}
+	var seconds float64
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if v, err := strconv.ParseFloat(m[i+1], 64); err == nil {
+			seconds += v * unit
+		}
+	}
+	return seconds
+}
+
+var templateVar = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time)(%0\d+d)?\$`)
+
+// expandTemplate fills in the $...$ identifiers of a SegmentTemplate URL.
+func expandTemplate(tmpl string, rep *dashRepresentation, number int64, time int64) string {
+	s := templateVar.ReplaceAllStringFunc(tmpl, func(v string) string {
+		m := templateVar.FindStringSubmatch(v)
+		format := "%d"
+		if m[2] != "" {
+			format = m[2]
+		}
+		switch m[1] {
+		case "RepresentationID":
+			return rep.Id
+		case "Number":
+			return fmt.Sprintf(format, number)
+		case "Bandwidth":
+			return fmt.Sprintf(format, rep.Bandwidth)
+		}
+		return fmt.Sprintf(format, time)
+	})
+	return strings.ReplaceAll(s, "$$", "$")
+}
+
+// parseByteRange reads the "first-last" ranges of SegmentList and SegmentBase.
+func parseByteRange(s string) (int64, int64, error) {
+	first, last, found := strings.Cut(s, "-")
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if !found || err1 != nil || err2 != nil || end < start {
+		return 0, 0, fmt.Errorf("invalid byte range %q", s)
+	}
+	return start, end - start + 1, nil
+}
+
+// dashSegments lists the init segment followed by the media segments of rep.
+func (dm *DownloadManager) dashSegments(ctx context.Context, client *http.Client, doc *mpdDoc, rep *dashRepresentation, opts requestOptions) ([]mediaSegment, error) {
+	resolve := func(ref string) (string, error) {
+		u, err := rep.BaseUrl.Parse(ref)
+		if err != nil {
+			return "", err
+		}
+		return u.String(), nil
+	}
+	var segments []mediaSegment
+
+	switch {
+	case rep.Template != nil:
+		t := rep.Template
+		timescale := max(t.Timescale, 1)
+		number := int64(1)
+		if t.StartNumber != "" {
+			number, _ = strconv.ParseInt(t.StartNumber, 10, 64)
+		}
+		if t.Initialization != "" {
+			u, err := resolve(expandTemplate(t.Initialization, rep, 0, 0))
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, mediaSegment{Url: u})
+		}
+
+		add := func(time int64) error {
+			u, err := resolve(expandTemplate(t.Media, rep, number, time))
+			if err != nil {
+				return err
+			}
+			segments = append(segments, mediaSegment{Url: u})
+			number++
+			return nil
+		}
+
+		if len(t.Timeline) > 0 {
+			periodEnd := int64(doc.periodSeconds() * float64(timescale))
+			var time int64
+			for i, s := range t.Timeline {
+				if s.T != nil {
+					time = *s.T
+				}
+				if s.D <= 0 {
+					return nil, errors.New("SegmentTimeline entry without a duration")
+				}
+				repeat := s.R
+				//A negative repeat runs up to the next entry, or the end of the period
+				if repeat < 0 {
+					until := periodEnd
+					if i+1 < len(t.Timeline) && t.Timeline[i+1].T != nil {
+						until = *t.Timeline[i+1].T
+					}
+					if until <= time {
+						return nil, errors.New("open ended SegmentTimeline in an MPD without a duration")
+					}
+					repeat = (until-time+s.D-1)/s.D - 1
+				}
+				for range repeat + 1 {
+					if err := add(time); err != nil {
+						return nil, err
+					}
+					time += s.D
+				}
+			}
+		} else {
+			seconds := doc.periodSeconds()
+			if t.Duration <= 0 || seconds <= 0 {
+				return nil, errors.New("cannot count the segments of a live MPD without a SegmentTimeline")
+			}
+			count := int64(math.Ceil(seconds * float64(timescale) / float64(t.Duration)))
+			for i := range count {
+				if err := add(i * t.Duration); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+	case rep.List != nil:
+		base := rep.BaseUrl.String()
+		if rep.List.Initialization != nil {
+			seg, err := mpdUrlSegment(rep.List.Initialization.SourceURL, rep.List.Initialization.Range, base, resolve)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, seg)
+		}
+		for _, su := range rep.List.SegmentUrls {
+			seg, err := mpdUrlSegment(su.Media, su.MediaRange, base, resolve)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, seg)
+		}
+
+	case rep.Base != nil && rep.Base.IndexRange != "":
+		return dm.sidxSegments(ctx, client, rep, opts)
+
+	default:
+		//A single file with no index, split it by size
+		segments = fileRanges(ctx, client, rep.BaseUrl.String(), opts)
+	}
+	return segments, nil
+}
+
+// fileRangeSize is how much of a single file representation one segment
+// covers.
+const fileRangeSize = 8 * 1024 * 1024
+
+// fileRanges splits a representation that is one plain file into byte
+// ranges, so it is fetched in parallel and a failed range is all that has to
+// be fetched again. Servers that don't tell the size or take ranges get the
+// file as one segment.
+func fileRanges(ctx context.Context, client *http.Client, fileUrl string, opts requestOptions) []mediaSegment {
+	whole := []mediaSegment{{Url: fileUrl}}
+	req, err := http.NewRequestWithContext(ctx, "HEAD", fileUrl, nil)
+	if err != nil {
+		return whole
+	}
+	opts.apply(req)
+	res, err := client.Do(req)
+	if err != nil {
+		log.Println("Cannot get the size of", fileUrl+":", err)
+		return whole
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 || res.ContentLength <= 0 || !strings.EqualFold(res.Header.Get("Accept-Ranges"), "bytes") {
+		return whole
+	}
+
+	var segments []mediaSegment
+	for offset := int64(0); offset < res.ContentLength; offset += fileRangeSize {
+		segments = append(segments, mediaSegment{Url: fileUrl, Offset: offset, Length: min(fileRangeSize, res.ContentLength-offset)})
+	}
+	return segments
+}
+
+func mpdUrlSegment(ref string, byteRange string, base string, resolve func(string) (string, error)) (mediaSegment, error) {
+	seg := mediaSegment{Url: base}
+	if ref != "" {
+		u, err := resolve(ref)
+		if err != nil {
+			return seg, err
+		}
+		seg.Url = u
+	}
+	if byteRange != "" {
+		offset, length, err := parseByteRange(byteRange)
+		if err != nil {
+			return seg, err
+		}
+		seg.Offset, seg.Length = offset, length
+	}
+	return seg, nil
+}
+
+// sidxSegments reads the segment index (sidx box) of a SegmentBase
+// representation and turns every subsegment it lists into a byte range.
+func (dm *DownloadManager) sidxSegments(ctx context.Context, client *http.Client, rep *dashRepresentation, opts requestOptions) ([]mediaSegment, error) {
+	fileUrl := rep.BaseUrl.String()
+	indexOffset, indexLength, err := parseByteRange(rep.Base.IndexRange)
+	if err != nil {
+		return nil, err
+	}
+	index, err := fetchRange(ctx, client, fileUrl, indexOffset, indexLength, opts, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetching segment index: %w", err)
+	}
+
+	//Everything before the index is the init segment unless the MPD says otherwise
+	init := mediaSegment{Url: fileUrl, Offset: 0, Length: indexOffset}
+	if rep.Base.Initialization != nil && rep.Base.Initialization.Range != "" {
+		init.Offset, init.Length, err = parseByteRange(rep.Base.Initialization.Range)
+		if err != nil {
+			return nil, err
+		}
+	}
+	segments := []mediaSegment{init}
+	//The index itself has to be in the output too, players read it to seek
+	if init.Offset+init.Length == indexOffset {
+		segments[0].Length += indexLength
+	} else {
+		segments = append(segments, mediaSegment{Url: fileUrl, Offset: indexOffset, Length: indexLength})
+	}
+
+	sizes, first, err := parseSidx(index)
+	if err != nil {
+		return nil, err
+	}
+	//The index range can hold more than the sidx box, offsets count from where the box ends
+	offset := indexOffset + first
+	for _, size := range sizes {
+		segments = append(segments, mediaSegment{Url: fileUrl, Offset: offset, Length: size})
+		offset += size
+	}
+	return segments, nil
+}
+
+// parseSidx returns the subsegment sizes listed in the first sidx box of
+// data, and where the first one starts counted from the start of data.
+func parseSidx(data []byte) ([]int64, int64, error) {
+	var start int64 //of the box being read in the index range
+	for len(data) >= 8 {
+		size := int64(binary.BigEndian.Uint32(data))
+		if size < 8 || size > int64(len(data)) {
+			return nil, 0, errors.New("truncated segment index")
+		}
+		if string(data[4:8]) != "sidx" {
+			data = data[size:]
+			start += size
+			continue
+		}
+
+		box := data[8:size]
+		if len(box) < 12 {
+			return nil, 0, errors.New("truncated sidx box")
+		}
+		version := box[0]
+		pos := 12 //version+flags, reference_ID, timescale
+		var firstOffset int64
+		if version == 0 {
+			if len(box) < pos+8 {
+				return nil, 0, errors.New("truncated sidx box")
+			}
+			firstOffset = int64(binary.BigEndian.Uint32(box[pos+4:]))
+			pos += 8
+		} else {
+			if len(box) < pos+16 {
+				return nil, 0, errors.New("truncated sidx box")
+			}
+			firstOffset = int64(binary.BigEndian.Uint64(box[pos+8:]))
+			pos += 16
+		}
+		if len(box) < pos+4 {
+			return nil, 0, errors.New("truncated sidx box")
+		}
+		count := int(binary.BigEndian.Uint16(box[pos+2:]))
+		pos += 4
+		if len(box) < pos+count*12 {
+			return nil, 0, errors.New("truncated sidx box")
+		}
+
+		sizes := make([]int64, 0, count)
+		for i := 0; i < count; i++ {
+			ref := binary.BigEndian.Uint32(box[pos+i*12:])
+			if ref&0x80000000 != 0 {
+				return nil, 0, errors.New("nested segment indexes are not supported")
+			}
+			sizes = append(sizes, int64(ref&0x7fffffff))
+		}
+		return sizes, start + size + firstOffset, nil
+	}
+	return nil, 0, errors.New("no sidx box in the index range")
+}
+
+// downloadDASH saves one representation of each kind in an MPD, the best
+// video and audio by default, as a fragmented MP4 (or WebM) file each.
+func (dm *DownloadManager) downloadDASH(ctx context.Context, taskId string, mpdUrl string) {
+	dm.semaphore <- struct{}{}
+	defer func() {
+		<-dm.semaphore
+	}()
+	log.Println("Analyzing DASH manifest:", mpdUrl)
+
+	var quality, saveAs string
+	var opts requestOptions
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].ID == taskId {
+			quality, saveAs = dm.Tasks[i].Quality, dm.Tasks[i].SaveAs
+			opts = dm.Tasks[i].requestOptions()
+			break
+		}
+	}
+	dm.dataMutex.Unlock()
+
+	fail := func(err error) {
+		log.Println("DASH error:", err)
+		dm.setTaskError(taskId, "DASH: "+err.Error())
+		SendError(taskId, "Failed to read manifest: "+err.Error())
+	}
+
+	client := dm.httpClient()
+	base, err := neturl.Parse(mpdUrl)
+	if err != nil {
+		fail(err)
+		return
+	}
+	data, err := fetchRange(ctx, client, mpdUrl, 0, 0, opts, nil)
+	if err != nil {
+		fail(err)
+		return
+	}
+	doc, err := parseMPD(data)
+	if err != nil {
+		fail(err)
+		return
+	}
+	reps, err := doc.representations(base)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	//One representation per kind, video by quality and audio by bandwidth
+	var picked []*dashRepresentation
+	for _, kind := range []string{"video", "audio"} {
+		var candidates []*dashRepresentation
+		var choices []streamVariant
+		for i := range reps {
+			if reps[i].kind() == kind {
+				candidates = append(candidates, &reps[i])
+				choices = append(choices, reps[i].streamVariant)
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		rule := quality
+		if kind == "audio" && quality != "worst" {
+			rule = "best"
+		}
+		picked = append(picked, candidates[pickVariant(choices, rule)])
+	}
+	if len(picked) == 0 {
+		fail(errors.New("no audio or video representations"))
+		return
+	}
+
+	baseName := saveAs
+	if baseName == "" {
+		baseName = path.Base(base.Path)
+	}
+	baseName = strings.TrimSuffix(baseName, path.Ext(baseName))
+	if baseName == "" || baseName == "." || baseName == "/" {
+		baseName = "stream"
+	}
+	baseName = sanitizeFileName(baseName)
+
+	stream := &streamManifest{}
+	var names []string
+	for _, rep := range picked {
+		segments, err := dm.dashSegments(ctx, client, doc, rep, opts)
+		if err != nil {
+			fail(fmt.Errorf("representation %s: %w", rep.Id, err))
+			return
+		}
+		fileName := baseName + rep.extension()
+		if len(picked) > 1 {
+			fileName = baseName + "." + rep.kind() + rep.extension()
+		}
+		stream.Tracks = append(stream.Tracks, streamTrack{FileName: fileName, Segments: segments})
+		names = append(names, rep.kind()+" "+rep.streamVariant.String())
+		stream.Source += rep.Id + ";"
+	}
+	log.Println("Picked representations:", strings.Join(names, ", "))
+
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].ID == taskId {
+			dm.Tasks[i].FileName = stream.Tracks[0].FileName
+			dm.Tasks[i].Variant = strings.Join(names, " + ")
+			break
+		}
+	}
+	dm.dataMutex.Unlock()
+	dm.SaveTasks()
+
+	dm.downloadStream(ctx, taskId, stream)
+}
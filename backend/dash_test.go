@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// sidxBox builds a version 0 sidx box listing subsegments of sizes, the
+// first one firstOffset bytes after the box.
+func sidxBox(firstOffset uint32, sizes ...uint32) []byte {
+	box := make([]byte, 32+12*len(sizes))
+	binary.BigEndian.PutUint32(box, uint32(len(box)))
+	copy(box[4:], "sidx")
+	binary.BigEndian.PutUint32(box[16:], 90000)       //timescale
+	binary.BigEndian.PutUint32(box[24:], firstOffset) //after earliest_presentation_time
+	binary.BigEndian.PutUint16(box[30:], uint16(len(sizes)))
+	for i, size := range sizes {
+		binary.BigEndian.PutUint32(box[32+i*12:], size)
+	}
+	return box
+}
+
+func TestParseSidx(t *testing.T) {
+	//A styp box ahead of the index and padding after it, both inside the index range
+	styp := make([]byte, 16)
+	binary.BigEndian.PutUint32(styp, 16)
+	copy(styp[4:], "styp")
+	sidx := sidxBox(10, 1000, 2000)
+	data := slices.Concat(styp, sidx, make([]byte, 64))
+
+	sizes, first, err := parseSidx(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(sizes, []int64{1000, 2000}) {
+		t.Errorf("sizes are %v", sizes)
+	}
+	if want := int64(len(styp) + len(sidx) + 10); first != want {
+		t.Errorf("first subsegment at %d, want %d", first, want)
+	}
+
+	if _, _, err := parseSidx(styp); err == nil {
+		t.Error("found a sidx box in a range without one")
+	}
+	if _, _, err := parseSidx(sidx[:40]); err == nil {
+		t.Error("read a truncated sidx box")
+	}
+	nested := sidxBox(0, 0x80000000|500)
+	if _, _, err := parseSidx(nested); err == nil {
+		t.Error("took a reference to another index for a subsegment")
+	}
+}
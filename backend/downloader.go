@@ -4,32 +4,23 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"mime"
-	"net"
 	"net/http"
-	neturl "net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/kkdai/youtube/v2"
 )
 
-// Part struct for handling chunks
-type Part struct {
-	Index int
-	Start int64
-	End   int64
-}
-
 func (dm *DownloadManager) processDownload(ctx context.Context, taskId string, downloadUrl string, customName ...string) {
 	dm.semaphore <- struct{}{}
 	defer func() {
@@ -37,13 +28,69 @@ func (dm *DownloadManager) processDownload(ctx context.Context, taskId string, d
 	}()
 	log.Println("Starting/Resuming download for: ", downloadUrl)
 
-	res, err := http.Head(downloadUrl)
+	var opts requestOptions
+	var method string
+	var resolved *Resolution
+	var mirrorUrls []string
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].ID == taskId {
+			opts = dm.Tasks[i].requestOptions()
+			method = dm.Tasks[i].Method
+			resolved = dm.Tasks[i].Resolved
+			mirrorUrls = dm.Tasks[i].Mirrors
+			break
+		}
+	}
+	dm.dataMutex.Unlock()
+	//The other URLs a resolver returned serve the file too
+	var resolvedHeader http.Header
+	if resolved != nil && len(resolved.Urls) > 0 && resolved.Urls[0] == downloadUrl {
+		resolvedHeader = resolved.Headers
+		mirrorUrls = slices.Concat(resolved.Urls[1:], mirrorUrls)
+	}
+
+	//One client per proxy/timeout setting, shared with the parts so they reuse this connection
+	client := dm.httpClient()
+	headReq, err := http.NewRequestWithContext(ctx, "HEAD", downloadUrl, nil)
+	if err != nil {
+		log.Println("Invalid URL: ", err)
+		dm.setTaskError(taskId, "Invalid URL")
+		SendError(taskId, "Invalid URL")
+		return
+	}
+	opts.apply(headReq)
+	sent := time.Now()
+	res, err := client.Do(headReq)
+	//The file can still be had from a mirror while the primary URL is down
+	if err != nil || res.StatusCode >= 400 {
+		for _, u := range mirrorUrls {
+			mirrorOpts := requestOptions{header: resolvedHeader}
+			sent = time.Now()
+			mirrorRes, mirrorErr := headFile(ctx, client, u, mirrorOpts)
+			if mirrorErr != nil {
+				continue
+			}
+			if mirrorRes.StatusCode >= 400 {
+				mirrorRes.Body.Close()
+				continue
+			}
+			log.Println("Primary URL failed, downloading from mirror", u)
+			if err == nil {
+				res.Body.Close()
+			}
+			res, err = mirrorRes, nil
+			downloadUrl, opts, method = u, mirrorOpts, ""
+			break
+		}
+	}
 	if err != nil {
 		log.Println("Error fetching HEAD: ", err)
 		dm.setTaskError(taskId, "Connection failed")
 		SendError(taskId, "Connection failed")
 		return
 	}
+	dm.limiter.ObserveLatency(time.Since(sent))
 	defer res.Body.Close()
 
 	supportsRange := strings.EqualFold(res.Header.Get("Accept-Ranges"), "bytes")
@@ -53,19 +100,45 @@ func (dm *DownloadManager) processDownload(ctx context.Context, taskId string, d
 		log.Println("Server does not support range requests, using single stream")
 	}
 
+	remote := validatorsFrom(res)
+	var previous remoteValidators
+	var expected checksum
+	var verifySidecar bool
+	var pieces *pieceHashes
+	var saveAs string
+	checksumSource := "task"
+
 	dm.dataMutex.Lock()
 	for i := range dm.Tasks {
 		if dm.Tasks[i].ID == taskId {
+			previous = remoteValidators{ETag: dm.Tasks[i].ETag, LastModified: dm.Tasks[i].LastModified, Size: dm.Tasks[i].TotalSize}
+			expected, _ = parseChecksum(dm.Tasks[i].Checksum)
+			verifySidecar = dm.Tasks[i].VerifySidecar
+			pieces = dm.Tasks[i].Pieces
+			saveAs = dm.Tasks[i].SaveAs
 			dm.Tasks[i].TotalSize = res.ContentLength
+			dm.Tasks[i].ETag = remote.ETag
+			dm.Tasks[i].LastModified = remote.LastModified
 			break
 		}
 	}
 	dm.dataMutex.Unlock()
 	dm.SaveTasks()
 
+	//Fall back to a digest the server advertised when the user gave none
+	if expected.Algo == "" {
+		if c, ok := serverChecksum(res.Header); ok {
+			log.Println("Server provided checksum:", c)
+			expected = c
+			checksumSource = "server"
+		}
+	}
+
 	var fileName string
 	if len(customName) > 0 {
 		fileName = customName[0]
+	} else if saveAs != "" {
+		fileName = saveAs
 	} else {
 		if cd := res.Header.Get("Content-Disposition"); cd != "" {
 			_, params, err := mime.ParseMediaType(cd)
@@ -83,20 +156,71 @@ func (dm *DownloadManager) processDownload(ctx context.Context, taskId string, d
 		}
 	}
 
-	parts := calculateParts(res.ContentLength, numParts)
+	//Pick up the saved manifest so a resume writes exactly where the last run stopped
+	manifest := loadManifest(taskId)
+	if manifest != nil && (manifest.TotalSize != res.ContentLength || manifest.validators().differ(remote) || previous.differ(remote)) {
+		log.Println("Remote file changed since the last run, discarding downloaded parts")
+		manifest = nil
+	}
+	if pieces != nil && !pieces.matches(res.ContentLength) {
+		log.Println("Piece hashes do not fit the remote file, skipping piece verification")
+		pieces = nil
+	}
+	if manifest == nil {
+		discardDownload(taskId)
+		var output string
+		//Corrupt pieces are refetched in place, which needs direct mode
+		if (dm.settings.DirectWrite || pieces != nil) && res.ContentLength > 0 {
+			output = filepath.Join(dm.config.DownloadDir, taskHash(taskId)+".pulldown")
+		}
+		manifest = newManifest(downloadUrl, remote, calculateParts(res.ContentLength, numParts), output)
+	}
+	output := manifest.Output
 
-	var initialDownloaded int64 = 0
+	//In direct mode every part writes into one preallocated file
+	var out *os.File
+	if output != "" {
+		out, err = openOutputFile(output, res.ContentLength)
+		if err != nil {
+			log.Println("Error preparing output file:", err)
+			dm.setTaskError(taskId, "Cannot create output file")
+			SendError(taskId, "Cannot create output file")
+			return
+		}
+		defer out.Close()
+	}
+
+	tracker := newSegmentTracker(taskId, manifest)
+	if out == nil {
+		for _, p := range tracker.parts {
+			if stat, err := os.Stat(partFileName(taskId, p.Index)); err == nil {
+				tracker.reset(p, stat.Size())
+			}
+		}
+	}
+	tracker.save()
 
-	for i := range parts {
-		tmpFileName := fmt.Sprintf("%s_part_%d.tmp", taskHash(taskId), i)
-		if stat, err := os.Stat(tmpFileName); err == nil {
-			initialDownloaded += stat.Size()
+	saveProgress := func() {
+		if out != nil {
+			tracker.checkpoint(out)
+		} else {
+			tracker.save()
 		}
 	}
 
+	var initialDownloaded = tracker.downloaded()
+
 	//Create shared counter
 	var downloadBytes = initialDownloaded
 
+	var verifier *pieceVerifier
+	if pieces != nil && out != nil {
+		verifier = newPieceVerifier(pieces, tracker, out, &downloadBytes, res.ContentLength)
+		defer verifier.stop()
+		//Recheck what earlier runs wrote, nothing is remembered about it
+		verifier.check()
+	}
+
 	if res.ContentLength > 0 {
 		percent := float64(initialDownloaded) / float64(res.ContentLength) * 100
 		SendProgress(taskId, fileName, percent, res.ContentLength, 0, 0)
@@ -105,40 +229,121 @@ func (dm *DownloadManager) processDownload(ctx context.Context, taskId string, d
 	//For implementing concurrency
 	var wg sync.WaitGroup
 
-	errChan := make(chan error, len(parts))
+	errChan := make(chan error, numParts)
+
+	//Keep the manifest close to what is on disk in case we crash
+	stopCheckpoints := make(chan struct{})
+	checkpointsDone := make(chan struct{})
+	go func() {
+		defer close(checkpointsDone)
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCheckpoints:
+				return
+			case <-ticker.C:
+				saveProgress()
+			}
+		}
+	}()
+
+	mirrors := newMirrorPool(downloadUrl, remote.ifRange())
+	mirrors.mirrors[0].opts, mirrors.mirrors[0].method = opts, method
+	//Parts only start past the first byte when the file is split or corrupt pieces are fetched again
+	if len(mirrorUrls) > 0 {
+		mirrors.probeMirrors(ctx, client, mirrorUrls, res.ContentLength, resolvedHeader, numParts > 1 || verifier != nil)
+	}
+
+	//Asks the resolver again when a signed link runs out mid-download
+	refresher := dm.newLinkRefresher(taskId, client, remote)
+	mirrors.mirrors[0].refreshable = refresher != nil
+
+	//Stops every worker at once when one of them finds the remote file changed
+	workerCtx, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+	var remoteChanged atomic.Bool
 
-	for i := range parts {
+	//Each worker keeps taking parts, and splitting slow ones, until nothing is left
+	for range numParts {
 		//Increment the goroutine counter
 		wg.Add(1)
 
-		go func(p Part) {
+		go func() {
 			defer wg.Done()
-			maxRetries := 5
-			if !dm.settings.AutoRetry {
-				maxRetries = 1
-			}
-			for attempt := 0; attempt < maxRetries; attempt++ {
-				if ctx.Err() != nil {
-					return
+			for p := nextPart(tracker, verifier); p != nil; p = nextPart(tracker, verifier) {
+				var err error
+				//Retry on one mirror, then fail over to the next best one
+				tried := make(map[*mirror]bool)
+				for m := mirrors.pick(tried); m != nil; m = mirrors.pick(tried) {
+					err = dm.retry(workerCtx, fmt.Sprintf("Part %d", p.Index), func() error {
+						used := mirrors.urlOf(m)
+						err := downloadPart(workerCtx, taskId, mirrors, m, fileName, out, tracker, verifier, p, &downloadBytes, res.ContentLength, dm.limiter, client)
+						if errors.Is(err, errLinkExpired) && refresher != nil && mirrors.isPrimary(m) {
+							if err = refresher.refresh(workerCtx, mirrors, used); err == nil {
+								//A fresh link is not a failed attempt, carry on from the part's offset
+								return errTryAgain
+							}
+						}
+						return err
+					}, func(err error) bool {
+						return errors.Is(err, errRemoteChanged)
+					})
+					if workerCtx.Err() != nil {
+						return
+					}
+					if err == nil {
+						break
+					}
+					if errors.Is(err, errRemoteChanged) {
+						log.Printf("Part %d: %v (%s)", p.Index, err, mirrors.urlOf(m))
+						if mirrors.isPrimary(m) {
+							remoteChanged.Store(true)
+							stopWorkers()
+							return
+						}
+					}
+					mirrors.failed(m)
+					tried[m] = true
+					if len(tried) < len(mirrors.mirrors) {
+						log.Printf("Part %d giving up on %s, trying another mirror", p.Index, mirrors.urlOf(m))
+					}
 				}
-				err := downloadPart(ctx, taskId, downloadUrl, fileName, p, &downloadBytes, res.ContentLength, dm.limiter, dm.settings.ProxyHost, dm.settings.ProxyPort, dm.settings.ConnTimeout, dm.settings.EnableProxy)
-				if err == nil {
+				if err != nil {
+					tracker.fail(p)
+					errChan <- err
 					return
 				}
-
-				if ctx.Err() != nil {
+				if workerCtx.Err() != nil {
 					return
 				}
-				log.Printf("Part %d failed (Attempt %d %d): %v. Retrying in 2 sec...", p.Index, attempt+1, maxRetries, err)
-				time.Sleep(2 * time.Second)
+				tracker.finish(p)
+				verifier.check()
 			}
-			errChan <- fmt.Errorf("Part %d failed after %d attempts", p.Index, maxRetries)
-		}(parts[i])
+		}()
 	}
 	wg.Wait()
 	close(errChan)
+	//A checkpoint still being written would bring back the manifest of a finished download
+	close(stopCheckpoints)
+	<-checkpointsDone
+
+	if remoteChanged.Load() && ctx.Err() == nil {
+		if out != nil {
+			out.Close()
+		}
+		dm.restartDownload(ctx, taskId, mirrors.urlOf(mirrors.mirrors[0]), customName...)
+		return
+	}
 
 	if len(errChan) > 0 {
+		saveProgress()
+		if err := <-errChan; errors.Is(err, errLinkExpired) {
+			log.Println("Download link expired:", err)
+			dm.setTaskError(taskId, "Download link expired")
+			SendError(taskId, "Download link expired, add the link again to get a fresh one")
+			return
+		}
 		log.Println("Download failed due to network error")
 		dm.setTaskError(taskId, "Download failed after retries")
 		SendError(taskId, "Download failed after retries")
@@ -146,9 +351,69 @@ func (dm *DownloadManager) processDownload(ctx context.Context, taskId string, d
 	}
 
 	if ctx.Err() == nil {
-		mergeParts(fileName, len(parts), taskId, dm.config.DownloadDir)
+		if err := verifier.result(); err != nil {
+			saveProgress()
+			log.Println("Piece verification failed:", err)
+			dm.setTaskError(taskId, "Piece verification failed")
+			SendError(taskId, "Piece verification failed: "+err.Error())
+			return
+		}
+	}
+
+	if ctx.Err() == nil && !tracker.allComplete() {
+		saveProgress()
+		log.Println("Download ended with missing ranges")
+		dm.setTaskError(taskId, "Download incomplete")
+		SendError(taskId, "Download incomplete")
+		return
+	}
+
+	if ctx.Err() == nil {
+		//The file is checked under a temporary name, a corrupt one never shows up as the download
+		var assembled string
+		if out != nil {
+			assembled, err = finishOutputFile(out)
+		} else {
+			assembled, err = mergeParts(tracker.layout(), taskId, dm.config.DownloadDir)
+		}
+		if err != nil {
+			log.Println("Error assembling file:", err)
+			dm.setTaskError(taskId, "Cannot assemble file")
+			SendError(taskId, "Cannot assemble file")
+			return
+		}
 		SendProgress(taskId, fileName, 100.0, res.ContentLength, 0, 0)
 
+		if expected.Algo != "" || verifySidecar {
+			dm.setTaskStatus(taskId, "Verifying")
+			source := checksumSource
+			if expected.Algo == "" {
+				expected, source = findSidecarChecksum(ctx, client, downloadUrl, fileName, opts)
+			}
+			if expected.Algo == "" {
+				log.Println("No checksum file found next to", downloadUrl)
+				dm.setChecksumStatus(taskId, "not_found", "")
+			} else if err := verifyFile(assembled, expected); err != nil {
+				log.Println("Checksum verification failed, removing the download:", err)
+				os.Remove(assembled)
+				os.Remove(manifestFileName(taskId))
+				dm.setChecksumStatus(taskId, "mismatch", source)
+				dm.setTaskError(taskId, "Checksum verification failed")
+				SendError(taskId, "Checksum verification failed: "+err.Error())
+				return
+			} else {
+				log.Println("Checksum verified:", expected, "from", source)
+				dm.setChecksumStatus(taskId, "verified", source)
+			}
+		}
+
+		if _, err := moveIntoPlace(assembled, fileName, taskId, dm.config.DownloadDir); err != nil {
+			log.Println("Error moving file into place:", err)
+			dm.setTaskError(taskId, "Cannot assemble file")
+			SendError(taskId, "Cannot assemble file")
+			return
+		}
+
 		dm.dataMutex.Lock()
 		for i := range dm.Tasks {
 			if dm.Tasks[i].ID == taskId {
@@ -163,11 +428,14 @@ func (dm *DownloadManager) processDownload(ctx context.Context, taskId string, d
 		dm.SaveTasks()
 		log.Println("Download Complete")
 	} else {
+		saveProgress()
 		currBytes := atomic.LoadInt64(&downloadBytes)
 		dm.dataMutex.Lock()
 		for i := range dm.Tasks {
 			if dm.Tasks[i].ID == taskId {
-				dm.Tasks[i].Status = "Paused"
+				if !isHeld(dm.Tasks[i].Status) {
+					dm.Tasks[i].Status = "Paused"
+				}
 				dm.Tasks[i].Downloaded = currBytes
 				break
 			}
@@ -178,66 +446,109 @@ func (dm *DownloadManager) processDownload(ctx context.Context, taskId string, d
 	}
 }
 
-func taskHash(taskId string) string {
-	h := md5.Sum([]byte(taskId))
-	return hex.EncodeToString(h[:])[:8]
+// headFile sends a HEAD request for the file at url.
+func headFile(ctx context.Context, client *http.Client, url string, opts requestOptions) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	opts.apply(req)
+	return client.Do(req)
 }
 
-func (dm *DownloadManager) downloadYoutube(ctx context.Context, originalUrl string) {
-	log.Println("Analyzing youtube video:", originalUrl)
+// errTryAgain from an attempt runs it again right away without counting it
+// as a failure, such as after a link was refreshed.
+var errTryAgain = errors.New("try again")
 
-	client := youtube.Client{}
-	video, err := client.GetVideo(originalUrl)
-	if err != nil {
-		log.Println("Error getting video info:", err)
-		dm.setTaskError(originalUrl, "Youtube: "+err.Error())
-		SendError(originalUrl, "Failed to analyze video")
-		return
-	}
-	formats := video.Formats.WithAudioChannels()
+// retryDelay is the pause between two attempts.
+var retryDelay = 2 * time.Second
 
-	var bestFormat *youtube.Format
-	for i := range formats {
-		if formats[i].QualityLabel != "" {
-			bestFormat = &formats[i]
+// retry calls try until it succeeds, as many times as the retry setting
+// allows and retryDelay apart. It gives up early once ctx ends, or when
+// final says no further attempt can help with the error.
+func (dm *DownloadManager) retry(ctx context.Context, what string, try func() error, final func(error) bool) error {
+	maxRetries := 5
+	if !dm.settings.AutoRetry {
+		maxRetries = 1
+	}
+	var err error
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = try()
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, errTryAgain) {
+			attempt--
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if final != nil && final(err) {
+			return err
+		}
+		if attempt+1 == maxRetries {
 			break
 		}
+		log.Printf("%s failed (Attempt %d %d): %v. Retrying in %v...", what, attempt+1, maxRetries, err, retryDelay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryDelay):
+		}
 	}
+	return fmt.Errorf("%s failed after %d attempts: %w", what, maxRetries, err)
+}
 
-	if bestFormat == nil {
-		if len(formats) == 0 {
-			log.Println("Error: No formats found for", originalUrl)
-			dm.setTaskError(originalUrl, "No downloadable formats found")
-			SendError(originalUrl, "No downloadable formats found")
-			return
+func (dm *DownloadManager) setChecksumStatus(taskId string, status string, source string) {
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].ID == taskId {
+			dm.Tasks[i].ChecksumStatus = status
+			break
 		}
-		bestFormat = &formats[0]
 	}
-	log.Printf("Found format: %s, Quality: %s\n", bestFormat.MimeType, bestFormat.QualityLabel)
-	//Get direct URL
-	streamURL, err := client.GetStreamURL(video, bestFormat)
-	if err != nil {
-		log.Println("Error getting stream URL:", err)
-		dm.setTaskError(originalUrl, "Failed to get stream URL")
-		SendError(originalUrl, "Failed to get stream URL")
+	dm.dataMutex.Unlock()
+	dm.SaveTasks()
+	SendChecksum(taskId, status, source)
+}
+
+type restartedKey struct{}
+
+// restartDownload throws away the parts of a file that changed on the server
+// and starts it again from scratch, once. A file that changes again right
+// away is reported as an error instead of looping.
+func (dm *DownloadManager) restartDownload(ctx context.Context, taskId string, downloadUrl string, customName ...string) {
+	if ctx.Value(restartedKey{}) != nil {
+		dm.setTaskError(taskId, "Remote file keeps changing")
+		SendError(taskId, "Remote file keeps changing")
 		return
 	}
-
-	log.Println("Got direct stream URL....")
-	safeTitle := sanitizeFileName(video.Title) + ".mp4"
+	log.Println("Remote file changed, restarting download:", taskId)
+	discardDownload(taskId)
 
 	dm.dataMutex.Lock()
 	for i := range dm.Tasks {
-		if dm.Tasks[i].ID == originalUrl {
-			dm.Tasks[i].FileName = safeTitle
+		if dm.Tasks[i].ID == taskId {
+			dm.Tasks[i].Downloaded = 0
+			dm.Tasks[i].ETag = ""
+			dm.Tasks[i].LastModified = ""
 			break
 		}
 	}
 	dm.dataMutex.Unlock()
 	dm.SaveTasks()
 
-	dm.processDownload(ctx, originalUrl, streamURL, safeTitle)
+	//Run after returning so this call gives its semaphore slot back first
+	go dm.processDownload(context.WithValue(ctx, restartedKey{}, true), taskId, downloadUrl, customName...)
+}
 
+func taskHash(taskId string) string {
+	h := md5.Sum([]byte(taskId))
+	return hex.EncodeToString(h[:])[:8]
 }
 
 func sanitizeFileName(name string) string {
@@ -250,7 +561,10 @@ func sanitizeFileName(name string) string {
 
 // Logic for calculating size of each part
 func calculateParts(totalSize int64, numParts int) []Part {
-	if totalSize <= 0 || totalSize < int64(numParts) {
+	if totalSize > 0 && totalSize < int64(numParts) {
+		numParts = 1
+	}
+	if totalSize <= 0 {
 		return []Part{{
 			Index: 0,
 			Start: 0,
@@ -275,68 +589,102 @@ func calculateParts(totalSize int64, numParts int) []Part {
 	return parts
 }
 
-func downloadPart(ctx context.Context, taskId string, downloadUrl string, fileName string, part Part, progress *int64, totalSize int64, limiter *BandwidthMonitor, proxyHost string, proxyPort int, connTimeout int, enableProxy bool) error {
+// errRemoteChanged means the server sent the whole file instead of the range
+// we asked for, so the parts on disk belong to an older version.
+var errRemoteChanged = errors.New("remote file changed since the download started")
 
-	tmpFileName := fmt.Sprintf("%s_part_%d.tmp", taskHash(taskId), part.Index)
-	var currStart = part.Start
+func downloadPart(ctx context.Context, taskId string, mirrors *mirrorPool, m *mirror, fileName string, out *os.File, tracker *segmentTracker, pieces *pieceVerifier, part *Part, progress *int64, totalSize int64, limiter *BandwidthMonitor, client *http.Client) error {
 
-	file, err := os.OpenFile(tmpFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("File open error: %v", err)
-	}
-	defer file.Close()
+	//Parts either append to their own temp file or write at their offset in the shared output
+	var file *os.File
+	if out != nil {
+		tracker.rewind(part)
+	} else {
+		tmpFile, err := os.OpenFile(partFileName(taskId, part.Index), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("File open error: %v", err)
+		}
+		defer tmpFile.Close()
+		file = tmpFile
 
-	stat, err := file.Stat()
-	if err == nil {
-		currStart += stat.Size()
+		stat, err := file.Stat()
+		if err == nil {
+			tracker.reset(part, stat.Size())
+		}
 	}
 
-	expectedBytesRemaining := (part.End - currStart) + 1
-
-	if expectedBytesRemaining <= 0 {
+	currStart, end := tracker.bounds(part)
+	if end >= 0 && currStart > end {
 		return nil
 	}
+	//Without a size there is no range to ask for, the answer starts at the first byte again
+	if end < 0 && currStart > part.Start {
+		if err := restartPart(tracker, part, file, progress); err != nil {
+			return err
+		}
+	}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", downloadUrl, nil)
+	req, err := mirrors.newRequest(ctx, m)
 	if err != nil {
 		return err
 	}
+	//Don't bother the server with a link that says it has run out when a fresh one can be had. Other
+	//links are tried anyway, their expires parameter may mean something else
+	expires := urlExpiry(req.URL)
+	if m.refreshable && !expires.IsZero() && time.Now().After(expires) {
+		return errLinkExpired
+	}
+	ifRange := mirrors.ifRangeOf(m)
 
 	//Used Sprintf to return formatted string
-	if part.End >= 0 {
-		rangeHeader := fmt.Sprintf("bytes=%d-%d", currStart, part.End)
+	if end >= 0 {
+		rangeHeader := fmt.Sprintf("bytes=%d-%d", currStart, end)
 		req.Header.Set("Range", rangeHeader)
+		//Only send the range if the file is still the one we started with
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
 	}
 
-	dialer := &net.Dialer{
-		Timeout: time.Duration(connTimeout) * time.Second,
-	}
-	transport := &http.Transport{
-		DialContext: dialer.DialContext,
-	}
-	if enableProxy && proxyHost != "" {
-		proxyAddr, _ := neturl.Parse(fmt.Sprintf("http://%s:%d", proxyHost, proxyPort))
-		transport.Proxy = http.ProxyURL(proxyAddr)
-	}
+	mirrors.begin(m)
+	defer mirrors.end(m)
 
-	client := &http.Client{
-		Transport: transport,
-	}
+	sent := time.Now()
 	res, err := client.Do(req)
 	if err != nil {
 		return err
 	}
+	limiter.ObserveLatency(time.Since(sent))
 
 	//Used defer so that the res object is closed after its functioning
 	defer res.Body.Close()
 
+	//Signed links answer 403 or 410 once they expire, anywhere else those just mean no
+	if (res.StatusCode == 403 || res.StatusCode == 410) && (m.refreshable || !expires.IsZero()) {
+		return fmt.Errorf("%w: status %d", errLinkExpired, res.StatusCode)
+	}
 	if res.StatusCode != 200 && res.StatusCode != 206 {
 		return fmt.Errorf("Bad status code: %d", res.StatusCode)
 	}
 
+	//A 200 to a range request is the whole file. That is only fine when the whole file is what we asked for
+	if res.StatusCode == 200 && end >= 0 && (currStart != 0 || end != totalSize-1) {
+		if ifRange != "" {
+			return errRemoteChanged
+		}
+		//Only a part that starts the file can take it from there, the others need a server that does ranges
+		if part.Start != 0 {
+			return fmt.Errorf("Server ignored range request for bytes %d-%d", currStart, end)
+		}
+		if currStart > part.Start {
+			if err := restartPart(tracker, part, file, progress); err != nil {
+				return err
+			}
+		}
+	}
+
 	//Create buffer
 	buf := make([]byte, 32*1024)
-	var bytesDownloadedThisSession int64 = 0
 	lastSent := time.Now()
 	lastBytes := atomic.LoadInt64(progress)
 
@@ -347,15 +695,25 @@ func downloadPart(ctx context.Context, taskId string, downloadUrl string, fileNa
 		}
 		n, err := res.Body.Read(buf)
 
-		//Write data to file upto 'n' bytes
+		//Write data to file upto 'n' bytes, or up to the end of the part if it was split meanwhile
 		if n > 0 {
-			if _, writeErr := file.Write(buf[:n]); writeErr != nil {
+			var offset int64
+			offset, n = tracker.claim(part, n)
+			var writeErr error
+			if out != nil {
+				_, writeErr = out.WriteAt(buf[:n], offset)
+			} else {
+				_, writeErr = file.Write(buf[:n])
+			}
+			if writeErr != nil {
 				return fmt.Errorf("disk write error: %w", writeErr)
 			}
+			tracker.commit(part, n)
+			mirrors.record(m, n)
+			pieces.wrote(offset, n)
 
 			limiter.AddBytes(n)
 
-			bytesDownloadedThisSession += int64(n)
 			//Safely add 'n' bytes to shared counter
 			current := atomic.AddInt64(progress, int64(n))
 			percent := float64(current) / float64(totalSize) * 100
@@ -371,12 +729,16 @@ func downloadPart(ctx context.Context, taskId string, downloadUrl string, fileNa
 				lastSent = time.Now()
 				lastBytes = currBytes
 			}
-			limiter.Wait(n)
+			limiter.Wait(ctx, taskId, n)
+		}
+		if end >= 0 && tracker.reached(part) {
+			break
 		}
 		if err != nil {
 			if err == io.EOF {
-				if bytesDownloadedThisSession < expectedBytesRemaining {
-					return fmt.Errorf("Server hung up early. Got %d bytes, expected %d", bytesDownloadedThisSession, expectedBytesRemaining)
+				if end >= 0 {
+					reachedAt, _ := tracker.bounds(part)
+					return fmt.Errorf("Server hung up early at byte %d, part ends at %d", reachedAt, end)
 				}
 				break
 			}
@@ -386,11 +748,24 @@ func downloadPart(ctx context.Context, taskId string, downloadUrl string, fileNa
 	return nil
 }
 
-func mergeParts(fileName string, numParts int, taskId string, downloadDir string) {
+// restartPart drops what a part has written so far, for servers that can
+// only send it from the first byte.
+func restartPart(tracker *segmentTracker, part *Part, file *os.File, progress *int64) error {
+	from, _ := tracker.bounds(part)
+	if file != nil {
+		if err := file.Truncate(0); err != nil {
+			return fmt.Errorf("File truncate error: %v", err)
+		}
+	}
+	tracker.reset(part, 0)
+	atomic.AddInt64(progress, part.Start-from)
+	log.Printf("Part %d cannot resume at byte %d, starting it over", part.Index, from)
+	return nil
+}
 
+// uniqueOutputPath avoids overwriting an existing file by appending (1), (2)...
+func uniqueOutputPath(downloadDir string, fileName string) string {
 	outputPath := filepath.Join(downloadDir, fileName)
-	os.MkdirAll(downloadDir, 0755)
-
 	if _, err := os.Stat(outputPath); err == nil {
 		ext := filepath.Ext(fileName)
 		base := strings.TrimSuffix(fileName, ext)
@@ -402,29 +777,87 @@ func mergeParts(fileName string, numParts int, taskId string, downloadDir string
 			}
 		}
 	}
-	//Create the final file
+	return outputPath
+}
+
+// openOutputFile opens the shared file of a direct mode download and
+// reserves the full size up front.
+func openOutputFile(output string, totalSize int64) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(output, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := file.Stat(); err == nil && stat.Size() == totalSize {
+		return file, nil
+	}
+	if err := file.Truncate(totalSize); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// finishOutputFile flushes a direct mode download and returns where it is,
+// for moveIntoPlace once it has been checked.
+func finishOutputFile(out *os.File) (string, error) {
+	if err := out.Sync(); err != nil {
+		return "", err
+	}
+	return out.Name(), out.Close()
+}
+
+// moveIntoPlace renames an assembled download to its final name in one
+// step, so a half written or unverified file never shows up there.
+func moveIntoPlace(assembled string, fileName string, taskId string, downloadDir string) (string, error) {
+	os.MkdirAll(downloadDir, 0755)
+	outputPath := uniqueOutputPath(downloadDir, fileName)
+	if err := os.Rename(assembled, outputPath); err != nil {
+		return "", err
+	}
+	os.Remove(manifestFileName(taskId))
+	log.Println("File moved into:", outputPath)
+	return outputPath, nil
+}
+
+// mergeParts joins the part files into one file next to the download
+// directory's final files and returns its path, for moveIntoPlace.
+func mergeParts(parts []Part, taskId string, downloadDir string) (string, error) {
+
+	os.MkdirAll(downloadDir, 0755)
+	outputPath := filepath.Join(downloadDir, taskHash(taskId)+".pulldown")
+
+	//Create the merged file
 	outFile, err := os.Create(outputPath)
 	if err != nil {
-		log.Println("Error creating final file: ", err)
-		return
+		return "", fmt.Errorf("creating merged file: %w", err)
 	}
 	defer outFile.Close()
 
-	for i := 0; i < numParts; i++ {
-		partFileName := fmt.Sprintf("%s_part_%d.tmp", taskHash(taskId), i)
+	//Parts come sorted by offset, their indexes only name the temp files
+	for _, p := range parts {
+		tmpFileName := partFileName(taskId, p.Index)
 
 		//Reading the partial files
-		partFile, err := os.Open(partFileName)
-
+		partFile, err := os.Open(tmpFileName)
+		if err == nil {
+			_, err = io.Copy(outFile, partFile)
+			partFile.Close()
+		}
 		if err != nil {
-			log.Println("Error opening part: ", err)
-			return
+			//Keep the parts so the merge can run again on resume
+			outFile.Close()
+			os.Remove(outputPath)
+			return "", fmt.Errorf("merging part %d: %w", p.Index, err)
 		}
+	}
 
-		io.Copy(outFile, partFile)
-		partFile.Close()
-		//Remove the partial files
-		os.Remove(partFileName)
+	//Only remove the partial files once the whole file is written
+	for _, p := range parts {
+		os.Remove(partFileName(taskId, p.Index))
 	}
-	log.Println("Files merged into:", fileName)
+	log.Println("Files merged into:", outputPath)
+	return outputPath, nil
 }
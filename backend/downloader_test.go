@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testContent is a file whose bytes differ by offset, so parts written to
+// the wrong place show up.
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i*7 + i/251)
+	}
+	return content
+}
+
+// serveFile serves content as file.bin with range support.
+func serveFile(content []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+func TestDownloadModes(t *testing.T) {
+	content := testContent(3*1024*1024 + 17)
+	srv := serveFile(content)
+	defer srv.Close()
+
+	for _, direct := range []bool{false, true} {
+		dm := newTestManager(t)
+		dm.settings.DirectWrite = direct
+		fileUrl := srv.URL + "/file.bin"
+		dm.Tasks = []Task{{ID: fileUrl, Url: fileUrl, Status: "Downloading"}}
+
+		dm.processDownload(context.Background(), fileUrl, fileUrl)
+
+		if got := dm.Tasks[0].Status; got != "Completed" {
+			t.Fatalf("direct %v: task is %s", direct, got)
+		}
+		got, err := os.ReadFile(filepath.Join("downloads", "file.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("direct %v: downloaded file differs from the served one", direct)
+		}
+		leftovers, _ := filepath.Glob("*.tmp")
+		preallocated, _ := filepath.Glob(filepath.Join("downloads", "*.pulldown"))
+		if len(leftovers)+len(preallocated) > 0 {
+			t.Errorf("direct %v: left %v %v behind", direct, leftovers, preallocated)
+		}
+	}
+}
+
+// countingWriter counts the body bytes a handler sends.
+type countingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	w.n.Add(int64(len(b)))
+	return w.ResponseWriter.Write(b)
+}
+
+// TestResumeFromManifest picks up a download a crash left half done, with a
+// different connection count than it was started with.
+func TestResumeFromManifest(t *testing.T) {
+	content := testContent(2 * 1024 * 1024)
+	size := int64(len(content))
+	var served atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(countingWriter{w, &served}, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	for _, direct := range []bool{false, true} {
+		served.Store(0)
+		dm := newTestManager(t)
+		fileUrl := srv.URL + "/file.bin"
+		dm.Tasks = []Task{{ID: fileUrl, Url: fileUrl, Status: "Downloading"}}
+
+		//Part 0 got halfway before the crash, part 1 never started
+		parts := calculateParts(size, 2)
+		half := parts[0].size() / 2
+		var output string
+		if direct {
+			output = filepath.Join("downloads", taskHash(fileUrl)+".pulldown")
+			file := make([]byte, size)
+			copy(file, content[:half])
+			os.MkdirAll("downloads", 0755)
+			os.WriteFile(output, file, 0644)
+		} else {
+			os.WriteFile(partFileName(fileUrl, 0), content[:half], 0644)
+		}
+		m := newManifest(fileUrl, remoteValidators{Size: size}, parts, output)
+		if direct {
+			m.Parts[0].Done = half
+		}
+		if err := writeManifest(fileUrl, m); err != nil {
+			t.Fatal(err)
+		}
+
+		dm.config.PartsPerFile = 8
+		dm.processDownload(context.Background(), fileUrl, fileUrl)
+
+		if got := dm.Tasks[0].Status; got != "Completed" {
+			t.Fatalf("direct %v: task is %s", direct, got)
+		}
+		got, err := os.ReadFile(filepath.Join("downloads", "file.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("direct %v: resumed file differs from the served one", direct)
+		}
+		if got := served.Load(); got != size-half {
+			t.Errorf("direct %v: server sent %d bytes, want the %d missing", direct, got, size-half)
+		}
+		if _, err := os.Stat(manifestFileName(fileUrl)); !os.IsNotExist(err) {
+			t.Errorf("direct %v: manifest left behind", direct)
+		}
+	}
+}
+
+// TestResumeOfChangedFile resumes a download whose file was replaced on the
+// server by one of the same size.
+func TestResumeOfChangedFile(t *testing.T) {
+	old, current := testContent(1024*1024), bytes.Repeat([]byte("new"), 1024*1024/3+1)[:1024*1024]
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(current))
+	}))
+	defer srv.Close()
+
+	dm := newTestManager(t)
+	fileUrl := srv.URL + "/file.bin"
+	dm.Tasks = []Task{{ID: fileUrl, Url: fileUrl, Status: "Downloading", ETag: `"v1"`}}
+	parts := calculateParts(int64(len(old)), 1)
+	os.WriteFile(partFileName(fileUrl, 0), old[:1000], 0644)
+	if err := writeManifest(fileUrl, newManifest(fileUrl, remoteValidators{ETag: `"v1"`, Size: int64(len(old))}, parts, "")); err != nil {
+		t.Fatal(err)
+	}
+
+	dm.processDownload(context.Background(), fileUrl, fileUrl)
+
+	if got := dm.Tasks[0].Status; got != "Completed" {
+		t.Fatalf("task is %s", got)
+	}
+	got, _ := os.ReadFile(filepath.Join("downloads", "file.bin"))
+	if !bytes.Equal(got, current) {
+		t.Error("bytes of the old file ended up in the download")
+	}
+	if dm.Tasks[0].ETag != `"v2"` {
+		t.Errorf("task remembers ETag %s", dm.Tasks[0].ETag)
+	}
+}
+
+// TestResumeWithoutRanges resumes downloads from a server that always sends
+// the whole file, with and without a known size.
+func TestResumeWithoutRanges(t *testing.T) {
+	content := testContent(512*1024 + 3)
+	for _, sized := range []bool{true, false} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if sized {
+				w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			}
+			if r.Method == "GET" {
+				w.Write(content)
+			}
+		}))
+
+		size := int64(-1)
+		if sized {
+			size = int64(len(content))
+		}
+		for _, direct := range []bool{false, true} {
+			if direct && !sized {
+				continue
+			}
+			dm := newTestManager(t)
+			fileUrl := srv.URL + "/file.bin"
+			dm.Tasks = []Task{{ID: fileUrl, Url: fileUrl, Status: "Downloading"}}
+			var output string
+			if direct {
+				output = filepath.Join("downloads", taskHash(fileUrl)+".pulldown")
+				os.MkdirAll("downloads", 0755)
+				os.WriteFile(output, slices.Concat(content[:1000], make([]byte, len(content)-1000)), 0644)
+			} else {
+				os.WriteFile(partFileName(fileUrl, 0), content[:1000], 0644)
+			}
+			m := newManifest(fileUrl, remoteValidators{Size: size}, calculateParts(size, 1), output)
+			m.Parts[0].Done = 1000
+			if err := writeManifest(fileUrl, m); err != nil {
+				t.Fatal(err)
+			}
+
+			dm.processDownload(context.Background(), fileUrl, fileUrl)
+
+			if got := dm.Tasks[0].Status; got != "Completed" {
+				t.Fatalf("sized %v, direct %v: task is %s", sized, direct, got)
+			}
+			got, _ := os.ReadFile(filepath.Join("downloads", "file.bin"))
+			if !bytes.Equal(got, content) {
+				t.Errorf("sized %v, direct %v: resumed file has %d bytes, want the %d served", sized, direct, len(got), len(content))
+			}
+		}
+		srv.Close()
+	}
+}
+
+// TestDownloadSendsTaskHeaders checks the task's headers, cookies and
+// method go with the probe and every part.
+func TestDownloadSendsTaskHeaders(t *testing.T) {
+	content := testContent(2 * 1024 * 1024)
+	var mu sync.Mutex
+	var refused []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "k" || r.Header.Get("Cookie") != "sid=abc" || (r.Method != "HEAD" && r.Method != "POST") {
+			mu.Lock()
+			refused = append(refused, r.Method+" "+r.Header.Get("Range"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	dm := newTestManager(t)
+	dm.settings.AutoRetry = false
+	fileUrl := srv.URL + "/file.bin"
+	dm.Tasks = []Task{{ID: fileUrl, Url: fileUrl, Status: "Downloading", Headers: map[string]string{"X-Api-Key": "k"}, Cookies: "sid=abc", Method: "POST"}}
+
+	dm.processDownload(context.Background(), fileUrl, fileUrl)
+
+	if got := dm.Tasks[0].Status; got != "Completed" {
+		t.Fatalf("task is %s, refused %v", got, refused)
+	}
+	got, err := os.ReadFile(filepath.Join("downloads", "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("downloaded file differs from the served one")
+	}
+}
+
+// TestForbiddenIsExpiryOnlyForSignedLinks sends parts to a server that
+// refuses everything, with links that look signed to various degrees.
+func TestForbiddenIsExpiryOnlyForSignedLinks(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "no", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name         string
+		path         string
+		refreshable  bool
+		wantExpired  bool
+		wantRequests int32
+	}{
+		{"plain link", "/file.bin", false, false, 1},
+		{"past expires without a resolver is still tried", "/file.bin?expires=1", false, true, 1},
+		{"future expiry", "/file.bin?X-Amz-Date=20991018T120000Z&X-Amz-Expires=60", false, true, 1},
+		{"resolved link", "/file.bin", true, true, 1},
+		{"expired resolved link is not requested", "/file.bin?expires=1", true, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			requests.Store(0)
+			fileUrl := srv.URL + tt.path
+			mirrors := newMirrorPool(fileUrl, "")
+			mirrors.mirrors[0].refreshable = tt.refreshable
+			tracker := newSegmentTracker(fileUrl, newManifest(fileUrl, remoteValidators{}, calculateParts(1000, 1), ""))
+			var progress int64
+
+			err := downloadPart(context.Background(), fileUrl, mirrors, mirrors.mirrors[0], "file.bin", nil, tracker, nil, tracker.parts[0], &progress, 1000, NewBandwidthMonitor(), srv.Client())
+			if err == nil {
+				t.Fatal("part succeeded against a server that refuses it")
+			}
+			if got := errors.Is(err, errLinkExpired); got != tt.wantExpired {
+				t.Errorf("got %v, want expired %v", err, tt.wantExpired)
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("server got %d requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+	failure := errors.New("connection reset")
+	final := func(err error) bool { return errors.Is(err, errRemoteChanged) }
+
+	tests := []struct {
+		name      string
+		autoRetry bool
+		results   []error
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", true, []error{nil}, 1, nil},
+		{"succeeds on a later attempt", true, []error{failure, failure, nil}, 3, nil},
+		{"gives up after five attempts", true, []error{failure, failure, failure, failure, failure, nil}, 5, failure},
+		{"one attempt without auto retry", false, []error{failure, nil}, 1, failure},
+		{"again right away is not counted", false, []error{errTryAgain, errTryAgain, nil}, 3, nil},
+		{"final errors stop at once", true, []error{errRemoteChanged, nil}, 1, errRemoteChanged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dm := &DownloadManager{settings: Settings{AutoRetry: tt.autoRetry}}
+			calls := 0
+			err := dm.retry(context.Background(), "Part 0", func() error {
+				calls++
+				return tt.results[calls-1]
+			}, final)
+			if calls != tt.wantCalls {
+				t.Errorf("tried %d times, want %d", calls, tt.wantCalls)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	//A pause ends the wait between attempts
+	retryDelay = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	dm := &DownloadManager{settings: Settings{AutoRetry: true}}
+	done := make(chan error)
+	go func() {
+		done <- dm.retry(ctx, "Part 0", func() error { return failure }, nil)
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v after the pause", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting to retry after the pause")
+	}
+}
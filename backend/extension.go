@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// extensionTokenHeader carries the token the browser extension shares with
+// the app, so other pages open in the browser can't start downloads.
+const extensionTokenHeader = "X-Pulldown-Token"
+
+// ensureExtensionToken makes the extension token on first start. The user
+// copies it from settings.json into the extension, the API never hands it out.
+func (dm *DownloadManager) ensureExtensionToken() {
+	dm.dataMutex.Lock()
+	if dm.settings.ExtensionToken != "" {
+		dm.dataMutex.Unlock()
+		return
+	}
+	token := make([]byte, 24)
+	if _, err := rand.Read(token); err != nil {
+		dm.dataMutex.Unlock()
+		log.Println("Error generating extension token:", err)
+		return
+	}
+	dm.settings.ExtensionToken = hex.EncodeToString(token)
+	dm.dataMutex.Unlock()
+	dm.SaveSettings()
+}
+
+// hasExtensionToken tells if the request carries the extension token.
+func (dm *DownloadManager) hasExtensionToken(c *gin.Context) bool {
+	dm.dataMutex.Lock()
+	token := dm.settings.ExtensionToken
+	dm.dataMutex.Unlock()
+
+	given := c.GetHeader(extensionTokenHeader)
+	return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// guardPosts refuses POSTs that are not JSON, unless they come from the
+// frontend or carry the extension token. A page on another site can send a
+// form or text/plain POST without asking first, but for JSON or the token
+// header the browser sends a CORS preflight, and only the app's own origins
+// pass that. Uploads from the frontend are told apart by the Origin header,
+// which browsers send with every cross-site POST. Other methods that change
+// anything are preflighted anyway.
+func (dm *DownloadManager) guardPosts(c *gin.Context) {
+	if c.Request.Method != http.MethodPost || c.ContentType() == "application/json" {
+		return
+	}
+	if slices.Contains(allowedOrigins, c.GetHeader("Origin")) || dm.hasExtensionToken(c) {
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "Send JSON, or the " + extensionTokenHeader + " header with uploads"})
+}
+
+// ExtensionDownloadHandler takes a download handed off by the browser
+// extension: the link with the cookies, Referer and User-Agent of the tab it
+// was clicked in, and the file name the browser suggested.
+func (dm *DownloadManager) ExtensionDownloadHandler(c *gin.Context) {
+	if !dm.hasExtensionToken(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid extension token"})
+		return
+	}
+
+	var req DownloadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Println("Download handed off by the browser extension:", req.Url)
+	dm.startDownload(c, req)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGuardPosts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dm := &DownloadManager{settings: Settings{ExtensionToken: "secret"}}
+	r := gin.New()
+	r.Use(dm.guardPosts)
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.POST("/download", ok)
+	r.POST("/metalink", ok)
+	r.DELETE("/cookies", ok)
+	r.GET("/settings", ok)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		origin      string
+		token       string
+		want        int
+	}{
+		{"json", "POST", "/download", "application/json", "", "", http.StatusOK},
+		{"json with a charset", "POST", "/download", "application/json; charset=utf-8", "", "", http.StatusOK},
+		{"plain text posted by another site", "POST", "/download", "text/plain", "", "", http.StatusUnsupportedMediaType},
+		{"form posted by another site", "POST", "/download", "application/x-www-form-urlencoded", "", "", http.StatusUnsupportedMediaType},
+		{"no content type", "POST", "/download", "", "", "", http.StatusUnsupportedMediaType},
+		{"upload with the token", "POST", "/download", "multipart/form-data; boundary=x", "", "secret", http.StatusOK},
+		{"upload with a wrong token", "POST", "/download", "text/plain", "", "guess", http.StatusUnsupportedMediaType},
+		{"upload from the frontend", "POST", "/metalink", "multipart/form-data; boundary=x", "http://localhost:4200", "", http.StatusOK},
+		{"upload from another site", "POST", "/metalink", "multipart/form-data; boundary=x", "https://evil.example", "", http.StatusUnsupportedMediaType},
+		{"delete is preflighted anyway", "DELETE", "/cookies", "", "", "", http.StatusOK},
+		{"get", "GET", "/settings", "", "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"url":"https://example.com/file.bin"}`))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.token != "" {
+			req.Header.Set(extensionTokenHeader, tt.token)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestSettingsHideExtensionToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dm := newTestManager(t)
+	dm.settings.ExtensionToken = "secret"
+	r := gin.New()
+	r.GET("/settings", dm.GetSettingsHandler)
+	r.POST("/settings", dm.UpdateSettingsHandler)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/settings", nil))
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "secret") {
+		t.Errorf("settings gave %d %s", rec.Code, rec.Body)
+	}
+
+	//Saving what the page got back keeps the token
+	req := httptest.NewRequest("POST", "/settings", rec.Body)
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || dm.settings.ExtensionToken != "secret" {
+		t.Errorf("saving settings gave %d and token %q", rec.Code, dm.settings.ExtensionToken)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// ftpTransport answers ftp:// and ftps:// requests the way an HTTP server
+// would, so the part and resume logic works on FTP mirrors unchanged. HEAD
+// maps to SIZE and MDTM, a ranged GET to REST plus a read limited to the range.
+type ftpTransport struct {
+	connTimeout time.Duration
+}
+
+func (ft *ftpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "HEAD" && req.Method != "GET" {
+		return nil, fmt.Errorf("ftp: unsupported method %s", req.Method)
+	}
+
+	conn, err := ft.dial(req)
+	if err != nil {
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) && protoErr.Code == ftp.StatusNotLoggedIn {
+			return ftpResponse(req, http.StatusUnauthorized, -1, nil), nil
+		}
+		return nil, err
+	}
+
+	//Servers without SIZE still let us download, just not in parts
+	filePath := req.URL.Path
+	size, sizeErr := conn.FileSize(filePath)
+	if sizeErr != nil {
+		size = -1
+	}
+
+	if req.Method == "HEAD" {
+		defer conn.Quit()
+		if isFtpNotFound(sizeErr) {
+			return ftpResponse(req, http.StatusNotFound, -1, nil), nil
+		}
+		res := ftpResponse(req, http.StatusOK, size, nil)
+		if size >= 0 {
+			res.Header.Set("Accept-Ranges", "bytes")
+		}
+		if conn.IsGetTimeSupported() {
+			if modTime, err := conn.GetTime(filePath); err == nil {
+				res.Header.Set("Last-Modified", modTime.Format(http.TimeFormat))
+			}
+		}
+		return res, nil
+	}
+
+	start, end, ranged := parseRangeHeader(req.Header.Get("Range"))
+	if ranged && size >= 0 && end >= size {
+		end = size - 1
+	}
+	if !ranged || end < 0 {
+		end = size - 1
+	}
+
+	data, err := conn.RetrFrom(filePath, uint64(start))
+	if err != nil {
+		conn.Quit()
+		if isFtpNotFound(err) {
+			return ftpResponse(req, http.StatusNotFound, -1, nil), nil
+		}
+		return nil, err
+	}
+
+	body := &ftpBody{data: data, conn: conn, reader: data}
+	length := int64(-1)
+	if end >= 0 {
+		length = end - start + 1
+		body.reader = io.LimitReader(data, length)
+	}
+	//Reads on the data connection ignore the request context, closing does not
+	stop := context.AfterFunc(req.Context(), func() { body.Close() })
+	body.stop = stop
+
+	status := http.StatusOK
+	if ranged {
+		status = http.StatusPartialContent
+	}
+	res := ftpResponse(req, status, length, body)
+	if ranged && size >= 0 {
+		res.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	return res, nil
+}
+
+// dial opens a logged in control connection. Credentials come from the
+// request's basic auth, then the URL, and fall back to anonymous.
+func (ft *ftpTransport) dial(req *http.Request) (*ftp.ServerConn, error) {
+	host := req.URL.Hostname()
+	port := req.URL.Port()
+	options := []ftp.DialOption{ftp.DialWithContext(req.Context()), ftp.DialWithShutTimeout(5 * time.Second)}
+	if ft.connTimeout > 0 {
+		options = append(options, ftp.DialWithTimeout(ft.connTimeout))
+	}
+	//ftps:// is implicit TLS on its own port, like curl and most clients treat it
+	if req.URL.Scheme == "ftps" {
+		if port == "" {
+			port = "990"
+		}
+		options = append(options, ftp.DialWithTLS(&tls.Config{ServerName: host}))
+	} else if port == "" {
+		port = "21"
+	}
+
+	conn, err := ftp.Dial(net.JoinHostPort(host, port), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	user, password, ok := req.BasicAuth()
+	if !ok && req.URL.User != nil {
+		user = req.URL.User.Username()
+		password, _ = req.URL.User.Password()
+	}
+	if user == "" {
+		user, password = "anonymous", "anonymous"
+	}
+	if err := conn.Login(user, password); err != nil {
+		conn.Quit()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ftpBody reads one range of a RETR and hangs up the whole session when the
+// part is done with it, the server has nothing else to send us.
+type ftpBody struct {
+	data   *ftp.Response
+	conn   *ftp.ServerConn
+	reader io.Reader
+	stop   func() bool
+	once   sync.Once
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+func (b *ftpBody) Close() error {
+	b.once.Do(func() {
+		if b.stop != nil {
+			b.stop()
+		}
+		//Stopping a transfer early makes the server report 426, that is expected
+		b.data.Close()
+		b.conn.Quit()
+	})
+	return nil
+}
+
+func ftpResponse(req *http.Request, status int, length int64, body io.ReadCloser) *http.Response {
+	if body == nil {
+		body = http.NoBody
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "FTP",
+		ProtoMajor:    1,
+		Header:        make(http.Header),
+		Body:          body,
+		ContentLength: length,
+		Request:       req,
+	}
+}
+
+func isFtpNotFound(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code == ftp.StatusFileUnavailable
+}
+
+// parseRangeHeader reads the single "bytes=start-end" range downloadPart
+// sends. end is -1 for an open ended range.
+func parseRangeHeader(header string) (int64, int64, bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return 0, -1, false
+	}
+	startStr, endStr, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, -1, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, -1, false
+	}
+	end := int64(-1)
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return 0, -1, false
+		}
+	}
+	return start, end, true
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeFTP serves content as /file.bin to the user "joe" with password
+// "secret", passively and with REST.
+type fakeFTP struct {
+	ln      net.Listener
+	content []byte
+	rests   atomic.Int32 // RETRs that started past the first byte
+}
+
+func newFakeFTP(t *testing.T, content []byte) *fakeFTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeFTP{ln: ln, content: content}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakeFTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	reply("220 ready")
+
+	var user string
+	var offset int64
+	var data net.Listener
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch strings.ToUpper(cmd) {
+		case "USER":
+			user = arg
+			reply("331 password please")
+		case "PASS":
+			if user != "joe" || arg != "secret" {
+				reply("530 login incorrect")
+				continue
+			}
+			reply("230 logged in")
+		case "FEAT":
+			reply("211-Features:\r\n SIZE\r\n REST STREAM\r\n211 End")
+		case "TYPE":
+			reply("200 binary")
+		case "SIZE":
+			if arg != "/file.bin" {
+				reply("550 no such file")
+				continue
+			}
+			reply("213 %d", len(f.content))
+		case "EPSV":
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 no data connection")
+				continue
+			}
+			reply("229 Entering Extended Passive Mode (|||%d|)", data.Addr().(*net.TCPAddr).Port)
+		case "REST":
+			offset, _ = strconv.ParseInt(arg, 10, 64)
+			reply("350 restarting at %d", offset)
+		case "RETR":
+			dc, err := data.Accept()
+			data.Close()
+			data = nil
+			if err != nil {
+				reply("425 no data connection")
+				continue
+			}
+			if offset > 0 {
+				f.rests.Add(1)
+			}
+			reply("150 sending")
+			//Clients stop reading at the end of their range, that is not an error here
+			dc.Write(f.content[offset:])
+			dc.Close()
+			offset = 0
+			reply("226 done")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (f *fakeFTP) url(path string) string {
+	return "ftp://" + f.ln.Addr().String() + path
+}
+
+func TestFTPDownloadInParts(t *testing.T) {
+	content := testContent(2*1024*1024 + 5)
+	srv := newFakeFTP(t, content)
+
+	dm := newTestManager(t)
+	fileUrl := srv.url("/file.bin")
+	dm.Tasks = []Task{{ID: fileUrl, Url: fileUrl, Status: "Downloading", Username: "joe", Password: "secret"}}
+
+	dm.processDownload(context.Background(), fileUrl, fileUrl)
+
+	if got := dm.Tasks[0].Status; got != "Completed" {
+		t.Fatalf("task is %s", got)
+	}
+	got, err := os.ReadFile(filepath.Join("downloads", "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("downloaded file differs from the served one")
+	}
+	if srv.rests.Load() == 0 {
+		t.Error("no part started with REST")
+	}
+}
+
+func TestFTPWrongLogin(t *testing.T) {
+	srv := newFakeFTP(t, testContent(1024))
+
+	dm := newTestManager(t)
+	dm.settings.AutoRetry = false
+	fileUrl := srv.url("/file.bin")
+	dm.Tasks = []Task{{ID: fileUrl, Url: fileUrl, Status: "Downloading", Username: "joe", Password: "wrong"}}
+
+	dm.processDownload(context.Background(), fileUrl, fileUrl)
+
+	if got := dm.Tasks[0].Status; got != "Error" {
+		t.Errorf("task is %s after a refused login", got)
+	}
+}
+
+func TestParseRangeHeader(t *testing.T) {
+	tests := []struct {
+		header     string
+		start, end int64
+		ok         bool
+	}{
+		{"bytes=0-99", 0, 99, true},
+		{"bytes=100-", 100, -1, true},
+		{"", 0, -1, false},
+		{"bytes=50-10", 0, -1, false},
+		{"bytes=-10", 0, -1, false},
+		{"items=0-9", 0, -1, false},
+	}
+	for _, tt := range tests {
+		start, end, ok := parseRangeHeader(tt.header)
+		if start != tt.start || end != tt.end || ok != tt.ok {
+			t.Errorf("parseRangeHeader(%q) = %d, %d, %v, want %d, %d, %v", tt.header, start, end, ok, tt.start, tt.end, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// hlsVariant is one entry of a master playlist.
+type hlsVariant struct {
+	streamVariant
+	Url   string
+	Audio string // GROUP-ID of the audio renditions it plays with
+}
+
+// hlsRendition is an alternative audio or subtitle playlist from EXT-X-MEDIA.
+type hlsRendition struct {
+	Type    string
+	GroupId string
+	Url     string
+	Default bool
+}
+
+// hlsPlaylist holds either the variants of a master playlist or the
+// segments of a media playlist.
+type hlsPlaylist struct {
+	Variants []hlsVariant
+	Media    []hlsRendition
+
+	Init     *mediaSegment // EXT-X-MAP, set for fragmented MP4 streams
+	Segments []mediaSegment
+	Ended    bool
+}
+
+// parseHLSPlaylist reads an m3u8 playlist. Relative URIs are resolved
+// against base, the URL the playlist was fetched from.
+func parseHLSPlaylist(r io.Reader, base *neturl.URL) (*hlsPlaylist, error) {
+	resolve := func(ref string) (string, error) {
+		u, err := base.Parse(ref)
+		if err != nil {
+			return "", fmt.Errorf("invalid URI %q: %w", ref, err)
+		}
+		return u.String(), nil
+	}
+
+	playlist := &hlsPlaylist{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var (
+		started   bool
+		variant   *hlsVariant
+		key       *segmentKey
+		keyIV     []byte
+		sequence  int64
+		rangeLen  int64
+		rangeOff  int64 = -1
+		rangeEnds       = make(map[string]int64) //a range without offset continues the last one
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !started {
+			if line != "#EXTM3U" {
+				return nil, fmt.Errorf("not an HLS playlist")
+			}
+			started = true
+			continue
+		}
+
+		if !strings.HasPrefix(line, "#") {
+			uri, err := resolve(line)
+			if err != nil {
+				return nil, err
+			}
+			if variant != nil {
+				variant.Url = uri
+				playlist.Variants = append(playlist.Variants, *variant)
+				variant = nil
+				continue
+			}
+
+			seg := mediaSegment{Url: uri}
+			if rangeLen > 0 {
+				if rangeOff < 0 {
+					rangeOff = rangeEnds[uri]
+				}
+				seg.Offset, seg.Length = rangeOff, rangeLen
+				rangeEnds[uri] = rangeOff + rangeLen
+			}
+			if key != nil {
+				seg.Key = &segmentKey{Url: key.Url, IV: keyIV}
+				//Without an explicit IV the media sequence number is the IV
+				if seg.Key.IV == nil {
+					seg.Key.IV = make([]byte, 16)
+					binary.BigEndian.PutUint64(seg.Key.IV[8:], uint64(sequence))
+				}
+			}
+			playlist.Segments = append(playlist.Segments, seg)
+			sequence++
+			rangeLen, rangeOff = 0, -1
+			continue
+		}
+
+		tag, value, _ := strings.Cut(line, ":")
+		switch tag {
+		case "#EXT-X-STREAM-INF":
+			attrs := parseHLSAttributes(value)
+			variant = &hlsVariant{Audio: attrs["AUDIO"]}
+			variant.Bandwidth, _ = strconv.ParseInt(attrs["BANDWIDTH"], 10, 64)
+			if w, h, ok := strings.Cut(attrs["RESOLUTION"], "x"); ok {
+				variant.Width, _ = strconv.Atoi(w)
+				variant.Height, _ = strconv.Atoi(h)
+			}
+		case "#EXT-X-MEDIA":
+			attrs := parseHLSAttributes(value)
+			rendition := hlsRendition{Type: attrs["TYPE"], GroupId: attrs["GROUP-ID"], Default: attrs["DEFAULT"] == "YES"}
+			if attrs["URI"] != "" {
+				uri, err := resolve(attrs["URI"])
+				if err != nil {
+					return nil, err
+				}
+				rendition.Url = uri
+			}
+			playlist.Media = append(playlist.Media, rendition)
+		case "#EXT-X-MEDIA-SEQUENCE":
+			sequence, _ = strconv.ParseInt(value, 10, 64)
+		case "#EXT-X-BYTERANGE":
+			rangeLen, rangeOff = parseHLSByteRange(value)
+		case "#EXT-X-KEY":
+			attrs := parseHLSAttributes(value)
+			switch attrs["METHOD"] {
+			case "NONE":
+				key, keyIV = nil, nil
+			case "AES-128":
+				uri, err := resolve(attrs["URI"])
+				if err != nil {
+					return nil, err
+				}
+				key, keyIV = &segmentKey{Url: uri}, nil
+				if iv := attrs["IV"]; iv != "" {
+					raw, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X"))
+					if err != nil || len(raw) != 16 {
+						return nil, fmt.Errorf("invalid IV %q", iv)
+					}
+					keyIV = raw
+				}
+			default:
+				return nil, fmt.Errorf("unsupported encryption %q", attrs["METHOD"])
+			}
+		case "#EXT-X-MAP":
+			attrs := parseHLSAttributes(value)
+			uri, err := resolve(attrs["URI"])
+			if err != nil {
+				return nil, err
+			}
+			playlist.Init = &mediaSegment{Url: uri}
+			if br := attrs["BYTERANGE"]; br != "" {
+				length, offset := parseHLSByteRange(br)
+				playlist.Init.Length, playlist.Init.Offset = length, max(offset, 0)
+			}
+			if key != nil {
+				playlist.Init.Key = &segmentKey{Url: key.Url, IV: keyIV}
+				if keyIV == nil {
+					playlist.Init.Key.IV = make([]byte, 16)
+					binary.BigEndian.PutUint64(playlist.Init.Key.IV[8:], uint64(sequence))
+				}
+			}
+		case "#EXT-X-ENDLIST":
+			playlist.Ended = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !started {
+		return nil, fmt.Errorf("not an HLS playlist")
+	}
+	return playlist, nil
+}
+
+// parseHLSAttributes splits an attribute list such as
+// BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2" into its values.
+func parseHLSAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for s != "" {
+		name, rest, found := strings.Cut(s, "=")
+		if !found {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+			rest = strings.TrimPrefix(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.TrimSpace(name)] = value
+		s = rest
+	}
+	return attrs
+}
+
+// parseHLSByteRange reads "<length>[@<offset>]", offset is -1 when missing.
+func parseHLSByteRange(s string) (int64, int64) {
+	lengthStr, offsetStr, hasOffset := strings.Cut(s, "@")
+	length, _ := strconv.ParseInt(lengthStr, 10, 64)
+	offset := int64(-1)
+	if hasOffset {
+		offset, _ = strconv.ParseInt(offsetStr, 10, 64)
+	}
+	return length, offset
+}
+
+func (dm *DownloadManager) fetchHLSPlaylist(ctx context.Context, client *http.Client, playlistUrl string, opts requestOptions) (*hlsPlaylist, error) {
+	base, err := neturl.Parse(playlistUrl)
+	if err != nil {
+		return nil, err
+	}
+	//Playlists of very long streams run to a few MB at most
+	data, err := fetchRange(ctx, client, playlistUrl, 0, 0, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseHLSPlaylist(strings.NewReader(string(data)), base)
+}
+
+// downloadHLS saves an HLS stream as one .ts file (.mp4 for fragmented MP4
+// streams), plus a second file for a separate audio rendition if the
+// chosen variant has one.
+func (dm *DownloadManager) downloadHLS(ctx context.Context, taskId string, playlistUrl string) {
+	dm.semaphore <- struct{}{}
+	defer func() {
+		<-dm.semaphore
+	}()
+	log.Println("Analyzing HLS playlist:", playlistUrl)
+
+	var quality, saveAs string
+	var opts requestOptions
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].ID == taskId {
+			quality, saveAs = dm.Tasks[i].Quality, dm.Tasks[i].SaveAs
+			opts = dm.Tasks[i].requestOptions()
+			break
+		}
+	}
+	dm.dataMutex.Unlock()
+
+	client := dm.httpClient()
+	playlist, err := dm.fetchHLSPlaylist(ctx, client, playlistUrl, opts)
+	if err != nil {
+		log.Println("Error fetching playlist:", err)
+		dm.setTaskError(taskId, "HLS: "+err.Error())
+		SendError(taskId, "Failed to read playlist")
+		return
+	}
+
+	source := playlistUrl
+	variantName := ""
+	var audio *hlsPlaylist
+	if len(playlist.Variants) > 0 {
+		choices := make([]streamVariant, len(playlist.Variants))
+		for i, v := range playlist.Variants {
+			choices[i] = v.streamVariant
+		}
+		variant := playlist.Variants[pickVariant(choices, quality)]
+		log.Println("Picked variant:", variant)
+		source, variantName = variant.Url, variant.String()
+
+		//A separate audio rendition, the DEFAULT one of the variant's group if there is one
+		var audioUrl string
+		for _, m := range playlist.Media {
+			if m.Type == "AUDIO" && m.GroupId == variant.Audio && variant.Audio != "" && m.Url != "" && (audioUrl == "" || m.Default) {
+				audioUrl = m.Url
+			}
+		}
+
+		playlist, err = dm.fetchHLSPlaylist(ctx, client, variant.Url, opts)
+		if err == nil && audioUrl != "" {
+			audio, err = dm.fetchHLSPlaylist(ctx, client, audioUrl, opts)
+		}
+		if err != nil {
+			log.Println("Error fetching media playlist:", err)
+			dm.setTaskError(taskId, "HLS: "+err.Error())
+			SendError(taskId, "Failed to read playlist")
+			return
+		}
+	}
+	if len(playlist.Segments) == 0 {
+		dm.setTaskError(taskId, "Playlist has no segments")
+		SendError(taskId, "Playlist has no segments")
+		return
+	}
+	if !playlist.Ended {
+		log.Println("Live playlist, saving the segments it lists right now")
+	}
+
+	baseName := saveAs
+	if baseName == "" {
+		if u, err := neturl.Parse(playlistUrl); err == nil {
+			baseName = path.Base(u.Path)
+		}
+	}
+	baseName = strings.TrimSuffix(baseName, path.Ext(baseName))
+	if baseName == "" || baseName == "." || baseName == "/" {
+		baseName = "stream"
+	}
+	baseName = sanitizeFileName(baseName)
+
+	stream := &streamManifest{Source: source}
+	stream.Tracks = append(stream.Tracks, hlsTrack(playlist, baseName))
+	if audio != nil && len(audio.Segments) > 0 {
+		stream.Tracks = append(stream.Tracks, hlsTrack(audio, baseName+".audio"))
+	}
+
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].ID == taskId {
+			dm.Tasks[i].FileName = stream.Tracks[0].FileName
+			dm.Tasks[i].Variant = variantName
+			break
+		}
+	}
+	dm.dataMutex.Unlock()
+	dm.SaveTasks()
+
+	dm.downloadStream(ctx, taskId, stream)
+}
+
+func hlsTrack(playlist *hlsPlaylist, baseName string) streamTrack {
+	track := streamTrack{FileName: baseName + ".ts"}
+	if playlist.Init != nil {
+		track.FileName = baseName + ".mp4"
+		track.Segments = append(track.Segments, *playlist.Init)
+	}
+	track.Segments = append(track.Segments, playlist.Segments...)
+	return track
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseHLSMaster(t *testing.T) {
+	base, _ := neturl.Parse("https://cdn.example.com/show/master.m3u8")
+	playlist, err := parseHLSPlaylist(strings.NewReader(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",DEFAULT=YES,URI="audio/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2",AUDIO="aac"
+360/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,AUDIO="aac"
+720/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080
+https://other.example.com/1080.m3u8
+`), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlist.Variants) != 3 {
+		t.Fatalf("got %d variants", len(playlist.Variants))
+	}
+	if v := playlist.Variants[0]; v.Url != "https://cdn.example.com/show/360/index.m3u8" || v.Height != 360 || v.Bandwidth != 800000 || v.Audio != "aac" {
+		t.Errorf("first variant is %+v", v)
+	}
+	if len(playlist.Media) != 1 || playlist.Media[0].Url != "https://cdn.example.com/show/audio/en.m3u8" || !playlist.Media[0].Default {
+		t.Errorf("renditions are %+v", playlist.Media)
+	}
+
+	choices := make([]streamVariant, len(playlist.Variants))
+	for i, v := range playlist.Variants {
+		choices[i] = v.streamVariant
+	}
+	for quality, height := range map[string]int{"": 1080, "best": 1080, "worst": 360, "720p": 720, "480": 360, "144p": 360} {
+		if got := choices[pickVariant(choices, quality)]; got.Height != height {
+			t.Errorf("quality %q picked %dp, want %dp", quality, got.Height, height)
+		}
+	}
+}
+
+func TestParseHLSMedia(t *testing.T) {
+	base, _ := neturl.Parse("https://cdn.example.com/show/720/index.m3u8")
+	playlist, err := parseHLSPlaylist(strings.NewReader(`#EXTM3U
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXT-X-KEY:METHOD=AES-128,URI="/keys/k1"
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:1000@720
+media.mp4
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:2000
+media.mp4
+#EXT-X-KEY:METHOD=AES-128,URI="/keys/k2",IV=0x000102030405060708090a0b0c0d0e0f
+#EXTINF:4.0,
+seg3.m4s
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:4.0,
+seg4.m4s
+#EXT-X-ENDLIST
+`), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !playlist.Ended {
+		t.Error("ENDLIST not seen")
+	}
+	if init := playlist.Init; init == nil || init.Url != "https://cdn.example.com/show/720/init.mp4" || init.Length != 720 || init.Offset != 0 {
+		t.Errorf("init segment is %+v", init)
+	}
+	if len(playlist.Segments) != 4 {
+		t.Fatalf("got %d segments", len(playlist.Segments))
+	}
+
+	segs := playlist.Segments
+	if segs[0].Offset != 720 || segs[0].Length != 1000 {
+		t.Errorf("first range is %d+%d", segs[0].Offset, segs[0].Length)
+	}
+	//A range without an offset follows the previous one of the same file
+	if segs[1].Offset != 1720 || segs[1].Length != 2000 {
+		t.Errorf("second range is %d+%d, want 1720+2000", segs[1].Offset, segs[1].Length)
+	}
+	wantIV := make([]byte, 16)
+	wantIV[15] = 8
+	if k := segs[1].Key; k == nil || k.Url != "https://cdn.example.com/keys/k1" || !bytes.Equal(k.IV, wantIV) {
+		t.Errorf("second key is %+v, want k1 with the sequence number 8 as IV", k)
+	}
+	if k := segs[2].Key; k == nil || k.Url != "https://cdn.example.com/keys/k2" || k.IV[1] != 1 || k.IV[15] != 15 {
+		t.Errorf("third key is %+v, want k2 with its explicit IV", k)
+	}
+	if segs[3].Key != nil {
+		t.Errorf("segment after METHOD=NONE is encrypted with %+v", segs[3].Key)
+	}
+
+	if _, err := parseHLSPlaylist(strings.NewReader("<html></html>"), base); err == nil {
+		t.Error("parsed a page that is no playlist")
+	}
+}
+
+// encryptSegment is the inverse of decryptSegment.
+func encryptSegment(plain []byte, key []byte, iv []byte) []byte {
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	data := append(bytes.Clone(plain), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return data
+}
+
+// TestDownloadHLSResumesSegments fetches an encrypted stream whose fourth
+// segment fails the first time, then resumes it from there.
+func TestDownloadHLSResumesSegments(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	var plain [][]byte
+	for i := range 6 {
+		plain = append(plain, bytes.Repeat([]byte{byte('a' + i)}, 1000+i))
+	}
+
+	var mu sync.Mutex
+	fetched := make(map[string]int)
+	var broken atomic.Bool
+	broken.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched[r.URL.Path]++
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/live/master.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=100000,RESOLUTION=320x180\nlow.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=900000,RESOLUTION=1280x720\nhigh.m3u8\n")
+		case r.URL.Path == "/live/high.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key\"\n")
+			for i := range plain {
+				fmt.Fprintf(w, "#EXTINF:2.0,\nseg%d.ts\n", i)
+			}
+			fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+		case r.URL.Path == "/live/key":
+			w.Write(key)
+		case strings.HasPrefix(r.URL.Path, "/live/seg"):
+			var i int
+			fmt.Sscanf(r.URL.Path, "/live/seg%d.ts", &i)
+			if i == 3 && broken.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			iv := make([]byte, 16)
+			iv[15] = byte(i)
+			w.Write(encryptSegment(plain[i], key, iv))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dm := newTestManager(t)
+	dm.settings.AutoRetry = false
+	//One segment at a time, so the ones after the failing one are never started
+	dm.config.PartsPerFile = 1
+	playlistUrl := srv.URL + "/live/master.m3u8"
+	dm.Tasks = []Task{{ID: playlistUrl, Url: playlistUrl, Status: "Downloading"}}
+
+	dm.downloadHLS(context.Background(), playlistUrl, playlistUrl)
+	if got := dm.Tasks[0].Status; got != "Error" {
+		t.Fatalf("task is %s with a segment failing", got)
+	}
+
+	broken.Store(false)
+	mu.Lock()
+	clear(fetched)
+	mu.Unlock()
+	dm.Tasks[0].Status = "Downloading"
+	dm.downloadHLS(context.Background(), playlistUrl, playlistUrl)
+
+	if got := dm.Tasks[0].Status; got != "Completed" {
+		t.Fatalf("task is %s after the resume", got)
+	}
+	if got := dm.Tasks[0].Variant; !strings.HasPrefix(got, "1280x720") {
+		t.Errorf("picked variant %q", got)
+	}
+	for i := range plain {
+		want := 0
+		if i >= 3 {
+			want = 1
+		}
+		if got := fetched[fmt.Sprintf("/live/seg%d.ts", i)]; got != want {
+			t.Errorf("resume fetched segment %d %d times, want %d", i, got, want)
+		}
+	}
+	got, err := os.ReadFile(filepath.Join("downloads", "master.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bytes.Join(plain, nil)) {
+		t.Error("joined stream differs from the decrypted segments")
+	}
+}
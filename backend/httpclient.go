@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"sync"
+	"time"
+)
+
+// clientKey holds every setting that changes how connections are made.
+// Requests with the same key can share connections.
+type clientKey struct {
+	proxy       string
+	connTimeout int
+}
+
+// clientPool hands out one client per clientKey, so HEAD requests, parts,
+// retries and mirror probes reuse open connections and TLS sessions instead
+// of dialing again each time. All of them share one cookie jar and the
+// saved logins.
+type clientPool struct {
+	clients map[clientKey]*http.Client
+	jar     http.CookieJar
+	creds   *credentialStore
+	mu      sync.Mutex
+}
+
+func newClientPool(jar http.CookieJar, creds *credentialStore) *clientPool {
+	return &clientPool{clients: make(map[clientKey]*http.Client), jar: jar, creds: creds}
+}
+
+func (cp *clientPool) get(proxyHost string, proxyPort int, connTimeout int, enableProxy bool) *http.Client {
+	key := clientKey{connTimeout: connTimeout}
+	if enableProxy && proxyHost != "" {
+		key.proxy = fmt.Sprintf("http://%s:%d", proxyHost, proxyPort)
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if client, ok := cp.clients[key]; ok {
+		return client
+	}
+	client := newHTTPClient(key, cp.jar, cp.creds)
+	cp.clients[key] = client
+	return client
+}
+
+// newHTTPClient builds a client that honors the proxy and connection timeout
+// settings. It keeps enough idle connections per host for every part of a
+// few downloads, uses HTTP/2 when the server offers it, speaks FTP too and
+// logs in to the hosts creds has logins for.
+func newHTTPClient(key clientKey, jar http.CookieJar, creds *credentialStore) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(key.connTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if key.proxy != "" {
+		proxyAddr, _ := neturl.Parse(key.proxy)
+		transport.Proxy = http.ProxyURL(proxyAddr)
+	}
+	//FTP goes straight to the server, the proxy setting is an HTTP proxy
+	ftpTransport := &ftpTransport{connTimeout: dialer.Timeout}
+	transport.RegisterProtocol("ftp", ftpTransport)
+	transport.RegisterProtocol("ftps", ftpTransport)
+
+	return &http.Client{
+		Transport: newAuthTransport(transport, creds),
+		Jar:       jar,
+	}
+}
+
+// requestOptions is what a task adds to every request it makes: its login
+// and extra headers, cookies included.
+type requestOptions struct {
+	username string
+	password string
+	header   http.Header
+}
+
+func (o requestOptions) apply(req *http.Request) {
+	for key, values := range o.header {
+		req.Header[key] = values
+	}
+	if o.username != "" {
+		req.SetBasicAuth(o.username, o.password)
+	}
+}
+
+// requestOptions collects the login, headers and cookies of t, on top of
+// the headers its resolver asked for.
+func (t *Task) requestOptions() requestOptions {
+	header := make(http.Header)
+	if t.Resolved != nil {
+		for key, values := range t.Resolved.Headers {
+			header[key] = values
+		}
+	}
+	for key, value := range t.Headers {
+		header.Set(key, value)
+	}
+	if t.Cookies != "" {
+		if cookies := header.Get("Cookie"); cookies != "" {
+			header.Set("Cookie", cookies+"; "+t.Cookies)
+		} else {
+			header.Set("Cookie", t.Cookies)
+		}
+	}
+	return requestOptions{username: t.Username, password: t.Password, header: header}
+}
+
+// httpClient returns the shared client for the current settings.
+func (dm *DownloadManager) httpClient() *http.Client {
+	return dm.httpClients.get(dm.settings.ProxyHost, dm.settings.ProxyPort, dm.settings.ConnTimeout, dm.settings.EnableProxy)
+}
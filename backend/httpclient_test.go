@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClientPoolSharesClientsPerSettings(t *testing.T) {
+	cp := newClientPool(nil, nil)
+	direct := cp.get("proxy.local", 8080, 10, false)
+	if cp.get("", 0, 10, false) != direct {
+		t.Error("a disabled proxy got a client of its own")
+	}
+	if cp.get("proxy.local", 8080, 10, true) == direct {
+		t.Error("proxied and direct requests share a client")
+	}
+	if cp.get("", 0, 30, false) == direct {
+		t.Error("different connection timeouts share a client")
+	}
+	if len(cp.clients) != 3 {
+		t.Errorf("pool holds %d clients, want 3", len(cp.clients))
+	}
+}
+
+func TestHTTPClientReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	client := newClientPool(nil, nil).get("", 0, 5, false)
+	for range 3 {
+		res, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+	if conns.Load() != 1 {
+		t.Errorf("opened %d connections for 3 requests, want 1", conns.Load())
+	}
+}
+
+func TestTaskRequestOptions(t *testing.T) {
+	task := &Task{
+		Username: "joe",
+		Password: "secret",
+		Headers:  map[string]string{"Referer": "https://example.com/page", "X-Session": "task"},
+		Cookies:  "theme=dark",
+		Resolved: &Resolution{Headers: http.Header{"X-Session": {"resolver"}, "Cookie": {"sid=abc"}}},
+	}
+	req := httptest.NewRequest("GET", "https://example.com/file.bin", nil)
+	task.requestOptions().apply(req)
+
+	if got := req.Header.Get("X-Session"); got != "task" {
+		t.Errorf("X-Session is %q, the task's own header should win", got)
+	}
+	if got := req.Header.Get("Cookie"); got != "sid=abc; theme=dark" {
+		t.Errorf("Cookie is %q", got)
+	}
+	if got := req.Header.Get("Referer"); got != "https://example.com/page" {
+		t.Errorf("Referer is %q", got)
+	}
+	if user, password, ok := req.BasicAuth(); !ok || user != "joe" || password != "secret" {
+		t.Errorf("login is %q/%q", user, password)
+	}
+}
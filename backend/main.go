@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"path"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
@@ -16,6 +19,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/kkdai/youtube/v2"
 )
 
 type Config struct {
@@ -27,7 +31,72 @@ type Config struct {
 
 // Map JSON data from frontend
 type DownloadRequest struct {
-	Url string `json:"url"`
+	Url           string   `json:"url"`
+	Checksum      string   `json:"checksum"` // optional, "sha256:<hex>" or a bare hex digest
+	VerifySidecar bool     `json:"verifySidecar"`
+	Mirrors       []string `json:"mirrors"`  // optional, more URLs serving the same file
+	Username      string   `json:"username"` // optional, for servers that need a login
+	Password      string   `json:"password"`
+	Quality       string   `json:"quality"` // optional, "best", "worst", "720p", or "best <=1080p mp4"/"audio only m4a" for YouTube
+	Itag          int      `json:"itag"`    // optional, a YouTube format from /youtube/formats
+
+	Headers   map[string]string `json:"headers"`   // optional, sent with every request for the file
+	Cookies   string            `json:"cookies"`   // optional, "name=value; name2=value2"
+	Referer   string            `json:"referer"`   // optional, shorthand for the Referer header
+	UserAgent string            `json:"userAgent"` // optional, shorthand for the User-Agent header
+	Method    string            `json:"method"`    // optional, GET or POST, GET when empty
+	FileName  string            `json:"fileName"`  // optional, name to save as instead of the server's
+
+	SpeedLimit int64 `json:"speedLimit"` // optional, cap of this download in bytes/sec
+	Weight     int   `json:"weight"`     // optional, share of the global limit against other downloads, 1 when 0
+	Force      bool  `json:"force"`      // optional, start now even while the schedule or the quota holds the queue
+}
+
+// LimitRequest changes the speed cap and weight of a download.
+type LimitRequest struct {
+	Url        string `json:"url"`
+	SpeedLimit int64  `json:"speedLimit"` // bytes/sec, 0 for no cap
+	Weight     int    `json:"weight"`     // 1 when 0
+}
+
+// headers returns Headers with the Referer and User-Agent shorthands added,
+// or an error for one that can't be sent or would break ranged requests.
+func (req *DownloadRequest) headers() (map[string]string, error) {
+	headers := make(map[string]string)
+	for name, value := range req.Headers {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	if req.Referer != "" {
+		headers["Referer"] = req.Referer
+	}
+	if req.UserAgent != "" {
+		headers["User-Agent"] = req.UserAgent
+	}
+	for name, value := range headers {
+		if !validHeaderName(name) || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid header %q", name)
+		}
+		switch name {
+		case "Range", "If-Range", "Content-Length", "Host":
+			return nil, fmt.Errorf("header %q is set by the downloader", name)
+		}
+	}
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	return headers, nil
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
 }
 
 // To identify which download to pause/resume
@@ -47,7 +116,15 @@ type DownloadManager struct {
 	config   Config
 	settings Settings
 
-	limiter *BandwidthMonitor
+	limiter   *BandwidthMonitor
+	scheduler *scheduler
+	quota     *quotaTracker
+
+	httpClients *clientPool
+	cookies     *cookieJar
+	credentials *credentialStore
+	youtube     youtubeClient
+	resolvers   *resolverRegistry
 }
 
 // Global Manager
@@ -57,10 +134,16 @@ var (
 	manager    *DownloadManager
 )
 
-// Upgrade http request to websocket
+// Origins of the frontend, the only pages allowed to call the API
+var allowedOrigins = []string{"http://localhost:4200", "http://localhost:8080"}
+
+// Upgrade http request to websocket. The socket can change limits, so pages
+// on other sites must not open it. Browsers always send their Origin here,
+// clients that aren't browsers send none.
 var wsupgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
-		return true
+		origin := r.Header.Get("Origin")
+		return origin == "" || slices.Contains(allowedOrigins, origin)
 	},
 }
 
@@ -72,15 +155,11 @@ func main() {
 	//Enable CORS
 	r.Use(func(c *gin.Context) {
 		origin := c.Request.Header.Get("Origin")
-		allowedOrigins := []string{"http://localhost:4200", "http://localhost:8080"}
-		for _, allowed := range allowedOrigins {
-			if origin == allowed {
-				c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
-				break
-			}
+		if slices.Contains(allowedOrigins, origin) {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
 		}
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST,GET,DELETE,OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+extensionTokenHeader)
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -89,6 +168,7 @@ func main() {
 	})
 
 	manager = NewDownloadManager()
+	r.Use(manager.guardPosts)
 
 	r.GET("/ws", manager.wsHandler)
 	r.POST("/download", manager.StartDownloadHandler)
@@ -98,11 +178,35 @@ func main() {
 	r.POST("/settings", manager.UpdateSettingsHandler)
 	r.DELETE("/delete", manager.DeleteDownloadHandler)
 	r.POST("/mode", manager.SetModeHandler)
+	r.POST("/metalink", manager.MetalinkHandler)
+	r.GET("/youtube/formats", manager.YoutubeFormatsHandler)
+	r.GET("/cookies", manager.ListCookiesHandler)
+	r.POST("/cookies", manager.ImportCookiesHandler)
+	r.DELETE("/cookies", manager.ClearCookiesHandler)
+	r.GET("/credentials", manager.ListCredentialsHandler)
+	r.POST("/credentials", manager.SaveCredentialHandler)
+	r.DELETE("/credentials", manager.DeleteCredentialHandler)
+	r.POST("/credentials/netrc", manager.ImportNetrcHandler)
+	r.POST("/extension/download", manager.ExtensionDownloadHandler)
+	r.POST("/limit", manager.SetLimitHandler)
+	r.GET("/quota", manager.QuotaHandler)
 
 	manager.LoadTasks()
 	manager.LoadSettings()
+	manager.ensureExtensionToken()
+	manager.limiter.SetLimit(manager.settings.SpeedLimit, manager.settings.SpeedBurst)
+	manager.quota.load()
+	manager.quota.setLimits(manager.settings.QuotaDaily, manager.settings.QuotaWeekly, manager.settings.QuotaMonthly)
+	manager.limiter.SetCounterSource(newCounterSource(manager.settings.BandwidthSource, manager.settings.NetInterfaces, manager.settings.NetDevPath))
+	manager.cookies.load()
+	manager.credentials.load()
 
 	manager.limiter.Start()
+	manager.scheduler.Start()
+	manager.quota.Start()
+	//Downloads held when the app was closed go on if what held them has passed
+	manager.runQueue("Quota")
+	manager.runQueue("Queued")
 
 	srv := &http.Server{
 		Addr:    manager.config.Port,
@@ -141,6 +245,8 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	manager.limiter.Stop()
+	manager.scheduler.Stop()
+	manager.quota.Stop()
 	srv.Shutdown(ctx)
 
 	log.Println("Server stopped completely")
@@ -153,6 +259,8 @@ func NewDownloadManager() *DownloadManager {
 		PartsPerFile:  4,
 		DownloadDir:   ".",
 	}
+	cookies := newCookieJar("cookies.json")
+	credentials := newCredentialStore("credentials.json", "credentials.key")
 	dm := &DownloadManager{
 		Tasks:           make([]Task, 0),
 		downloadManager: make(map[string]context.CancelFunc),
@@ -170,9 +278,19 @@ func NewDownloadManager() *DownloadManager {
 			NotifComplete:   true,
 			NotifError:      true,
 		},
-		limiter: NewBandwidthMonitor(),
+		limiter:     NewBandwidthMonitor(),
+		httpClients: newClientPool(cookies, credentials),
+		cookies:     cookies,
+		credentials: credentials,
+		youtube:     &youtube.Client{},
+		resolvers:   newResolverRegistry(),
 	}
-	dm.limiter.SetParts(cfg.PartsPerFile)
+	dm.scheduler = newScheduler(dm)
+	dm.quota = newQuotaTracker("usage.json")
+	dm.quota.onReached = dm.quotaReached
+	dm.quota.onReset = dm.quotaReset
+	dm.limiter.quota = dm.quota
+	dm.RegisterResolver(&youtubeResolver{client: dm.youtube})
 	return dm
 }
 
@@ -227,22 +345,33 @@ func (dm *DownloadManager) wsHandler(c *gin.Context) {
 		}
 	}()
 
-	//For keeping connection alive
+	//For keeping connection alive, and for the changes clients send
 	for {
-		_, _, err := con.ReadMessage()
+		_, data, err := con.ReadMessage()
 		if err != nil {
 			break
 		}
+		dm.handleClientMessage(data)
 	}
 
 }
 
-// Bridge function
-func SendProgress(taskId string, fileName string, percent float64, totalSize int64, speed float64, eta float64) {
+// Sends a message to every connected client
+func broadcast(msg gin.H) {
 	clientsMux.Lock()
 	defer clientsMux.Unlock()
 
-	msg := gin.H{
+	for con := range clients {
+		if err := con.WriteJSON(msg); err != nil {
+			con.Close()
+			delete(clients, con)
+		}
+	}
+}
+
+// Bridge function
+func SendProgress(taskId string, fileName string, percent float64, totalSize int64, speed float64, eta float64) {
+	broadcast(gin.H{
 		"event":     "progress",
 		"id":        taskId,
 		"fileName":  fileName,
@@ -250,32 +379,41 @@ func SendProgress(taskId string, fileName string, percent float64, totalSize int
 		"totalSize": totalSize,
 		"speed":     speed,
 		"eta":       eta,
-	}
-
-	for con := range clients {
-		if err := con.WriteJSON(msg); err != nil {
-			con.Close()
-			delete(clients, con)
-		}
-	}
+	})
 }
 
 func SendError(taskId string, message string) {
-	clientsMux.Lock()
-	defer clientsMux.Unlock()
-
-	msg := gin.H{
+	broadcast(gin.H{
 		"event":   "error",
 		"id":      taskId,
 		"message": message,
-	}
+	})
+}
 
-	for con := range clients {
-		if err := con.WriteJSON(msg); err != nil {
-			con.Close()
-			delete(clients, con)
-		}
-	}
+func SendStatus(taskId string, status string) {
+	broadcast(gin.H{
+		"event":  "status",
+		"id":     taskId,
+		"status": status,
+	})
+}
+
+func SendLimit(taskId string, speedLimit int64, weight int) {
+	broadcast(gin.H{
+		"event":      "limit",
+		"id":         taskId,
+		"speedLimit": speedLimit,
+		"weight":     weight,
+	})
+}
+
+func SendChecksum(taskId string, status string, source string) {
+	broadcast(gin.H{
+		"event":  "checksum",
+		"id":     taskId,
+		"status": status,
+		"source": source,
+	})
 }
 
 // Handler method: Starts when frontend sends the request
@@ -287,10 +425,15 @@ func (dm *DownloadManager) StartDownloadHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	dm.startDownload(c, req)
+}
 
+// startDownload adds the task req asks for, or updates the one there is for
+// its URL, and starts it.
+func (dm *DownloadManager) startDownload(c *gin.Context, req DownloadRequest) {
 	parsedUrl, urlErr := url.ParseRequestURI(req.Url)
-	if urlErr != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid URL. Only http:// and https:// are supported."})
+	if urlErr != nil || !supportedScheme(parsedUrl) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid URL. Only http://, https://, ftp:// and ftps:// are supported."})
 		return
 	}
 
@@ -299,52 +442,156 @@ func (dm *DownloadManager) StartDownloadHandler(c *gin.Context) {
 		req.Url = parsedUrl.String()
 	}
 
+	for _, m := range req.Mirrors {
+		mirrorUrl, err := url.ParseRequestURI(m)
+		if err != nil || !supportedScheme(mirrorUrl) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mirror URL: " + m})
+			return
+		}
+	}
+
+	expected, err := parseChecksum(req.Checksum)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid checksum: " + err.Error()})
+		return
+	}
+
+	headers, err := req.headers()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid headers: " + err.Error()})
+		return
+	}
+	if strings.ContainsAny(req.Cookies, "\r\n") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cookies"})
+		return
+	}
+	req.Method = strings.ToUpper(req.Method)
+	if req.Method != "" && req.Method != "GET" && req.Method != "POST" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Method must be GET or POST"})
+		return
+	}
+	if err := checkTaskLimit(req.SpeedLimit, req.Weight); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	saveAs := sanitizeFileName(path.Base(strings.ReplaceAll(req.FileName, "\\", "/")))
+	if saveAs == "." || saveAs == "/" || saveAs == ".." {
+		saveAs = ""
+	}
+
+	//Outside of the schedule's windows or over the quota downloads wait their turn, unless forced
+	status := "Downloading"
+	var held string
+	if !req.Force {
+		held = dm.heldStatus()
+	}
+	if held != "" {
+		status = held
+	}
+
 	dm.dataMutex.Lock()
 	var taskFound bool = false
 
 	for i := range dm.Tasks {
 		if dm.Tasks[i].ID == req.Url {
-			dm.Tasks[i].Status = "Downloading"
+			dm.Tasks[i].Status = status
+			if expected.Algo != "" {
+				dm.Tasks[i].Checksum = expected.String()
+			}
+			if req.VerifySidecar {
+				dm.Tasks[i].VerifySidecar = true
+			}
+			if len(req.Mirrors) > 0 {
+				dm.Tasks[i].Mirrors = req.Mirrors
+			}
+			if req.Username != "" {
+				dm.Tasks[i].Username = req.Username
+				dm.Tasks[i].Password = req.Password
+			}
+			if req.Quality != "" {
+				dm.Tasks[i].Quality = req.Quality
+			}
+			if req.Itag > 0 {
+				dm.Tasks[i].Itag = req.Itag
+			}
+			if headers != nil {
+				dm.Tasks[i].Headers = headers
+			}
+			if req.Cookies != "" {
+				dm.Tasks[i].Cookies = req.Cookies
+			}
+			if req.Method != "" {
+				dm.Tasks[i].Method = req.Method
+			}
+			if saveAs != "" {
+				dm.Tasks[i].SaveAs = saveAs
+			}
+			if req.SpeedLimit > 0 || req.Weight > 0 {
+				dm.Tasks[i].SpeedLimit = req.SpeedLimit
+				dm.Tasks[i].Weight = req.Weight
+			}
+			dm.limiter.SetTaskLimit(req.Url, dm.Tasks[i].SpeedLimit, dm.Tasks[i].Weight)
 			taskFound = true
 			break
 		}
 	}
 
 	if !taskFound {
+		fileName := saveAs
+		if fileName == "" {
+			fileName = "Pending..."
+		}
 		newTask := Task{
 			ID:         req.Url,
 			Url:        req.Url,
-			FileName:   "Pending...",
-			Status:     "Downloading",
+			FileName:   fileName,
+			Status:     status,
 			TotalSize:  0,
 			Downloaded: 0,
+			Checksum:   expected.String(),
+
+			VerifySidecar: req.VerifySidecar,
+			Mirrors:       req.Mirrors,
+			Username:      req.Username,
+			Password:      req.Password,
+			Quality:       req.Quality,
+			Itag:          req.Itag,
+			Headers:       headers,
+			Cookies:       req.Cookies,
+			Method:        req.Method,
+			SaveAs:        saveAs,
+			SpeedLimit:    req.SpeedLimit,
+			Weight:        req.Weight,
 		}
 		dm.Tasks = append(dm.Tasks, newTask)
+		dm.limiter.SetTaskLimit(req.Url, req.SpeedLimit, req.Weight)
 	}
 
 	dm.dataMutex.Unlock()
 	dm.SaveTasks()
 
-	dm.managerMutex.Lock()
-	if _, alreadyRunning := dm.downloadManager[req.Url]; alreadyRunning {
-		dm.managerMutex.Unlock()
+	if held != "" {
+		SendStatus(req.Url, status)
+		message := "Download queued until the schedule starts the queue"
+		if held == "Quota" {
+			message = "Download queued until the data quota resets"
+		}
+		c.JSON(http.StatusOK, gin.H{"message": message + `, send "force": true to start it now`, "status": status})
+		return
+	}
+
+	started := dm.launch(req.Url, func(ctx context.Context) {
+		if req.Force {
+			ctx = context.WithValue(ctx, forcedKey{}, true)
+		}
+		dm.download(ctx, req.Url, parsedUrl)
+	})
+	if !started {
 		c.JSON(http.StatusOK, gin.H{
 			"message": "Download Already Running",
 		})
 		return
 	}
-	dm.managerMutex.Unlock()
-
-	ctx, cancel := context.WithCancel(context.Background())
-	dm.managerMutex.Lock()
-	dm.downloadManager[req.Url] = cancel
-	dm.managerMutex.Unlock()
-
-	if strings.Contains(req.Url, "youtube") || strings.Contains(req.Url, "youtu.be") {
-		go dm.downloadYoutube(ctx, req.Url)
-	} else {
-		go dm.processDownload(ctx, req.Url, req.Url)
-	}
 
 	//Response
 	c.JSON(http.StatusOK, gin.H{
@@ -353,6 +600,34 @@ func (dm *DownloadManager) StartDownloadHandler(c *gin.Context) {
 
 }
 
+// supportedScheme reports whether downloads from u can be handled.
+func supportedScheme(u *url.URL) bool {
+	switch u.Scheme {
+	case "http", "https", "ftp", "ftps":
+		return true
+	}
+	return false
+}
+
+// forcedKey marks the context of a download started with force, it runs
+// even while the queue is held.
+type forcedKey struct{}
+
+// launch runs a download in the background under a cancel func registered
+// for taskId. It returns false if the task is already running.
+func (dm *DownloadManager) launch(taskId string, run func(ctx context.Context)) bool {
+	dm.managerMutex.Lock()
+	defer dm.managerMutex.Unlock()
+	if _, alreadyRunning := dm.downloadManager[taskId]; alreadyRunning {
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dm.downloadManager[taskId] = cancel
+	go run(ctx)
+	return true
+}
+
 func (dm *DownloadManager) setTaskError(taskId string, errMsg string) {
 	dm.managerMutex.Lock()
 	if cancel, exists := dm.downloadManager[taskId]; exists {
@@ -373,6 +648,19 @@ func (dm *DownloadManager) setTaskError(taskId string, errMsg string) {
 	log.Println("Task error:", taskId, "-", errMsg)
 }
 
+func (dm *DownloadManager) setTaskStatus(taskId string, status string) {
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].ID == taskId {
+			dm.Tasks[i].Status = status
+			break
+		}
+	}
+	dm.dataMutex.Unlock()
+	dm.SaveTasks()
+	SendStatus(taskId, status)
+}
+
 func (dm *DownloadManager) PauseDownloadHandler(c *gin.Context) {
 	var req ActionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -380,34 +668,129 @@ func (dm *DownloadManager) PauseDownloadHandler(c *gin.Context) {
 		return
 	}
 
+	if dm.pauseTask(req.Url, "Paused") {
+		c.JSON(http.StatusOK, gin.H{"message": "Download Paused"})
+	} else {
+		c.JSON(http.StatusNotFound, gin.H{"message": "Download not running"})
+	}
+}
+
+// pauseTask stops a download and gives it status, Paused or a held one. It
+// returns false if the download wasn't running.
+func (dm *DownloadManager) pauseTask(taskId string, status string) bool {
+	//Pausing a playlist pauses its videos too
+	members := dm.groupMembers(taskId)
+
 	dm.managerMutex.Lock()
-	cancel, exists := dm.downloadManager[req.Url]
+	cancel, exists := dm.downloadManager[taskId]
 	if exists {
 		cancel()
-		delete(dm.downloadManager, req.Url)
+		delete(dm.downloadManager, taskId)
+	}
+	for _, id := range members {
+		if cancel, running := dm.downloadManager[id]; running {
+			cancel()
+			delete(dm.downloadManager, id)
+		}
 	}
 	dm.managerMutex.Unlock()
 
 	dm.dataMutex.Lock()
 	for i := range dm.Tasks {
-		if dm.Tasks[i].ID == req.Url {
-			dm.Tasks[i].Status = "Paused"
-			break
+		if dm.Tasks[i].ID == taskId || (dm.Tasks[i].Group == taskId && dm.Tasks[i].Status == "Downloading") {
+			dm.Tasks[i].Status = status
 		}
 	}
 	dm.dataMutex.Unlock()
 	dm.SaveTasks()
-	if exists {
-		c.JSON(http.StatusOK, gin.H{"message": "Download Paused"})
-	} else {
-		c.JSON(http.StatusNotFound, gin.H{"message": "Download not running"})
-	}
+	return exists
 }
 
 func (dm *DownloadManager) ResumeDownloadHandler(c *gin.Context) {
 	dm.StartDownloadHandler(c)
 }
 
+// heldStatus returns the status downloads wait in while the queue is held,
+// Quota when the data quota is used up or Queued outside of the schedule's
+// windows, or "" when they can run.
+func (dm *DownloadManager) heldStatus() string {
+	if dm.quota.exceeded() != "" {
+		return "Quota"
+	}
+	if dm.scheduler.holding() {
+		return "Queued"
+	}
+	return ""
+}
+
+// isHeld reports whether status is one the queue holds downloads in. Their
+// status sticks when the download they had running winds down.
+func isHeld(status string) bool {
+	return status == "Queued" || status == "Quota"
+}
+
+// holdQueue pauses every running download into status, playlists before
+// their videos so they don't start the next one.
+func (dm *DownloadManager) holdQueue(status string) {
+	dm.managerMutex.Lock()
+	running := make(map[string]bool)
+	for id := range dm.downloadManager {
+		running[id] = true
+	}
+	dm.managerMutex.Unlock()
+
+	var groups, single []string
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		//Finished downloads keep their entry, only the ones still going are paused
+		if running[dm.Tasks[i].ID] && dm.Tasks[i].Status == "Downloading" {
+			if dm.Tasks[i].IsGroup {
+				groups = append(groups, dm.Tasks[i].ID)
+			} else if !running[dm.Tasks[i].Group] {
+				single = append(single, dm.Tasks[i].ID)
+			}
+		}
+	}
+	dm.dataMutex.Unlock()
+
+	for _, id := range append(groups, single...) {
+		dm.pauseTask(id, status)
+		SendStatus(id, status)
+	}
+}
+
+// runQueue starts the downloads waiting in status, or moves them over to
+// the status of whatever still holds the queue. Videos of a playlist are
+// left to the playlist, which starts them as slots free up.
+func (dm *DownloadManager) runQueue(status string) {
+	held := dm.heldStatus()
+	var waiting []string
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].Status == status && dm.Tasks[i].Group == "" {
+			waiting = append(waiting, dm.Tasks[i].ID)
+		}
+	}
+	dm.dataMutex.Unlock()
+
+	for _, id := range waiting {
+		if held != "" {
+			if held != status {
+				dm.setTaskStatus(id, held)
+			}
+			continue
+		}
+		u, err := url.Parse(id)
+		if err != nil {
+			continue
+		}
+		dm.launch(id, func(ctx context.Context) {
+			dm.setTaskStatus(id, "Downloading")
+			dm.download(ctx, id, u)
+		})
+	}
+}
+
 func (dm *DownloadManager) DeleteDownloadHandler(c *gin.Context) {
 	var req ActionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -415,29 +798,33 @@ func (dm *DownloadManager) DeleteDownloadHandler(c *gin.Context) {
 		return
 	}
 
+	//Deleting a playlist deletes its videos too
+	ids := append([]string{req.Url}, dm.groupMembers(req.Url)...)
+
 	dm.managerMutex.Lock()
-	if cancel, exists := dm.downloadManager[req.Url]; exists {
-		cancel()
-		delete(dm.downloadManager, req.Url)
+	for _, id := range ids {
+		if cancel, exists := dm.downloadManager[id]; exists {
+			cancel()
+			delete(dm.downloadManager, id)
+		}
 	}
 	dm.managerMutex.Unlock()
 
 	time.Sleep(500 * time.Millisecond)
 
 	dm.dataMutex.Lock()
-	for i := range dm.Tasks {
-		if dm.Tasks[i].ID == req.Url {
-			dm.Tasks = append(dm.Tasks[:i], dm.Tasks[i+1:]...)
-			break
+	kept := dm.Tasks[:0]
+	for _, t := range dm.Tasks {
+		if t.ID != req.Url && t.Group != req.Url {
+			kept = append(kept, t)
 		}
 	}
+	dm.Tasks = kept
 	dm.dataMutex.Unlock()
 
-	hash := taskHash(req.Url)
-	cleanupPattern := hash + "_part_*.tmp"
-	matches, _ := filepath.Glob(cleanupPattern)
-	for _, f := range matches {
-		os.Remove(f)
+	for _, id := range ids {
+		discardDownload(id)
+		dm.limiter.RemoveTask(id)
 	}
 
 	dm.SaveTasks()
@@ -446,8 +833,11 @@ func (dm *DownloadManager) DeleteDownloadHandler(c *gin.Context) {
 
 func (dm *DownloadManager) GetSettingsHandler(c *gin.Context) {
 	dm.dataMutex.Lock()
-	defer dm.dataMutex.Unlock()
-	c.JSON(http.StatusOK, dm.settings)
+	settings := dm.settings
+	dm.dataMutex.Unlock()
+	//Whoever can read the token could hand downloads to the app like the extension
+	settings.ExtensionToken = ""
+	c.JSON(http.StatusOK, settings)
 }
 
 func (dm *DownloadManager) UpdateSettingsHandler(c *gin.Context) {
@@ -456,8 +846,20 @@ func (dm *DownloadManager) UpdateSettingsHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := validateSchedule(newSettings.Schedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validBandwidthSource(newSettings.BandwidthSource) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bandwidthSource must be host, self or empty"})
+		return
+	}
 
 	dm.dataMutex.Lock()
+	//The settings page never gets the token, saving it must not wipe it
+	if newSettings.ExtensionToken == "" {
+		newSettings.ExtensionToken = dm.settings.ExtensionToken
+	}
 	dm.settings = newSettings
 	dm.dataMutex.Unlock()
 
@@ -466,7 +868,10 @@ func (dm *DownloadManager) UpdateSettingsHandler(c *gin.Context) {
 	dm.config.DownloadDir = newSettings.DownloadPath
 	dm.config.MaxConcurrent = newSettings.MaxDownloads
 	dm.config.PartsPerFile = newSettings.MaxConnections
-	dm.limiter.SetParts(newSettings.MaxConnections)
+	dm.limiter.SetLimit(newSettings.SpeedLimit, newSettings.SpeedBurst)
+	dm.quota.setLimits(newSettings.QuotaDaily, newSettings.QuotaWeekly, newSettings.QuotaMonthly)
+	dm.limiter.SetCounterSource(newCounterSource(newSettings.BandwidthSource, newSettings.NetInterfaces, newSettings.NetDevPath))
+	dm.scheduler.tick()
 
 	dm.managerMutex.Lock()
 	activeCount := len(dm.downloadManager)
@@ -501,6 +906,10 @@ func (dm *DownloadManager) SaveTasks() {
 	if renameErr := os.Rename(tmpFile, "tasks.json"); renameErr != nil {
 		log.Println("Error renaming tasks file:", renameErr)
 	}
+
+	if err := dm.credentials.saveTaskSecrets("task-secrets.json", dm.Tasks); err != nil {
+		log.Println("Error saving task secrets:", err)
+	}
 }
 
 func (dm *DownloadManager) LoadTasks() {
@@ -517,11 +926,15 @@ func (dm *DownloadManager) LoadTasks() {
 		log.Println("Error parsing tasks.json", err)
 		return
 	}
+	dm.credentials.loadTaskSecrets("task-secrets.json", dm.Tasks)
 
 	for i := range dm.Tasks {
 		if dm.Tasks[i].Status == "Downloading" {
 			dm.Tasks[i].Status = "Paused"
 		}
+		if dm.Tasks[i].SpeedLimit > 0 || dm.Tasks[i].Weight > 0 {
+			dm.limiter.SetTaskLimit(dm.Tasks[i].ID, dm.Tasks[i].SpeedLimit, dm.Tasks[i].Weight)
+		}
 	}
 }
 
@@ -573,3 +986,85 @@ func (dm *DownloadManager) SetModeHandler(c *gin.Context) {
 	log.Println("Speed mode set to:", req.Mode)
 	c.JSON(http.StatusOK, gin.H{"message": "Mode set to " + req.Mode})
 }
+
+// maxWeight bounds task weights, a foreground download at 100 already gets
+// nearly all of the limit.
+const maxWeight = 100
+
+func checkTaskLimit(speedLimit int64, weight int) error {
+	if speedLimit < 0 || weight < 0 || weight > maxWeight {
+		return fmt.Errorf("speedLimit can't be negative and weight must be 0 to %d", maxWeight)
+	}
+	return nil
+}
+
+// setTaskLimit changes the speed cap and weight of a task, running or not,
+// and tells the clients.
+func (dm *DownloadManager) setTaskLimit(taskId string, speedLimit int64, weight int) error {
+	if err := checkTaskLimit(speedLimit, weight); err != nil {
+		return err
+	}
+	found := false
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].ID == taskId {
+			dm.Tasks[i].SpeedLimit = speedLimit
+			dm.Tasks[i].Weight = weight
+			found = true
+			break
+		}
+	}
+	dm.dataMutex.Unlock()
+	if !found {
+		return errTaskNotFound
+	}
+	dm.SaveTasks()
+
+	dm.limiter.SetTaskLimit(taskId, speedLimit, weight)
+	log.Printf("Speed limit of %s set to %d bytes/sec, weight %d\n", taskId, speedLimit, weight)
+	SendLimit(taskId, speedLimit, weight)
+	return nil
+}
+
+var errTaskNotFound = errors.New("task not found")
+
+func (dm *DownloadManager) SetLimitHandler(c *gin.Context) {
+	var req LimitRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := dm.setTaskLimit(req.Url, req.SpeedLimit, req.Weight); err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, errTaskNotFound) {
+			code = http.StatusNotFound
+		}
+		c.JSON(code, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Speed limit set"})
+}
+
+// handleClientMessage acts on an event a client sent over the WebSocket:
+//
+//	{"event": "set_limit", "id": "<task>", "speedLimit": 2097152, "weight": 3}
+func (dm *DownloadManager) handleClientMessage(data []byte) {
+	var msg struct {
+		Event      string `json:"event"`
+		Id         string `json:"id"`
+		SpeedLimit int64  `json:"speedLimit"`
+		Weight     int    `json:"weight"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Println("Ignoring WebSocket message:", err)
+		return
+	}
+	switch msg.Event {
+	case "set_limit":
+		if err := dm.setTaskLimit(msg.Id, msg.SpeedLimit, msg.Weight); err != nil {
+			SendError(msg.Id, "Cannot set speed limit: "+err.Error())
+		}
+	default:
+		log.Println("Ignoring WebSocket event:", msg.Event)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// newTestManager returns a manager that keeps tasks.json, its manifests and
+// downloads in a temporary directory, which becomes the working directory
+// for the rest of the test.
+func newTestManager(t *testing.T) *DownloadManager {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	dm := NewDownloadManager()
+	dm.config.DownloadDir = "downloads"
+	return dm
+}
+
+func TestDownloadRequestHeaders(t *testing.T) {
+	req := DownloadRequest{
+		Headers:   map[string]string{"x-api-key": "k", "referer": "https://old.example.com"},
+		Referer:   "https://example.com/page",
+		UserAgent: "Mozilla/5.0",
+	}
+	headers, err := req.headers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"X-Api-Key": "k", "Referer": "https://example.com/page", "User-Agent": "Mozilla/5.0"}
+	if len(headers) != len(want) {
+		t.Errorf("headers are %v, want %v", headers, want)
+	}
+	for name, value := range want {
+		if headers[name] != value {
+			t.Errorf("%s is %q, want %q", name, headers[name], value)
+		}
+	}
+
+	if headers, err := (&DownloadRequest{}).headers(); headers != nil || err != nil {
+		t.Errorf("no headers gave %v, %v", headers, err)
+	}
+	for _, bad := range []map[string]string{
+		{"Range": "bytes=0-"},
+		{"if-range": "\"v1\""},
+		{"X-Evil": "a\r\nHost: other"},
+		{"Bad Name": "x"},
+		{"": "x"},
+	} {
+		if _, err := (&DownloadRequest{Headers: bad}).headers(); err == nil {
+			t.Errorf("accepted %v", bad)
+		}
+	}
+}
+
+// TestSetLimitOverWebSocket changes a task's cap the way the frontend does
+// and waits for the change to be announced back.
+func TestSetLimitOverWebSocket(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dm := newTestManager(t)
+	dm.Tasks = []Task{{ID: "https://example.com/file.bin", Url: "https://example.com/file.bin", Status: "Paused"}}
+	r := gin.New()
+	r.GET("/ws", dm.wsHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	con, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	con.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg map[string]any
+	if err := con.ReadJSON(&msg); err != nil || msg["event"] != "initial_state" {
+		t.Fatalf("first message is %v, %v", msg, err)
+	}
+
+	send := func(event string) map[string]any {
+		t.Helper()
+		if err := con.WriteMessage(websocket.TextMessage, []byte(event)); err != nil {
+			t.Fatal(err)
+		}
+		var reply map[string]any
+		if err := con.ReadJSON(&reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	reply := send(`{"event":"set_limit","id":"https://example.com/file.bin","speedLimit":65536,"weight":3}`)
+	if reply["event"] != "limit" || reply["speedLimit"] != float64(65536) || reply["weight"] != float64(3) {
+		t.Errorf("announced %v", reply)
+	}
+	dm.dataMutex.Lock()
+	task := dm.Tasks[0]
+	dm.dataMutex.Unlock()
+	if task.SpeedLimit != 65536 || task.Weight != 3 {
+		t.Errorf("task has limit %d and weight %d", task.SpeedLimit, task.Weight)
+	}
+	dm.limiter.mu.Lock()
+	limit := dm.limiter.taskLimits[task.ID]
+	dm.limiter.mu.Unlock()
+	if limit != (taskLimit{bytesPerSec: 65536, weight: 3}) {
+		t.Errorf("limiter has %+v", limit)
+	}
+
+	if reply := send(`{"event":"set_limit","id":"https://example.com/file.bin","weight":1000}`); reply["event"] != "error" {
+		t.Errorf("out of range weight answered with %v", reply)
+	}
+	if reply := send(`{"event":"set_limit","id":"https://example.com/other.bin","speedLimit":1}`); reply["event"] != "error" {
+		t.Errorf("unknown task answered with %v", reply)
+	}
+}
+
+// TestWebSocketOrigins lets the frontend open the socket and turns away
+// pages of other sites.
+func TestWebSocketOrigins(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dm := newTestManager(t)
+	r := gin.New()
+	r.GET("/ws", dm.wsHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	wsUrl := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	for origin, allowed := range map[string]bool{"": true, "http://localhost:4200": true, "https://evil.example": false, "http://localhost:4200.evil.example": false} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		con, res, err := websocket.DefaultDialer.Dial(wsUrl, header)
+		if err == nil {
+			con.Close()
+		}
+		if allowed && err != nil {
+			t.Errorf("origin %q turned away: %v", origin, err)
+		}
+		if !allowed && (err == nil || res.StatusCode != http.StatusForbidden) {
+			t.Errorf("origin %q let in", origin)
+		}
+	}
+}
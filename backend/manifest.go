@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const manifestVersion = 1
+
+// taskManifest is saved next to the part files of every unfinished download.
+// It pins the layout the download was started with, so resuming never
+// depends on the current MaxConnections, and records what the remote file
+// looked like at the time.
+type taskManifest struct {
+	Version      int          `json:"version"`
+	Url          string       `json:"url"`
+	TotalSize    int64        `json:"totalSize"`
+	ETag         string       `json:"etag,omitempty"`
+	LastModified string       `json:"lastModified,omitempty"`
+	Output       string       `json:"output,omitempty"` // set in direct write mode
+	Parts        []partRecord `json:"parts"`
+}
+
+// partRecord is one part as stored in the manifest. Done is trusted in
+// direct mode, temp files are measured on disk instead.
+type partRecord struct {
+	Index int   `json:"index"`
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Done  int64 `json:"done"`
+}
+
+// remoteValidators identify one version of a remote file.
+type remoteValidators struct {
+	ETag         string
+	LastModified string
+	Size         int64
+}
+
+func validatorsFrom(res *http.Response) remoteValidators {
+	return remoteValidators{
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		Size:         res.ContentLength,
+	}
+}
+
+// differ reports whether v and o describe different files. Values one side
+// does not know about are not counted as a change.
+func (v remoteValidators) differ(o remoteValidators) bool {
+	if v.ETag != "" && o.ETag != "" && v.ETag != o.ETag {
+		return true
+	}
+	if v.LastModified != "" && o.LastModified != "" && v.LastModified != o.LastModified {
+		return true
+	}
+	return v.Size > 0 && o.Size > 0 && v.Size != o.Size
+}
+
+// ifRange picks the value for an If-Range header. Weak ETags are not allowed
+// there, so those fall back to Last-Modified.
+func (v remoteValidators) ifRange() string {
+	if v.ETag != "" && !strings.HasPrefix(v.ETag, "W/") {
+		return v.ETag
+	}
+	return v.LastModified
+}
+
+func newManifest(downloadUrl string, remote remoteValidators, parts []Part, output string) *taskManifest {
+	m := &taskManifest{
+		Version:      manifestVersion,
+		Url:          downloadUrl,
+		TotalSize:    remote.Size,
+		ETag:         remote.ETag,
+		LastModified: remote.LastModified,
+		Output:       output,
+	}
+	for _, p := range parts {
+		m.Parts = append(m.Parts, partRecord{Index: p.Index, Start: p.Start, End: p.End})
+	}
+	return m
+}
+
+func (m *taskManifest) validators() remoteValidators {
+	return remoteValidators{ETag: m.ETag, LastModified: m.LastModified, Size: m.TotalSize}
+}
+
+// parts turns the saved records back into parts.
+func (m *taskManifest) parts() []Part {
+	parts := make([]Part, len(m.Parts))
+	for i, r := range m.Parts {
+		parts[i] = Part{Index: r.Index, Start: r.Start, End: r.End}
+		if m.Output != "" {
+			parts[i].done = r.Done
+			parts[i].claimed = r.Done
+			parts[i].durable = r.Done
+		}
+	}
+	return parts
+}
+
+// loadManifest returns the saved manifest of a task, or nil if there is none
+// or it cannot be trusted any more.
+func loadManifest(taskId string) *taskManifest {
+	bytes, err := os.ReadFile(manifestFileName(taskId))
+	if err != nil {
+		return nil
+	}
+	var m taskManifest
+	if err := json.Unmarshal(bytes, &m); err != nil {
+		log.Println("Error parsing manifest:", err)
+		return nil
+	}
+	if m.Version != manifestVersion {
+		log.Println("Manifest version", m.Version, "is not supported, starting over")
+		return nil
+	}
+	if !validLayout(m.Parts, m.TotalSize) {
+		log.Println("Manifest part layout is broken, starting over")
+		return nil
+	}
+	if m.Output != "" {
+		if _, err := os.Stat(m.Output); err != nil {
+			log.Println("Output file in manifest is gone, starting over")
+			return nil
+		}
+	}
+	return &m
+}
+
+// writeManifest replaces the manifest so that a crash at any point leaves
+// either the old or the new version on disk, never a torn file.
+func writeManifest(taskId string, m *taskManifest) error {
+	bytes, err := json.MarshalIndent(m, "", " ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(manifestFileName(taskId), bytes, 0644)
+}
+
+// writeFileAtomic writes data to a temp file created with perm, syncs it and
+// renames it over name.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmpFile := name + ".tmp"
+	//A leftover temp file would keep its old mode
+	os.Remove(tmpFile)
+	file, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, name); err != nil {
+		return err
+	}
+
+	//Make the rename itself durable
+	if dir, err := os.Open(filepath.Dir(name)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// discardDownload removes everything an unfinished download left behind.
+func discardDownload(taskId string) {
+	if bytes, err := os.ReadFile(manifestFileName(taskId)); err == nil {
+		var m taskManifest
+		if json.Unmarshal(bytes, &m) == nil && m.Output != "" {
+			os.Remove(m.Output)
+		}
+	}
+	matches, _ := filepath.Glob(taskHash(taskId) + "_part_*.tmp")
+	for _, f := range matches {
+		os.Remove(f)
+	}
+	os.Remove(manifestFileName(taskId))
+	os.RemoveAll(streamDirName(taskId))
+}
+
+// validLayout checks that the parts tile a file of totalSize bytes without
+// gaps or overlaps. Unknown sizes only ever have one open ended part.
+func validLayout(parts []partRecord, totalSize int64) bool {
+	if len(parts) == 0 {
+		return false
+	}
+	if totalSize <= 0 {
+		return len(parts) == 1 && parts[0].Start == 0 && parts[0].End == -1
+	}
+	sorted := append([]partRecord(nil), parts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	var next int64
+	for _, p := range sorted {
+		if p.Start != next || p.End < p.Start {
+			return false
+		}
+		next = p.End + 1
+	}
+	return next == totalSize
+}
+
+func manifestFileName(taskId string) string {
+	return fmt.Sprintf("%s.manifest.json", taskHash(taskId))
+}
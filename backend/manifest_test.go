@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+func TestValidLayout(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts []partRecord
+		size  int64
+		want  bool
+	}{
+		{"tiles the file", []partRecord{{Start: 0, End: 49}, {Start: 50, End: 99}}, 100, true},
+		{"out of order", []partRecord{{Start: 50, End: 99}, {Start: 0, End: 49}}, 100, true},
+		{"gap", []partRecord{{Start: 0, End: 48}, {Start: 50, End: 99}}, 100, false},
+		{"overlap", []partRecord{{Start: 0, End: 50}, {Start: 50, End: 99}}, 100, false},
+		{"file grew", []partRecord{{Start: 0, End: 99}}, 200, false},
+		{"unknown size", []partRecord{{Start: 0, End: -1}}, -1, true},
+		{"empty", nil, 100, false},
+	}
+	for _, tt := range tests {
+		if got := validLayout(tt.parts, tt.size); got != tt.want {
+			t.Errorf("%s: validLayout = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	t.Chdir(t.TempDir())
+	const id = "https://example.com/file.bin"
+	good := taskManifest{Version: manifestVersion, Url: id, TotalSize: 100, Parts: []partRecord{{Index: 0, Start: 0, End: 49}, {Index: 1, Start: 50, End: 99, Done: 10}}}
+
+	if err := writeManifest(id, &good); err != nil {
+		t.Fatal(err)
+	}
+	m := loadManifest(id)
+	if m == nil || m.TotalSize != 100 || len(m.Parts) != 2 || m.Parts[1] != good.Parts[1] {
+		t.Fatalf("loaded %+v", m)
+	}
+
+	tests := []struct {
+		name   string
+		change func(m *taskManifest)
+	}{
+		{"other version", func(m *taskManifest) { m.Version = manifestVersion + 1 }},
+		{"broken layout", func(m *taskManifest) { m.Parts[1].Start = 60 }},
+		{"output file gone", func(m *taskManifest) { m.Output = "missing.pulldown" }},
+	}
+	for _, tt := range tests {
+		bad := good
+		bad.Parts = append([]partRecord(nil), good.Parts...)
+		tt.change(&bad)
+		if err := writeManifest(id, &bad); err != nil {
+			t.Fatal(err)
+		}
+		if m := loadManifest(id); m != nil {
+			t.Errorf("%s: loaded %+v", tt.name, m)
+		}
+	}
+}
+
+func TestRemoteValidators(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   remoteValidators
+		differ bool
+	}{
+		{"same", remoteValidators{ETag: `"a"`, Size: 10}, remoteValidators{ETag: `"a"`, Size: 10}, false},
+		{"other ETag", remoteValidators{ETag: `"a"`}, remoteValidators{ETag: `"b"`}, true},
+		{"other date", remoteValidators{LastModified: "Mon, 19 Oct 2026 10:00:00 GMT"}, remoteValidators{LastModified: "Tue, 20 Oct 2026 10:00:00 GMT"}, true},
+		{"other size", remoteValidators{Size: 10}, remoteValidators{Size: 11}, true},
+		{"one side unknown", remoteValidators{ETag: `"a"`, Size: 10}, remoteValidators{LastModified: "Mon, 19 Oct 2026 10:00:00 GMT"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.a.differ(tt.b); got != tt.differ {
+			t.Errorf("%s: differ = %v, want %v", tt.name, got, tt.differ)
+		}
+	}
+
+	if got := (remoteValidators{ETag: `"a"`, LastModified: "Mon"}).ifRange(); got != `"a"` {
+		t.Errorf("If-Range is %s, want the strong ETag", got)
+	}
+	if got := (remoteValidators{ETag: `W/"a"`, LastModified: "Mon"}).ifRange(); got != "Mon" {
+		t.Errorf("If-Range is %s, weak ETags are not allowed there", got)
+	}
+}
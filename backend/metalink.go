@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metalink documents are small, anything bigger is not one
+const maxMetalinkSize = 4 * 1024 * 1024
+
+// metalinkDoc covers both RFC 5854 (.meta4) and the older 3.0 (.metalink)
+// format. Their elements differ, so each file keeps the fields of both.
+type metalinkDoc struct {
+	Files   []metalinkFile `xml:"file"`
+	V3Files []metalinkFile `xml:"files>file"`
+}
+
+type metalinkFile struct {
+	Name string `xml:"name,attr"`
+	Size int64  `xml:"size"`
+
+	Hashes []metalinkHash   `xml:"hash"`
+	Pieces []metalinkPieces `xml:"pieces"`
+	Urls   []metalinkUrl    `xml:"url"`
+
+	//3.0 nests these under verification and resources
+	V3Hashes []metalinkHash   `xml:"verification>hash"`
+	V3Pieces []metalinkPieces `xml:"verification>pieces"`
+	V3Urls   []metalinkUrl    `xml:"resources>url"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPieces struct {
+	Length int64          `xml:"length,attr"`
+	Type   string         `xml:"type,attr"`
+	Hashes []metalinkHash `xml:"hash"`
+}
+
+type metalinkUrl struct {
+	Location   string `xml:"location,attr"`
+	Priority   int    `xml:"priority,attr"`   //4.0, 1 is best
+	Preference int    `xml:"preference,attr"` //3.0, 100 is best
+	Type       string `xml:"type,attr"`
+	Value      string `xml:",chardata"`
+}
+
+func parseMetalink(r io.Reader) ([]metalinkFile, error) {
+	var doc metalinkDoc
+	if err := xml.NewDecoder(io.LimitReader(r, maxMetalinkSize)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid metalink: %w", err)
+	}
+	files := append(doc.Files, doc.V3Files...)
+	if len(files) == 0 {
+		return nil, fmt.Errorf("metalink lists no files")
+	}
+	for i := range files {
+		f := &files[i]
+		f.Hashes = append(f.Hashes, f.V3Hashes...)
+		f.Pieces = append(f.Pieces, f.V3Pieces...)
+		f.Urls = append(f.Urls, f.V3Urls...)
+	}
+	return files, nil
+}
+
+// urls returns the URLs of the file we can download from, best first. Entries without a
+// priority go after the ones that have one.
+func (f *metalinkFile) urls() []string {
+	rank := func(u metalinkUrl) int {
+		if u.Priority > 0 {
+			return u.Priority
+		}
+		if u.Preference > 0 {
+			return 1000 - u.Preference
+		}
+		return 1000
+	}
+
+	candidates := make([]metalinkUrl, 0, len(f.Urls))
+	for _, u := range f.Urls {
+		u.Value = strings.TrimSpace(u.Value)
+		parsed, err := neturl.ParseRequestURI(u.Value)
+		if err != nil || !supportedScheme(parsed) {
+			continue
+		}
+		candidates = append(candidates, u)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return rank(candidates[i]) < rank(candidates[j])
+	})
+
+	urls := make([]string, 0, len(candidates))
+	for _, u := range candidates {
+		urls = append(urls, u.Value)
+	}
+	return urls
+}
+
+// checksum returns the strongest whole-file hash we can verify.
+func (f *metalinkFile) checksum() checksum {
+	for _, algo := range checksumAlgos {
+		for _, h := range f.Hashes {
+			if normalizeAlgo(h.Type) != algo {
+				continue
+			}
+			if c, err := parseChecksum(algo + ":" + h.Value); err == nil {
+				return c
+			}
+		}
+	}
+	return checksum{}
+}
+
+// pieces returns the piece hashes with the strongest algorithm we support,
+// or nil if there are none that fit the file size.
+func (f *metalinkFile) pieces() *pieceHashes {
+	for _, algo := range checksumAlgos {
+		for _, p := range f.Pieces {
+			if normalizeAlgo(p.Type) != algo {
+				continue
+			}
+			ph := &pieceHashes{Length: p.Length, Algo: algo}
+			for _, h := range p.Hashes {
+				ph.Hashes = append(ph.Hashes, strings.ToLower(strings.TrimSpace(h.Value)))
+			}
+			if ph.matches(f.Size) {
+				return ph
+			}
+		}
+	}
+	return nil
+}
+
+// MetalinkHandler creates one task per file of a metalink. The document is
+// sent as the body, as a "file" form upload, or as {"url": ...} to fetch it.
+func (dm *DownloadManager) MetalinkHandler(c *gin.Context) {
+	var body io.Reader
+	switch {
+	case strings.HasPrefix(c.ContentType(), "application/json"):
+		var req ActionRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		parsedUrl, err := neturl.ParseRequestURI(req.Url)
+		if err != nil || !supportedScheme(parsedUrl) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid URL. Only http://, https://, ftp:// and ftps:// are supported."})
+			return
+		}
+		fetch, err := http.NewRequestWithContext(c.Request.Context(), "GET", req.Url, nil)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		res, err := dm.httpClient().Do(fetch)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Metalink fetch failed: " + err.Error()})
+			return
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Metalink fetch failed: " + res.Status})
+			return
+		}
+		body = res.Body
+	case strings.HasPrefix(c.ContentType(), "multipart/form-data"):
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer file.Close()
+		body = file
+	default:
+		body = c.Request.Body
+	}
+
+	files, err := parseMetalink(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var tasks []Task
+	for _, f := range files {
+		urls := f.urls()
+		if len(urls) == 0 {
+			log.Println("Metalink file skipped, no supported URL:", f.Name)
+			continue
+		}
+		name := sanitizeFileName(path.Base(f.Name))
+		if name == "." || name == "/" {
+			name = ""
+		}
+		fileName := name
+		if fileName == "" {
+			fileName = "Pending..."
+		}
+		tasks = append(tasks, Task{
+			ID:        urls[0],
+			Url:       urls[0],
+			FileName:  fileName,
+			Status:    "Downloading",
+			TotalSize: f.Size,
+			Checksum:  f.checksum().String(),
+			Mirrors:   urls[1:],
+			SaveAs:    name,
+			Pieces:    f.pieces(),
+		})
+	}
+	if len(tasks) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Metalink lists no supported URLs"})
+		return
+	}
+
+	//Like single downloads, the files wait while the schedule or the quota holds the queue
+	status := "Downloading"
+	held := dm.heldStatus()
+	if held != "" {
+		status = held
+	}
+
+	dm.dataMutex.Lock()
+	for _, task := range tasks {
+		task.Status = status
+		found := false
+		for i := range dm.Tasks {
+			if dm.Tasks[i].ID == task.ID {
+				dm.Tasks[i].mergeMetalink(task)
+				found = true
+				break
+			}
+		}
+		if !found {
+			dm.Tasks = append(dm.Tasks, task)
+		}
+	}
+	dm.dataMutex.Unlock()
+	dm.SaveTasks()
+
+	ids := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		id := task.ID
+		ids = append(ids, id)
+		if held != "" {
+			SendStatus(id, status)
+			continue
+		}
+		dm.launch(id, func(ctx context.Context) {
+			dm.processDownload(ctx, id, id)
+		})
+	}
+
+	message := "Download started"
+	if held != "" {
+		message = "Download queued until the queue runs again"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": message,
+		"tasks":   ids,
+	})
+}
+
+// mergeMetalink adds what a metalink says about the file of t to it when
+// the same document is posted again. Mirrors are added, and hashes and the
+// name only filled in where t has none, since a running download already
+// goes by them. Its status only changes when it isn't downloading already.
+func (t *Task) mergeMetalink(from Task) {
+	for _, m := range from.Mirrors {
+		if m != t.Url && !slices.Contains(t.Mirrors, m) {
+			t.Mirrors = append(t.Mirrors, m)
+		}
+	}
+	if t.Checksum == "" {
+		t.Checksum = from.Checksum
+	}
+	if t.Pieces == nil {
+		t.Pieces = from.Pieces
+	}
+	if t.SaveAs == "" {
+		t.SaveAs = from.SaveAs
+	}
+	if t.TotalSize == 0 {
+		t.TotalSize = from.TotalSize
+	}
+	if t.Status != "Downloading" {
+		t.Status = from.Status
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metalinkFor lists content under urls, the first one as the best.
+func metalinkFor(content []byte, urls ...string) string {
+	sum := sha256.Sum256(content)
+	var doc strings.Builder
+	fmt.Fprintf(&doc, `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+ <file name="file.bin">
+  <size>%d</size>
+  <hash type="sha-256">%s</hash>
+`, len(content), hex.EncodeToString(sum[:]))
+	for i, u := range urls {
+		fmt.Fprintf(&doc, "  <url priority=\"%d\">%s</url>\n", i+1, u)
+	}
+	doc.WriteString(" </file>\n</metalink>")
+	return doc.String()
+}
+
+// TestMetalinkPrimaryDown imports a metalink whose first URL is gone, the
+// file comes from the mirror instead.
+func TestMetalinkPrimaryDown(t *testing.T) {
+	content := testContent(256 * 1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gone.bin":
+			http.NotFound(w, r)
+		case "/file.meta4":
+			fmt.Fprint(w, metalinkFor(content, "http://"+r.Host+"/gone.bin", "http://"+r.Host+"/file.bin"))
+		default:
+			http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+		}
+	}))
+	defer srv.Close()
+
+	gin.SetMode(gin.TestMode)
+	dm := newTestManager(t)
+	r := gin.New()
+	r.POST("/metalink", dm.MetalinkHandler)
+	req := httptest.NewRequest("POST", "/metalink", strings.NewReader(`{"url":"`+srv.URL+`/file.meta4"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("import gave %d %s", rec.Code, rec.Body)
+	}
+
+	waitForStatus(t, dm, srv.URL+"/gone.bin", "Completed")
+	got, _ := os.ReadFile(filepath.Join("downloads", "file.bin"))
+	if !bytes.Equal(got, content) {
+		t.Error("downloaded file differs from the served one")
+	}
+}
+
+// TestMetalinkRepost posts a metalink again while its file downloads, which
+// adds the new mirror and leaves the rest of the task alone.
+func TestMetalinkRepost(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dm := newTestManager(t)
+	r := gin.New()
+	r.POST("/metalink", dm.MetalinkHandler)
+
+	primary := "https://a.example.com/file.bin"
+	dm.Tasks = []Task{{ID: primary, Url: primary, FileName: "file.bin", Status: "Downloading", TotalSize: 100, Downloaded: 60,
+		Checksum: "sha256:" + strings.Repeat("0", 64), Mirrors: []string{"https://b.example.com/file.bin"}, ETag: `"v1"`}}
+	stop := make(chan struct{})
+	dm.launch(primary, func(ctx context.Context) {
+		<-stop
+	})
+	defer close(stop)
+
+	doc := metalinkFor([]byte("other version"), primary, "https://b.example.com/file.bin", "https://c.example.com/file.bin")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/metalink", strings.NewReader(doc)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("import gave %d %s", rec.Code, rec.Body)
+	}
+
+	dm.dataMutex.Lock()
+	defer dm.dataMutex.Unlock()
+	if len(dm.Tasks) != 1 {
+		t.Fatalf("posting again made %d tasks", len(dm.Tasks))
+	}
+	task := dm.Tasks[0]
+	if !slices.Equal(task.Mirrors, []string{"https://b.example.com/file.bin", "https://c.example.com/file.bin"}) {
+		t.Errorf("mirrors are %v", task.Mirrors)
+	}
+	if task.Status != "Downloading" || task.Downloaded != 60 || task.TotalSize != 100 || task.ETag != `"v1"` || task.Checksum != "sha256:"+strings.Repeat("0", 64) {
+		t.Errorf("running task changed to %+v", task)
+	}
+}
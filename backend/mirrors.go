@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirror is one URL serving the file of a task. The primary URL is always
+// the first mirror of a download.
+type mirror struct {
+	Url     string
+	ifRange string // validators differ between servers, so each mirror has its own
+	// The task's login, headers and method belong to the primary only, the
+	// others get a resolver's headers at most
+	opts   requestOptions
+	method string
+	// A resolver can hand out a fresh URL when this one expires
+	refreshable bool
+
+	bytes    int64
+	busy     int64 // nanoseconds spent with connections open, see begin/end
+	active   int
+	failures int
+}
+
+// mirrorPool spreads the parts of one download over its mirrors by the
+// throughput each of them has shown so far.
+type mirrorPool struct {
+	mirrors []*mirror
+	mu      sync.Mutex
+}
+
+func newMirrorPool(primary string, ifRange string) *mirrorPool {
+	return &mirrorPool{mirrors: []*mirror{{Url: primary, ifRange: ifRange}}}
+}
+
+// probeMirrors adds every mirror that serves a file of the same size, with
+// range support if ranged. Anything else could not be mixed with the
+// primary's parts. A download in one part only needs mirrors to take over
+// from the first byte. header is sent to every mirror, probes included.
+func (mp *mirrorPool) probeMirrors(ctx context.Context, client *http.Client, urls []string, totalSize int64, header http.Header, ranged bool) {
+	var wg sync.WaitGroup
+	for _, u := range urls {
+		if u == mp.mirrors[0].Url {
+			continue
+		}
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, "HEAD", u, nil)
+			if err != nil {
+				log.Println("Invalid mirror URL:", u, err)
+				return
+			}
+			for key, values := range header {
+				req.Header[key] = values
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				log.Println("Mirror unreachable:", u, err)
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode != 200 || (totalSize > 0 && res.ContentLength != totalSize) {
+				log.Printf("Mirror %s skipped: status %d, size %d instead of %d", u, res.StatusCode, res.ContentLength, totalSize)
+				return
+			}
+			if ranged && !strings.EqualFold(res.Header.Get("Accept-Ranges"), "bytes") {
+				log.Println("Mirror skipped, no range support:", u)
+				return
+			}
+			mp.mu.Lock()
+			mp.mirrors = append(mp.mirrors, &mirror{Url: u, ifRange: validatorsFrom(res).ifRange(), opts: requestOptions{header: header}})
+			mp.mu.Unlock()
+		}(u)
+	}
+	wg.Wait()
+	log.Println("Downloading from", len(mp.mirrors), "mirror(s)")
+}
+
+// pick returns the mirror a new connection should go to, skipping the ones
+// this part already gave up on. Mirrors nobody has measured yet go first,
+// after that the one with the best expected speed per extra connection wins.
+func (mp *mirrorPool) pick(exclude map[*mirror]bool) *mirror {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	var best *mirror
+	bestScore := -1.0
+	for _, m := range mp.mirrors {
+		if exclude[m] {
+			continue
+		}
+		var score float64
+		busy := float64(m.busy+int64(m.active)*now) / float64(time.Second)
+		if busy < 1 {
+			score = math.Inf(1)
+		} else {
+			score = float64(m.bytes) / busy / float64(m.active+1)
+		}
+		score /= float64(m.failures + 1)
+		if best == nil || score > bestScore || (score == bestScore && m.active < best.active) {
+			best = m
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// newRequest builds a GET for m with the mirror's headers and login.
+func (mp *mirrorPool) newRequest(ctx context.Context, m *mirror) (*http.Request, error) {
+	mp.mu.Lock()
+	url, opts := m.Url, m.opts
+	mp.mu.Unlock()
+
+	method := m.method
+	if method == "" {
+		method = "GET"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	opts.apply(req)
+	return req, nil
+}
+
+func (mp *mirrorPool) urlOf(m *mirror) string {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return m.Url
+}
+
+func (mp *mirrorPool) ifRangeOf(m *mirror) string {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return m.ifRange
+}
+
+// replace points m at a fresh URL for the same file, after its old one
+// expired.
+func (mp *mirrorPool) replace(m *mirror, url string, opts requestOptions, ifRange string) {
+	mp.mu.Lock()
+	m.Url, m.opts, m.ifRange = url, opts, ifRange
+	mp.mu.Unlock()
+}
+
+func (mp *mirrorPool) begin(m *mirror) {
+	mp.mu.Lock()
+	m.active++
+	m.busy -= time.Now().UnixNano()
+	mp.mu.Unlock()
+}
+
+func (mp *mirrorPool) end(m *mirror) {
+	mp.mu.Lock()
+	m.active--
+	m.busy += time.Now().UnixNano()
+	mp.mu.Unlock()
+}
+
+func (mp *mirrorPool) record(m *mirror, n int) {
+	mp.mu.Lock()
+	m.bytes += int64(n)
+	mp.mu.Unlock()
+}
+
+func (mp *mirrorPool) failed(m *mirror) {
+	mp.mu.Lock()
+	m.failures++
+	mp.mu.Unlock()
+}
+
+func (mp *mirrorPool) isPrimary(m *mirror) bool {
+	return m == mp.mirrors[0]
+}
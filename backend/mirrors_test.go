@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPickPrefersUnmeasuredThenFaster(t *testing.T) {
+	mp := newMirrorPool("https://a.example.com/f", "")
+	slow := &mirror{Url: "https://b.example.com/f", bytes: 1 * mib, busy: int64(4 * time.Second)}
+	fast := &mirror{Url: "https://c.example.com/f", bytes: 8 * mib, busy: int64(4 * time.Second)}
+	mp.mirrors = append(mp.mirrors, slow, fast)
+
+	if m := mp.pick(nil); m != mp.mirrors[0] {
+		t.Errorf("picked %s before the unmeasured primary", m.Url)
+	}
+	if m := mp.pick(map[*mirror]bool{mp.mirrors[0]: true}); m != fast {
+		t.Errorf("picked %s over the faster mirror", m.Url)
+	}
+
+	//Failures count against a mirror until another one looks better
+	fast.failures = 8
+	if m := mp.pick(map[*mirror]bool{mp.mirrors[0]: true}); m != slow {
+		t.Errorf("picked %s after it failed repeatedly", m.Url)
+	}
+	if m := mp.pick(map[*mirror]bool{mp.mirrors[0]: true, slow: true, fast: true}); m != nil {
+		t.Errorf("picked excluded mirror %s", m.Url)
+	}
+}
+
+func TestProbeMirrors(t *testing.T) {
+	content := testContent(64 * 1024)
+	same := serveFile(content)
+	defer same.Close()
+	other := serveFile(content[:1000])
+	defer other.Close()
+	noRange := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content)
+	}))
+	defer noRange.Close()
+
+	urls := []string{same.URL + "/primary", same.URL + "/copy", other.URL, noRange.URL}
+	probe := func(totalSize int64, ranged bool) []string {
+		mp := newMirrorPool(same.URL+"/primary", "")
+		mp.probeMirrors(context.Background(), http.DefaultClient, urls, totalSize, nil, ranged)
+		var found []string
+		for _, m := range mp.mirrors[1:] {
+			found = append(found, m.Url)
+		}
+		slices.Sort(found)
+		return found
+	}
+
+	if got := probe(int64(len(content)), true); !slices.Equal(got, []string{same.URL + "/copy"}) {
+		t.Errorf("mirrors of a split download are %v", got)
+	}
+	//One part only ever starts at the first byte, any server of the file can take it over
+	if got, want := probe(int64(len(content)), false), slices.Sorted(slices.Values([]string{noRange.URL, same.URL + "/copy"})); !slices.Equal(got, want) {
+		t.Errorf("mirrors of a download in one part are %v", got)
+	}
+	if got := probe(-1, false); len(got) != 3 {
+		t.Errorf("mirrors of a file of unknown size are %v", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mp := newMirrorPool(same.URL+"/primary", "")
+	mp.probeMirrors(ctx, http.DefaultClient, urls, int64(len(content)), nil, true)
+	if len(mp.mirrors) != 1 {
+		t.Errorf("probes of a stopped download found %d mirrors", len(mp.mirrors)-1)
+	}
+}
+
+func TestDownloadFailsOverToMirror(t *testing.T) {
+	content := testContent(2 * 1024 * 1024)
+	good := serveFile(content)
+	defer good.Close()
+	//Answers probes like the primary but breaks every transfer
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	dm := newTestManager(t)
+	dm.settings.AutoRetry = false
+	fileUrl := good.URL + "/file.bin"
+	dm.Tasks = []Task{{ID: fileUrl, Url: fileUrl, Status: "Downloading", Mirrors: []string{broken.URL + "/file.bin"}}}
+
+	dm.processDownload(context.Background(), fileUrl, fileUrl)
+
+	if got := dm.Tasks[0].Status; got != "Completed" {
+		t.Fatalf("task is %s", got)
+	}
+	got, err := os.ReadFile(filepath.Join("downloads", "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("downloaded file differs from the served one")
+	}
+}
+
+// TestSingleConnectionFailsOver downloads from a primary without range
+// support, which only ever gets one connection, and breaks halfway.
+func TestSingleConnectionFailsOver(t *testing.T) {
+	content := testContent(512 * 1024)
+	good := serveFile(content)
+	defer good.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		if r.Method == http.MethodGet {
+			w.Write(content[:len(content)/2])
+		}
+	}))
+	defer broken.Close()
+
+	dm := newTestManager(t)
+	dm.settings.AutoRetry = false
+	fileUrl := broken.URL + "/file.bin"
+	dm.Tasks = []Task{{ID: fileUrl, Url: fileUrl, Status: "Downloading", Mirrors: []string{good.URL + "/file.bin"}}}
+
+	dm.processDownload(context.Background(), fileUrl, fileUrl)
+
+	if got := dm.Tasks[0].Status; got != "Completed" {
+		t.Fatalf("task is %s", got)
+	}
+	got, _ := os.ReadFile(filepath.Join("downloads", "file.bin"))
+	if !bytes.Equal(got, content) {
+		t.Error("downloaded file differs from the served one")
+	}
+}
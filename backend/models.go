@@ -7,6 +7,51 @@ type Task struct {
 	Status     string `json:"status"`
 	TotalSize  int64  `json:"totalSize"`
 	Downloaded int64  `json:"downloaded"`
+	// Other URLs serving the same file, parts are spread over these and Url
+	Mirrors []string `json:"mirrors,omitempty"`
+	// Login for Url when it is not part of the URL itself, kept sealed in task-secrets.json and never sent to clients
+	Username string `json:"-"`
+	Password string `json:"-"`
+	// Sent with the HEAD and every request for Url, for sites that want a Referer, a browser User-Agent or a session.
+	// Sealed in task-secrets.json like the login
+	Headers map[string]string `json:"-"`
+	Cookies string            `json:"-"` // as in a Cookie header, "name=value; name2=value2"
+	// Method of the download requests, GET when empty
+	Method string `json:"method,omitempty"`
+
+	// Validators from the first HEAD, used to detect a changed remote file on resume
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+
+	// Expected digest as "algo:hex", checked once the file is assembled
+	Checksum string `json:"checksum,omitempty"`
+	// Look for SHA256SUMS, <file>.sha256 and the like next to the download
+	VerifySidecar bool `json:"verifySidecar,omitempty"`
+	// verified, mismatch or not_found once the file has been checked
+	ChecksumStatus string `json:"checksumStatus,omitempty"`
+
+	// File name to save as instead of the one the server suggests
+	SaveAs string `json:"saveAs,omitempty"`
+	// Per-piece digests from a metalink, checked while the file downloads
+	Pieces *pieceHashes `json:"pieces,omitempty"`
+
+	// Wanted quality of a stream or video ("best", "worst", "720p"), and the one picked
+	Quality string `json:"quality,omitempty"`
+	Variant string `json:"variant,omitempty"`
+	// YouTube format to download, overrides Quality
+	Itag int `json:"itag,omitempty"`
+	// Where a resolver last found the file behind Url
+	Resolved *Resolution `json:"resolved,omitempty"`
+
+	// A playlist or channel, its videos are tasks of their own that point back at it through Group
+	IsGroup bool   `json:"isGroup,omitempty"`
+	Group   string `json:"group,omitempty"`
+	// YouTube ID of the video, used to skip videos that are already downloaded
+	VideoId string `json:"videoId,omitempty"`
+
+	// Cap of this task in bytes/sec, 0 for none, and its weight when tasks split the global limit, 1 when 0
+	SpeedLimit int64 `json:"speedLimit,omitempty"`
+	Weight     int   `json:"weight,omitempty"`
 }
 
 type Settings struct {
@@ -22,8 +67,25 @@ type Settings struct {
 	ForceHttps      bool   `json:"forceHttps"`
 	AutoExtract     bool   `json:"autoExtract"`
 	AutoRetry       bool   `json:"autoRetry"`
-	Scheduler       bool   `json:"scheduler"`
+	Scheduler       bool   `json:"scheduler"` // follow Schedule
 	NotifComplete   bool   `json:"notifComplete"`
 	NotifError      bool   `json:"notifError"`
 	SoundEffects    bool   `json:"soundEffects"`
+	DirectWrite     bool   `json:"directWrite"`
+	ExtensionToken  string `json:"extensionToken"` // shared with the browser extension, made on first start
+	SpeedLimit      int64  `json:"speedLimit"`     // combined cap of all downloads in bytes/sec, 0 for none
+	SpeedBurst      int64  `json:"speedBurst"`     // bytes let through at once under the cap, 0 to pick one
+
+	// Weekly windows that run or hold the queue and set the bandwidth mode
+	Schedule []ScheduleWindow `json:"schedule"`
+
+	// Bytes that may be downloaded per day, week and month, 0 for no quota
+	QuotaDaily   int64 `json:"quotaDaily"`
+	QuotaWeekly  int64 `json:"quotaWeekly"`
+	QuotaMonthly int64 `json:"quotaMonthly"`
+
+	// What auto mode measures the link with: "host" counters, "self" for our own speed and latency, "" for host unless in a container
+	BandwidthSource string   `json:"bandwidthSource"`
+	NetInterfaces   []string `json:"netInterfaces"` // interfaces to count, all physical ones when empty
+	NetDevPath      string   `json:"netDevPath"`    // read the counters from this /proc/net/dev instead, e.g. the host's
 }
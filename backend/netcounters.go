@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	psnet "github.com/shirou/gopsutil/v3/net"
+)
+
+// counterSource reads how many bytes the machine has received on the
+// interfaces the bandwidth is measured on, for auto mode to tell how much
+// of the link other programs use.
+type counterSource interface {
+	Received() (uint64, error)
+}
+
+// virtualPrefixes start the names of loopback, bridge, container and VPN
+// interfaces. Their traffic is either not on the wire or counted again on
+// the interface that carries it.
+var virtualPrefixes = []string{
+	"lo", "docker", "br-", "veth", "virbr", "vmnet", "vboxnet", "cni", "flannel", "cali",
+	"tun", "tap", "wg", "tailscale", "zt", "utun", "awdl", "llw", "vEthernet", "Loopback",
+}
+
+// measured reports whether the interface name counts: one of names if any
+// were given, any that isn't virtual otherwise.
+func measured(name string, names []string) bool {
+	if len(names) > 0 {
+		return slices.Contains(names, name)
+	}
+	for _, prefix := range virtualPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// interfaceCounters reads the counters of the chosen interfaces from the
+// system, all physical ones when none are chosen.
+type interfaceCounters struct {
+	names []string
+}
+
+func (ic interfaceCounters) Received() (uint64, error) {
+	stats, err := psnet.IOCounters(true)
+	if err != nil {
+		return 0, err
+	}
+	var total uint64
+	found := false
+	for _, s := range stats {
+		if measured(s.Name, ic.names) {
+			total += s.BytesRecv
+			found = true
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("no interface to measure among %d", len(stats))
+	}
+	return total, nil
+}
+
+// procNetDev reads the counters from a /proc/net/dev file, such as the
+// host's one mounted into a container.
+type procNetDev struct {
+	path  string
+	names []string
+}
+
+func (pd procNetDev) Received() (uint64, error) {
+	f, err := os.Open(pd.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseNetDev(bufio.NewScanner(f), pd.names)
+}
+
+// parseNetDev sums the received bytes of the measured interfaces in the
+// /proc/net/dev format:
+//
+//	Inter-|   Receive                            |  Transmit
+//	 face |bytes    packets errs drop fifo frame compressed multicast|bytes ...
+//	  eth0: 1843201   1500    0    0    0     0          0         0  ...
+func parseNetDev(scanner *bufio.Scanner, names []string) (uint64, error) {
+	var total uint64
+	found := false
+	for scanner.Scan() {
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		name = strings.TrimSpace(name)
+		if !ok || strings.Contains(name, "|") || !measured(name, names) {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) == 0 {
+			continue
+		}
+		received, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("interface %s: %w", name, err)
+		}
+		total += received
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, errors.New("no interface to measure")
+	}
+	return total, nil
+}
+
+// inContainer reports whether the app runs in a container, where the
+// interfaces it sees say little about the link the host is on.
+func inContainer() bool {
+	for _, marker := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(marker); err == nil {
+			return true
+		}
+	}
+	cgroup, err := os.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return false
+	}
+	for _, runtime := range []string{"docker", "kubepods", "containerd", "lxc", "libpod"} {
+		if strings.Contains(string(cgroup), runtime) {
+			return true
+		}
+	}
+	return false
+}
+
+// newCounterSource picks where auto mode reads the machine's traffic from:
+// source is "self" to go by our own downloads alone, "host" for the system's
+// counters, or "" to use those unless running in a container. A netDevPath
+// or chosen interfaces are trusted even in a container.
+func newCounterSource(source string, interfaces []string, netDevPath string) counterSource {
+	switch {
+	case source == "self":
+		return nil
+	case netDevPath != "":
+		return procNetDev{path: netDevPath, names: interfaces}
+	case source == "host" || len(interfaces) > 0:
+		return interfaceCounters{names: interfaces}
+	case inContainer():
+		log.Println("Running in a container, auto mode goes by the downloads' own speed and latency")
+		return nil
+	default:
+		return interfaceCounters{}
+	}
+}
+
+func validBandwidthSource(source string) bool {
+	switch source {
+	case "", "host", "self":
+		return true
+	}
+	return false
+}
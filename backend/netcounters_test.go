@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCounters is a counterSource that reports what it is told, to drive
+// auto mode in tests.
+type fakeCounters struct {
+	received uint64
+	err      error
+	mu       sync.Mutex
+}
+
+func (fc *fakeCounters) Received() (uint64, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.received, fc.err
+}
+
+// add counts n more bytes received.
+func (fc *fakeCounters) add(n uint64) {
+	fc.mu.Lock()
+	fc.received += n
+	fc.mu.Unlock()
+}
+
+const testNetDev = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:     999      10    0    0    0     0          0         0      999      10    0    0    0     0       0          0
+  eth0:    1000      20    0    0    0     0          0         0      500       5    0    0    0     0       0          0
+ wlan0:    2000      30    0    0    0     0          0         0      700       7    0    0    0     0       0          0
+docker0:   5000      40    0    0    0     0          0         0     5000      40    0    0    0     0       0          0
+vethab12:  7000      50    0    0    0     0          0         0     7000      50    0    0    0     0       0          0
+   wg0:    4000      60    0    0    0     0          0         0     4000      60    0    0    0     0       0          0
+`
+
+func TestParseNetDev(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		want    uint64
+		wantErr bool
+	}{
+		{name: "physical interfaces by default", want: 3000},
+		{name: "chosen interface", names: []string{"eth0"}, want: 1000},
+		{name: "chosen virtual interface", names: []string{"docker0", "lo"}, want: 5999},
+		{name: "chosen interface missing", names: []string{"eth1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseNetDev(bufio.NewScanner(strings.NewReader(testNetDev)), tt.names)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := parseNetDev(bufio.NewScanner(strings.NewReader("  eth0: 12x 0 0\n")), nil); err == nil {
+		t.Error("parsed a malformed counter")
+	}
+}
+
+func TestProcNetDev(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dev")
+	if err := os.WriteFile(path, []byte(testNetDev), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := procNetDev{path: path, names: []string{"wlan0"}}.Received()
+	if err != nil || got != 2000 {
+		t.Errorf("got %d, %v", got, err)
+	}
+	if _, err := (procNetDev{path: path + ".missing"}).Received(); err == nil {
+		t.Error("read a missing file")
+	}
+}
+
+func TestNewCounterSource(t *testing.T) {
+	if src := newCounterSource("self", []string{"eth0"}, "/host/proc/net/dev"); src != nil {
+		t.Errorf("self mode reads %T", src)
+	}
+	if src, ok := newCounterSource("", []string{"eth0"}, "/host/proc/net/dev").(procNetDev); !ok || src.path != "/host/proc/net/dev" || src.names[0] != "eth0" {
+		t.Errorf("netDevPath gives %#v", src)
+	}
+	if src, ok := newCounterSource("host", nil, "").(interfaceCounters); !ok || src.names != nil {
+		t.Errorf("host gives %#v", src)
+	}
+	if src, ok := newCounterSource("", []string{"en0"}, "").(interfaceCounters); !ok || src.names[0] != "en0" {
+		t.Errorf("chosen interfaces give %#v", src)
+	}
+}
+
+func TestSetCounterSourceDropsUnreadable(t *testing.T) {
+	bm := NewBandwidthMonitor()
+	bm.SetCounterSource(&fakeCounters{err: errors.New("permission denied")})
+	if bm.source != nil {
+		t.Error("kept a source that can't be read")
+	}
+	fc := &fakeCounters{}
+	bm.SetCounterSource(fc)
+	if bm.source != fc {
+		t.Error("dropped a readable source")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// A piece that is still corrupt after this many downloads fails the task
+const maxPieceAttempts = 3
+
+// pieceHashes are the digests of fixed size pieces of a file, as listed in
+// a metalink. They let a corrupt range be fetched again on its own.
+type pieceHashes struct {
+	Length int64    `json:"length"`
+	Algo   string   `json:"algo"`
+	Hashes []string `json:"hashes"`
+}
+
+// matches reports whether the pieces describe a file of totalSize bytes.
+func (ph *pieceHashes) matches(totalSize int64) bool {
+	if ph.Length <= 0 || totalSize <= 0 {
+		return false
+	}
+	if (checksum{Algo: ph.Algo}).newHash() == nil {
+		return false
+	}
+	count := (totalSize + ph.Length - 1) / ph.Length
+	return int64(len(ph.Hashes)) == count
+}
+
+// pieceVerifier checks pieces of a direct mode download as soon as they are
+// written and sends the corrupt ones back to the tracker. Writers only queue
+// the pieces they finish, the hashing runs on a goroutine of its own.
+type pieceVerifier struct {
+	pieces    *pieceHashes
+	tracker   *segmentTracker
+	out       *os.File
+	progress  *int64
+	totalSize int64
+
+	wake    chan struct{} // pokes the verifying goroutine, holds at most one poke
+	quit    chan struct{}
+	stopped chan struct{}
+
+	mu       sync.Mutex
+	idle     *sync.Cond   // broadcast when nothing is queued or being hashed
+	pending  map[int]bool // pieces queued for a check
+	busy     bool         // a piece is being hashed
+	verified []bool
+	attempts []int
+	err      error
+}
+
+func newPieceVerifier(pieces *pieceHashes, tracker *segmentTracker, out *os.File, progress *int64, totalSize int64) *pieceVerifier {
+	pv := &pieceVerifier{
+		pieces:    pieces,
+		tracker:   tracker,
+		out:       out,
+		progress:  progress,
+		totalSize: totalSize,
+		wake:      make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		pending:   make(map[int]bool),
+		verified:  make([]bool, len(pieces.Hashes)),
+		attempts:  make([]int, len(pieces.Hashes)),
+	}
+	pv.idle = sync.NewCond(&pv.mu)
+	go pv.run()
+	return pv
+}
+
+func (pv *pieceVerifier) pieceRange(i int) (int64, int64) {
+	start := int64(i) * pv.pieces.Length
+	end := min(start+pv.pieces.Length, pv.totalSize) - 1
+	return start, end
+}
+
+// queueLocked marks piece i for a check unless it is settled already. The
+// caller holds pv.mu.
+func (pv *pieceVerifier) queueLocked(i int) {
+	if !pv.verified[i] && pv.attempts[i] < maxPieceAttempts {
+		pv.pending[i] = true
+	}
+}
+
+func (pv *pieceVerifier) poke() {
+	select {
+	case pv.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wrote is called after n bytes were written at offset and queues the
+// pieces whose last byte the write reached.
+func (pv *pieceVerifier) wrote(offset int64, n int) {
+	if pv == nil || n == 0 {
+		return
+	}
+	end := offset + int64(n)
+	queued := false
+	pv.mu.Lock()
+	for i := int(offset / pv.pieces.Length); i < len(pv.verified) && int64(i)*pv.pieces.Length < end; i++ {
+		if _, pieceEnd := pv.pieceRange(i); pieceEnd < end {
+			pv.queueLocked(i)
+			queued = true
+		}
+	}
+	pv.mu.Unlock()
+	if queued {
+		pv.poke()
+	}
+}
+
+// check queues every piece not verified yet, for pieces whose last byte
+// was written before their first, and for what an earlier run wrote.
+func (pv *pieceVerifier) check() {
+	if pv == nil {
+		return
+	}
+	pv.mu.Lock()
+	for i := range pv.verified {
+		pv.queueLocked(i)
+	}
+	pv.mu.Unlock()
+	pv.poke()
+}
+
+func (pv *pieceVerifier) run() {
+	defer close(pv.stopped)
+	for {
+		select {
+		case <-pv.wake:
+			pv.verifyPending()
+		case <-pv.quit:
+			pv.verifyPending()
+			return
+		}
+	}
+}
+
+// verifyPending checks the queued pieces until none are left.
+func (pv *pieceVerifier) verifyPending() {
+	for {
+		pv.mu.Lock()
+		i, ok := -1, false
+		for i = range pv.pending {
+			ok = true
+			break
+		}
+		if !ok {
+			pv.busy = false
+			pv.idle.Broadcast()
+			pv.mu.Unlock()
+			return
+		}
+		delete(pv.pending, i)
+		pv.busy = true
+		pv.mu.Unlock()
+
+		pv.verify(i)
+	}
+}
+
+// verify hashes piece i if it is fully written, and sends it back to the
+// tracker if it doesn't match.
+func (pv *pieceVerifier) verify(i int) {
+	start, end := pv.pieceRange(i)
+	if !pv.tracker.covered(start, end) {
+		return
+	}
+	ok, err := pv.hashMatches(i, start, end)
+	if err != nil {
+		log.Printf("Piece %d could not be read: %v", i, err)
+		return
+	}
+
+	pv.mu.Lock()
+	defer pv.mu.Unlock()
+	if ok {
+		pv.verified[i] = true
+		return
+	}
+	pv.attempts[i]++
+	if pv.attempts[i] >= maxPieceAttempts {
+		pv.err = fmt.Errorf("piece %d is still corrupt after %d downloads", i, pv.attempts[i])
+		log.Println("Piece verification:", pv.err)
+		return
+	}
+	log.Printf("Piece %d failed verification, fetching bytes %d-%d again", i, start, end)
+	dropped := pv.tracker.refetch(start, end)
+	atomic.AddInt64(pv.progress, -dropped)
+}
+
+// wait blocks until the queued pieces are checked, any range found corrupt
+// is back with the tracker then.
+func (pv *pieceVerifier) wait() {
+	if pv == nil {
+		return
+	}
+	pv.mu.Lock()
+	for len(pv.pending) > 0 || pv.busy {
+		pv.idle.Wait()
+	}
+	pv.mu.Unlock()
+}
+
+// stop checks what is still queued and ends the verifying goroutine.
+func (pv *pieceVerifier) stop() {
+	if pv == nil {
+		return
+	}
+	close(pv.quit)
+	<-pv.stopped
+}
+
+// nextPart is tracker.next, except that when nothing is left it waits for
+// the pieces being checked first, as they may send ranges back.
+func nextPart(tracker *segmentTracker, verifier *pieceVerifier) *Part {
+	if p := tracker.next(); p != nil || verifier == nil {
+		return p
+	}
+	verifier.wait()
+	return tracker.next()
+}
+
+func (pv *pieceVerifier) hashMatches(i int, start int64, end int64) (bool, error) {
+	buf := make([]byte, end-start+1)
+	if _, err := pv.out.ReadAt(buf, start); err != nil {
+		return false, err
+	}
+	h := (checksum{Algo: pv.pieces.Algo}).newHash()
+	h.Write(buf)
+	return hex.EncodeToString(h.Sum(nil)) == pv.pieces.Hashes[i], nil
+}
+
+// result returns nil once every piece has been verified.
+func (pv *pieceVerifier) result() error {
+	if pv == nil {
+		return nil
+	}
+	pv.wait()
+	pv.mu.Lock()
+	defer pv.mu.Unlock()
+	if pv.err != nil {
+		return pv.err
+	}
+	for i, ok := range pv.verified {
+		if !ok {
+			return fmt.Errorf("piece %d was never verified", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCorruptPieceIsRefetched serves one range with a flipped byte and
+// expects only the piece around it to be downloaded again.
+func TestCorruptPieceIsRefetched(t *testing.T) {
+	const pieceLength = 256 * 1024
+	content := make([]byte, 4*1024*1024+1000)
+	for i := range content {
+		content[i] = byte(i * 7 / 3)
+	}
+	pieces := &pieceHashes{Length: pieceLength, Algo: "sha256"}
+	for start := 0; start < len(content); start += pieceLength {
+		sum := sha256.Sum256(content[start:min(start+pieceLength, len(content))])
+		pieces.Hashes = append(pieces.Hashes, hex.EncodeToString(sum[:]))
+	}
+
+	const corruptAt = 5*pieceLength + 10
+	corrupt := bytes.Clone(content)
+	corrupt[corruptAt] ^= 0xff
+	var corruptServed, refetched atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		body := content
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil && start <= corruptAt && corruptAt <= end {
+			if corruptServed.Add(1) == 1 {
+				body = corrupt
+			} else {
+				refetched.Add(1)
+			}
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(body))
+	}))
+	defer srv.Close()
+
+	dm := newTestManager(t)
+	fileUrl := srv.URL + "/file.bin"
+	dm.Tasks = []Task{{ID: fileUrl, Url: fileUrl, Status: "Downloading", Pieces: pieces}}
+	dm.processDownload(context.Background(), fileUrl, fileUrl)
+
+	if got := dm.Tasks[0].Status; got != "Completed" {
+		t.Fatalf("task ended %s", got)
+	}
+	if refetched.Load() == 0 {
+		t.Error("the corrupt piece was never requested again")
+	}
+	got, err := os.ReadFile(filepath.Join("downloads", "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("downloaded file differs from the one served")
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	neturl "net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+// channelIdRegex finds the channel ID in the page of a handle or custom
+// channel URL.
+var channelIdRegex = regexp.MustCompile(`"(?:externalId|channelId)":"(UC[A-Za-z0-9_-]{22})"`)
+
+// isYoutubeGroup reports whether u is a playlist or channel rather than a
+// single video.
+func isYoutubeGroup(u *neturl.URL) bool {
+	switch strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.") {
+	case "youtube.com", "m.youtube.com", "music.youtube.com":
+	default:
+		return false
+	}
+	switch {
+	case u.Path == "/playlist":
+		return u.Query().Get("list") != ""
+	case strings.HasPrefix(u.Path, "/channel/"), strings.HasPrefix(u.Path, "/@"),
+		strings.HasPrefix(u.Path, "/c/"), strings.HasPrefix(u.Path, "/user/"):
+		return true
+	}
+	return false
+}
+
+// youtubeVideoId returns the ID of the video a task downloads, or "" if it
+// isn't a YouTube video.
+func youtubeVideoId(t *Task) string {
+	if t.VideoId != "" || t.IsGroup {
+		return t.VideoId
+	}
+	if strings.Contains(t.Url, "youtu") {
+		if id, err := youtube.ExtractVideoID(t.Url); err == nil {
+			return id
+		}
+	}
+	return ""
+}
+
+// youtubePlaylistUrl returns the playlist to expand for a playlist or
+// channel URL. A channel maps to its uploads playlist, whose ID is the
+// channel ID with UU in place of UC.
+func (dm *DownloadManager) youtubePlaylistUrl(ctx context.Context, groupUrl string) (string, error) {
+	u, err := neturl.Parse(groupUrl)
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "/playlist" {
+		return groupUrl, nil
+	}
+
+	var channelId string
+	if rest, ok := strings.CutPrefix(u.Path, "/channel/"); ok {
+		channelId, _, _ = strings.Cut(rest, "/")
+	} else {
+		//Handles and custom URLs only give the ID away in the channel page
+		page, err := fetchRange(ctx, dm.httpClient(), groupUrl, 0, 0, requestOptions{}, nil)
+		if err != nil {
+			return "", err
+		}
+		if m := channelIdRegex.FindSubmatch(page); m != nil {
+			channelId = string(m[1])
+		}
+	}
+	if !strings.HasPrefix(channelId, "UC") {
+		return "", fmt.Errorf("no channel ID found for %s", groupUrl)
+	}
+	return "https://www.youtube.com/playlist?list=UU" + channelId[2:], nil
+}
+
+// groupMembers returns the IDs of the videos expanded from groupId.
+func (dm *DownloadManager) groupMembers(groupId string) []string {
+	dm.dataMutex.Lock()
+	defer dm.dataMutex.Unlock()
+	var ids []string
+	for i := range dm.Tasks {
+		if dm.Tasks[i].Group == groupId {
+			ids = append(ids, dm.Tasks[i].ID)
+		}
+	}
+	return ids
+}
+
+// downloadYoutubeGroup expands a playlist or channel into one task per
+// video and downloads those that aren't finished yet. Running it again
+// only adds the videos that were published since.
+func (dm *DownloadManager) downloadYoutubeGroup(ctx context.Context, groupId string) {
+	log.Println("Expanding youtube playlist:", groupId)
+
+	playlistUrl, err := dm.youtubePlaylistUrl(ctx, groupId)
+	var playlist *youtube.Playlist
+	if err == nil {
+		playlist, err = dm.youtube.GetPlaylistContext(ctx, playlistUrl)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("Error getting playlist:", err)
+		dm.setTaskError(groupId, "Youtube: "+err.Error())
+		SendError(groupId, "Failed to read playlist")
+		return
+	}
+
+	added := dm.expandYoutubeGroup(groupId, playlist)
+	log.Printf("Playlist %q: %d of %d videos are new\n", playlist.Title, added, len(playlist.Videos))
+
+	dm.runYoutubeGroup(ctx, groupId)
+}
+
+// expandYoutubeGroup adds a queued task for every video of playlist that no
+// task downloads yet and returns how many it added.
+func (dm *DownloadManager) expandYoutubeGroup(groupId string, playlist *youtube.Playlist) int {
+	dm.dataMutex.Lock()
+	known := make(map[string]bool)
+	var quality string
+	var itag int
+	for i := range dm.Tasks {
+		t := &dm.Tasks[i]
+		if t.ID == groupId {
+			t.IsGroup = true
+			if playlist.Title != "" {
+				t.FileName = sanitizeFileName(playlist.Title)
+			}
+			quality, itag = t.Quality, t.Itag
+		} else if id := youtubeVideoId(t); id != "" {
+			known[id] = true
+		}
+	}
+
+	added := 0
+	for _, entry := range playlist.Videos {
+		if entry.ID == "" || known[entry.ID] {
+			continue
+		}
+		known[entry.ID] = true
+
+		fileName := sanitizeFileName(entry.Title)
+		if entry.Title == "" {
+			fileName = "Pending..."
+		}
+		videoUrl := "https://www.youtube.com/watch?v=" + entry.ID
+		dm.Tasks = append(dm.Tasks, Task{
+			ID:       videoUrl,
+			Url:      videoUrl,
+			FileName: fileName,
+			Status:   "Queued",
+			Group:    groupId,
+			VideoId:  entry.ID,
+			Quality:  quality,
+			Itag:     itag,
+		})
+		added++
+	}
+
+	members := 0
+	for i := range dm.Tasks {
+		if dm.Tasks[i].Group == groupId {
+			members++
+		}
+	}
+	for i := range dm.Tasks {
+		if dm.Tasks[i].ID == groupId {
+			dm.Tasks[i].Variant = fmt.Sprintf("%d videos", members)
+			break
+		}
+	}
+	dm.dataMutex.Unlock()
+	dm.SaveTasks()
+	return added
+}
+
+// runYoutubeGroup downloads the unfinished videos of a group, at most
+// MaxConcurrent at a time so a long playlist doesn't look up every video at
+// once, and sets the group's status from theirs when all are done.
+func (dm *DownloadManager) runYoutubeGroup(ctx context.Context, groupId string) {
+	var pending []string
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].Group == groupId && dm.Tasks[i].Status != "Completed" {
+			pending = append(pending, dm.Tasks[i].ID)
+		}
+	}
+	dm.dataMutex.Unlock()
+
+	slots := make(chan struct{}, max(dm.config.MaxConcurrent, 1))
+	var wg sync.WaitGroup
+	var held string
+	for _, id := range pending {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		//Like a single download, no video starts while the schedule or the quota holds the queue, unless forced
+		if ctx.Value(forcedKey{}) == nil {
+			if held = dm.heldStatus(); held != "" {
+				<-slots
+				break
+			}
+		}
+
+		wg.Add(1)
+		started := dm.launch(id, func(videoCtx context.Context) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			dm.setTaskStatus(id, "Downloading")
+			if u, err := neturl.Parse(id); err == nil {
+				dm.download(videoCtx, id, u)
+			}
+		})
+		if !started {
+			<-slots
+			wg.Done()
+		}
+	}
+	wg.Wait()
+
+	//Paused or deleted, the handler has already dealt with the status
+	if ctx.Err() != nil {
+		return
+	}
+	dm.managerMutex.Lock()
+	delete(dm.downloadManager, groupId)
+	dm.managerMutex.Unlock()
+
+	//The queue starts the playlist again once it runs, with the videos still left
+	if held != "" {
+		dm.setTaskStatus(groupId, held)
+		return
+	}
+
+	var failed, unfinished int
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].Group != groupId {
+			continue
+		}
+		switch dm.Tasks[i].Status {
+		case "Completed":
+		case "Error":
+			failed++
+		default:
+			unfinished++
+		}
+	}
+	dm.dataMutex.Unlock()
+
+	switch {
+	case failed > 0:
+		dm.setTaskStatus(groupId, "Error")
+		SendError(groupId, fmt.Sprintf("%d videos failed", failed))
+	case unfinished > 0:
+		dm.setTaskStatus(groupId, "Paused")
+	default:
+		dm.setTaskStatus(groupId, "Completed")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	neturl "net/url"
+	"testing"
+
+	"github.com/kkdai/youtube/v2"
+)
+
+func TestIsYoutubeGroup(t *testing.T) {
+	tests := map[string]bool{
+		"https://www.youtube.com/playlist?list=PL123":           true,
+		"https://www.youtube.com/playlist":                      false,
+		"https://youtube.com/channel/UCabcdefghijklmnopqrstuv":  true,
+		"https://www.youtube.com/@somebody":                     true,
+		"https://m.youtube.com/c/Custom":                        true,
+		"https://music.youtube.com/user/old":                    true,
+		"https://www.youtube.com/watch?v=dQw4w9WgXcQ&list=PL12": false,
+		"https://youtu.be/dQw4w9WgXcQ":                          false,
+		"https://example.com/playlist?list=PL123":               false,
+	}
+	for raw, want := range tests {
+		u, _ := neturl.Parse(raw)
+		if got := isYoutubeGroup(u); got != want {
+			t.Errorf("isYoutubeGroup(%s) = %v, want %v", raw, got, want)
+		}
+	}
+}
+
+func TestYoutubePlaylistUrl(t *testing.T) {
+	dm := newTestManager(t)
+	tests := map[string]string{
+		"https://www.youtube.com/playlist?list=PL123":                  "https://www.youtube.com/playlist?list=PL123",
+		"https://www.youtube.com/channel/UCabcdefghijklmnopqrstuv":     "https://www.youtube.com/playlist?list=UUabcdefghijklmnopqrstuv",
+		"https://www.youtube.com/channel/UCabcdefghijklmnopqrstuv/vid": "https://www.youtube.com/playlist?list=UUabcdefghijklmnopqrstuv",
+	}
+	for groupUrl, want := range tests {
+		got, err := dm.youtubePlaylistUrl(context.Background(), groupUrl)
+		if err != nil || got != want {
+			t.Errorf("youtubePlaylistUrl(%s) = %s, %v, want %s", groupUrl, got, err, want)
+		}
+	}
+
+	page := []byte(`<script>var ytInitialData = {"metadata":{"channelMetadataRenderer":{"externalId":"UCabcdefghijklmnopqrstuv"}}}</script>`)
+	if m := channelIdRegex.FindSubmatch(page); m == nil || string(m[1]) != "UCabcdefghijklmnopqrstuv" {
+		t.Errorf("channel ID not found in page, got %q", m)
+	}
+}
+
+func TestExpandYoutubeGroupOnlyAddsNewVideos(t *testing.T) {
+	dm := newTestManager(t)
+	groupId := "https://www.youtube.com/playlist?list=PL123"
+	dm.Tasks = []Task{
+		{ID: groupId, Url: groupId, Status: "Downloading", Quality: "best <=720p"},
+		//Downloaded on its own before the playlist was added
+		{ID: "https://youtu.be/aaaaaaaaaaa", Url: "https://youtu.be/aaaaaaaaaaa", Status: "Completed"},
+	}
+	playlist := &youtube.Playlist{Title: "Talks: 2026", Videos: []*youtube.PlaylistEntry{
+		{ID: "aaaaaaaaaaa", Title: "First"},
+		{ID: "bbbbbbbbbbb", Title: "Second"},
+		{ID: "ccccccccccc"},
+		{ID: "bbbbbbbbbbb", Title: "Second again"},
+	}}
+
+	if added := dm.expandYoutubeGroup(groupId, playlist); added != 2 {
+		t.Errorf("added %d videos, want 2", added)
+	}
+	members := dm.groupMembers(groupId)
+	if len(members) != 2 || members[0] != "https://www.youtube.com/watch?v=bbbbbbbbbbb" || members[1] != "https://www.youtube.com/watch?v=ccccccccccc" {
+		t.Fatalf("members are %v", members)
+	}
+	group, second, third := dm.Tasks[0], dm.Tasks[2], dm.Tasks[3]
+	if !group.IsGroup || group.Variant != "2 videos" || group.FileName != sanitizeFileName("Talks: 2026") {
+		t.Errorf("group is %+v", group)
+	}
+	if second.Status != "Queued" || second.Quality != "best <=720p" || second.VideoId != "bbbbbbbbbbb" || second.FileName != "Second" {
+		t.Errorf("second video is %+v", second)
+	}
+	if third.FileName != "Pending..." {
+		t.Errorf("untitled video is named %q", third.FileName)
+	}
+
+	//Expanding it again only picks up the new upload
+	playlist.Videos = append(playlist.Videos, &youtube.PlaylistEntry{ID: "ddddddddddd", Title: "Fourth"})
+	if added := dm.expandYoutubeGroup(groupId, playlist); added != 1 {
+		t.Errorf("second expansion added %d videos, want 1", added)
+	}
+	if got := dm.Tasks[0].Variant; got != "3 videos" {
+		t.Errorf("group shows %q", got)
+	}
+}
+
+// TestYoutubeGroupWaitsForQuota keeps the videos of a playlist from starting
+// once the quota is used up, and leaves the playlist to the queue.
+func TestYoutubeGroupWaitsForQuota(t *testing.T) {
+	dm := newTestManager(t)
+	groupId := "https://www.youtube.com/playlist?list=PL123"
+	dm.Tasks = []Task{
+		{ID: groupId, Url: groupId, Status: "Downloading", IsGroup: true},
+		{ID: "https://www.youtube.com/watch?v=bbbbbbbbbbb", Url: "https://www.youtube.com/watch?v=bbbbbbbbbbb", Status: "Queued", Group: groupId},
+		{ID: "https://www.youtube.com/watch?v=ccccccccccc", Url: "https://www.youtube.com/watch?v=ccccccccccc", Status: "Queued", Group: groupId},
+	}
+	dm.quota.setLimits(100, 0, 0)
+	dm.quota.add(100)
+
+	dm.runYoutubeGroup(context.Background(), groupId)
+
+	dm.dataMutex.Lock()
+	defer dm.dataMutex.Unlock()
+	if got := dm.Tasks[0].Status; got != "Quota" {
+		t.Errorf("playlist is %s", got)
+	}
+	for _, video := range dm.Tasks[1:] {
+		if video.Status != "Queued" {
+			t.Errorf("%s is %s while the quota is used up", video.ID, video.Status)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// quotaPeriods are the periods a quota can be set for, in the order they
+// are checked.
+var quotaPeriods = []string{"daily", "weekly", "monthly"}
+
+// periodKey names the day, ISO week or month t falls in, in local time.
+func periodKey(period string, t time.Time) string {
+	switch period {
+	case "daily":
+		return t.Format("2006-01-02")
+	case "weekly":
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	default:
+		return t.Format("2006-01")
+	}
+}
+
+// periodEnd returns when the period t falls in rolls over.
+func periodEnd(period string, t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch period {
+	case "daily":
+		return day.AddDate(0, 0, 1)
+	case "weekly":
+		//Weeks start on Monday
+		return day.AddDate(0, 0, 7-(int(t.Weekday())+6)%7)
+	default:
+		return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// periodUsage is what was downloaded in one period.
+type periodUsage struct {
+	Period string `json:"period"` // e.g. "2026-10-18", "2026-W42" or "2026-10"
+	Bytes  int64  `json:"bytes"`
+}
+
+// quotaTracker counts the bytes downloaded per day, week and month, saves
+// the counts so a restart doesn't reset them, and reports when one goes
+// over its quota and when the period rolls over.
+type quotaTracker struct {
+	usage    map[string]periodUsage // by period name
+	limits   map[string]int64       // bytes, 0 for no quota
+	reached  string                 // the period over its quota, "" when none is
+	dirty    bool
+	fileName string
+	now      func() time.Time // the clock, time.Now outside of tests
+
+	// Called without the lock held, on a goroutine of their own
+	onReached func(period string, used int64, limit int64)
+	onReset   func()
+
+	mu     sync.Mutex
+	stopCh chan struct{}
+}
+
+func newQuotaTracker(fileName string) *quotaTracker {
+	return &quotaTracker{
+		usage:    make(map[string]periodUsage),
+		limits:   make(map[string]int64),
+		fileName: fileName,
+		now:      time.Now,
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// rollLocked starts new counts for periods that have passed. The caller
+// holds qt.mu.
+func (qt *quotaTracker) rollLocked(now time.Time) {
+	for _, period := range quotaPeriods {
+		key := periodKey(period, now)
+		if qt.usage[period].Period != key {
+			qt.usage[period] = periodUsage{Period: key}
+			qt.dirty = true
+		}
+	}
+}
+
+// overLocked returns the first period whose count is at its quota, or "".
+// The caller holds qt.mu.
+func (qt *quotaTracker) overLocked() string {
+	for _, period := range quotaPeriods {
+		if limit := qt.limits[period]; limit > 0 && qt.usage[period].Bytes >= limit {
+			return period
+		}
+	}
+	return ""
+}
+
+// checkLocked notes the quota being reached or freed again and returns the
+// callback to run for it, if any. The caller holds qt.mu.
+func (qt *quotaTracker) checkLocked() func() {
+	over := qt.overLocked()
+	switch {
+	case over != "" && qt.reached == "":
+		qt.reached = over
+		used, limit := qt.usage[over].Bytes, qt.limits[over]
+		if qt.onReached != nil {
+			return func() { qt.onReached(over, used, limit) }
+		}
+	case over == "" && qt.reached != "":
+		qt.reached = ""
+		if qt.onReset != nil {
+			return qt.onReset
+		}
+	default:
+		qt.reached = over
+	}
+	return nil
+}
+
+// add counts n more bytes downloaded.
+func (qt *quotaTracker) add(n int) {
+	qt.mu.Lock()
+	qt.rollLocked(qt.now())
+	for _, period := range quotaPeriods {
+		u := qt.usage[period]
+		u.Bytes += int64(n)
+		qt.usage[period] = u
+	}
+	qt.dirty = true
+	callback := qt.checkLocked()
+	qt.mu.Unlock()
+	if callback != nil {
+		go callback()
+	}
+}
+
+// exceeded returns the period whose quota is used up, or "".
+func (qt *quotaTracker) exceeded() string {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	return qt.reached
+}
+
+// setLimits sets the quotas in bytes, 0 for none. Raising one that was
+// reached lets downloads go on.
+func (qt *quotaTracker) setLimits(daily int64, weekly int64, monthly int64) {
+	qt.mu.Lock()
+	qt.limits["daily"], qt.limits["weekly"], qt.limits["monthly"] = max(daily, 0), max(weekly, 0), max(monthly, 0)
+	qt.rollLocked(qt.now())
+	callback := qt.checkLocked()
+	qt.mu.Unlock()
+	if callback != nil {
+		go callback()
+	}
+}
+
+// tick rolls the periods over, which may free a quota, and saves the counts.
+func (qt *quotaTracker) tick() {
+	qt.mu.Lock()
+	qt.rollLocked(qt.now())
+	callback := qt.checkLocked()
+	qt.saveLocked()
+	qt.mu.Unlock()
+	if callback != nil {
+		go callback()
+	}
+}
+
+// Start checks for the periods rolling over and saves the counts every 10
+// seconds.
+func (qt *quotaTracker) Start() {
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-qt.stopCh:
+				return
+			case <-ticker.C:
+				qt.tick()
+			}
+		}
+	}()
+}
+
+// Stop stops the ticker and saves the counts.
+func (qt *quotaTracker) Stop() {
+	close(qt.stopCh)
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	qt.saveLocked()
+}
+
+// saveLocked writes the counts if they changed. The caller holds qt.mu.
+func (qt *quotaTracker) saveLocked() {
+	if !qt.dirty {
+		return
+	}
+	bytes, err := json.MarshalIndent(qt.usage, "", " ")
+	if err != nil {
+		log.Println("Error marshalling usage:", err)
+		return
+	}
+	if err := writeFileAtomic(qt.fileName, bytes, 0644); err != nil {
+		log.Println("Error saving usage:", err)
+		return
+	}
+	qt.dirty = false
+}
+
+func (qt *quotaTracker) load() {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+
+	bytes, err := os.ReadFile(qt.fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Error reading usage:", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(bytes, &qt.usage); err != nil {
+		log.Println("Error parsing", qt.fileName, err)
+		return
+	}
+	//Counts of periods that passed while the app was closed start over
+	qt.rollLocked(qt.now())
+	qt.reached = qt.overLocked()
+}
+
+// status describes each period's use and quota for clients. A period that
+// rolled over since the last tick frees its quota here as it would there.
+func (qt *quotaTracker) status() gin.H {
+	qt.mu.Lock()
+	now := qt.now()
+	qt.rollLocked(now)
+	callback := qt.checkLocked()
+	periods := gin.H{}
+	for _, period := range quotaPeriods {
+		periods[period] = gin.H{
+			"period":   qt.usage[period].Period,
+			"used":     qt.usage[period].Bytes,
+			"limit":    qt.limits[period],
+			"resetsAt": periodEnd(period, now),
+		}
+	}
+	status := gin.H{"exceeded": qt.reached, "periods": periods}
+	qt.mu.Unlock()
+	if callback != nil {
+		go callback()
+	}
+	return status
+}
+
+// quotaReached holds the queue until the period rolls over.
+func (dm *DownloadManager) quotaReached(period string, used int64, limit int64) {
+	log.Printf("%s data quota reached, %d of %d bytes used. Pausing downloads\n", period, used, limit)
+	dm.holdQueue("Quota")
+	broadcast(gin.H{
+		"event":    "quota",
+		"exceeded": period,
+		"used":     used,
+		"limit":    limit,
+		"resetsAt": periodEnd(period, dm.quota.now()),
+	})
+}
+
+// quotaReset resumes the downloads the quota held.
+func (dm *DownloadManager) quotaReset() {
+	log.Println("Data quota available again, resuming downloads")
+	broadcast(gin.H{
+		"event":    "quota",
+		"exceeded": "",
+	})
+	dm.runQueue("Quota")
+}
+
+// QuotaHandler reports the data used this day, week and month against the
+// quotas.
+func (dm *DownloadManager) QuotaHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, dm.quota.status())
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPeriodKeyAndEnd(t *testing.T) {
+	tests := []struct {
+		period  string
+		t       time.Time
+		wantKey string
+		wantEnd time.Time
+	}{
+		{"daily", at(time.Sunday, "23:59"), "2026-10-18", at(time.Monday, "00:00")},
+		{"daily", at(time.Monday, "00:00"), "2026-10-19", at(time.Tuesday, "00:00")},
+		{"weekly", at(time.Sunday, "23:59"), "2026-W42", at(time.Monday, "00:00")},
+		{"weekly", at(time.Monday, "00:00"), "2026-W43", at(time.Monday, "00:00").AddDate(0, 0, 7)},
+		{"weekly", at(time.Wednesday, "12:00"), "2026-W43", at(time.Monday, "00:00").AddDate(0, 0, 7)},
+		{"weekly", time.Date(2027, 1, 1, 12, 0, 0, 0, time.Local), "2026-W53", time.Date(2027, 1, 4, 0, 0, 0, 0, time.Local)},
+		{"monthly", at(time.Sunday, "12:00"), "2026-10", time.Date(2026, 11, 1, 0, 0, 0, 0, time.Local)},
+		{"monthly", time.Date(2026, 12, 31, 23, 59, 0, 0, time.Local), "2026-12", time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		if got := periodKey(tt.period, tt.t); got != tt.wantKey {
+			t.Errorf("periodKey(%s, %s) = %s, want %s", tt.period, tt.t.Format(time.DateTime), got, tt.wantKey)
+		}
+		if got := periodEnd(tt.period, tt.t); !got.Equal(tt.wantEnd) {
+			t.Errorf("periodEnd(%s, %s) = %s, want %s", tt.period, tt.t.Format(time.DateTime), got.Format(time.DateTime), tt.wantEnd.Format(time.DateTime))
+		}
+	}
+}
+
+// testClock only moves when a test sets it. Callbacks read it from other
+// goroutines.
+type testClock struct {
+	t  time.Time
+	mu sync.Mutex
+}
+
+func (c *testClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) set(t time.Time) {
+	c.mu.Lock()
+	c.t = t
+	c.mu.Unlock()
+}
+
+// newTestQuota returns a tracker saving to a temporary file on clock, with
+// its callbacks going to channels.
+func newTestQuota(t *testing.T, clock *testClock) (*quotaTracker, chan string, chan struct{}) {
+	qt := newQuotaTracker(filepath.Join(t.TempDir(), "usage.json"))
+	qt.now = clock.now
+	reached, reset := make(chan string, 1), make(chan struct{}, 1)
+	qt.onReached = func(period string, used int64, limit int64) { reached <- period }
+	qt.onReset = func() { reset <- struct{}{} }
+	return qt, reached, reset
+}
+
+func waitFor[T any](t *testing.T, ch chan T, what string) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("no", what)
+		panic("unreachable")
+	}
+}
+
+func TestQuotaRollover(t *testing.T) {
+	clock := &testClock{t: at(time.Wednesday, "12:00")}
+	qt, reached, reset := newTestQuota(t, clock)
+	qt.setLimits(100, 250, 0)
+
+	qt.add(60)
+	qt.add(50)
+	if got := waitFor(t, reached, "quota reached"); got != "daily" {
+		t.Errorf("reached the %s quota, want daily", got)
+	}
+	if got := qt.exceeded(); got != "daily" {
+		t.Errorf("exceeded() = %q", got)
+	}
+
+	//The next day frees it, seen by the status before any tick
+	clock.set(at(time.Thursday, "00:00"))
+	status := qt.status()
+	waitFor(t, reset, "reset on the next day")
+	if status["exceeded"] != "" {
+		t.Errorf("status still exceeded %v", status["exceeded"])
+	}
+	periods := status["periods"].(gin.H)
+	if used := periods["daily"].(gin.H)["used"]; used != int64(0) {
+		t.Errorf("daily count is %v on a new day", used)
+	}
+	if used := periods["weekly"].(gin.H)["used"]; used != int64(110) {
+		t.Errorf("weekly count is %v, the week has not passed", used)
+	}
+
+	//The week's quota outlasts days
+	qt.add(90)
+	clock.set(at(time.Friday, "12:00"))
+	qt.add(50)
+	if got := waitFor(t, reached, "weekly quota reached"); got != "weekly" {
+		t.Errorf("reached the %s quota, want weekly", got)
+	}
+	clock.set(at(time.Saturday, "12:00"))
+	qt.tick()
+	if got := qt.exceeded(); got != "weekly" {
+		t.Errorf("a new day freed the %q quota", got)
+	}
+
+	//Monday starts a new week
+	clock.set(at(time.Monday, "00:00").AddDate(0, 0, 7))
+	qt.tick()
+	waitFor(t, reset, "reset in a new week")
+	if got := qt.exceeded(); got != "" {
+		t.Errorf("still over the %s quota", got)
+	}
+
+	//Raising the quota frees it as well
+	qt.add(100)
+	waitFor(t, reached, "quota reached again")
+	qt.setLimits(200, 0, 0)
+	waitFor(t, reset, "reset by a higher quota")
+}
+
+func TestQuotaPersistence(t *testing.T) {
+	clock := &testClock{t: at(time.Monday, "12:00")}
+	qt, _, _ := newTestQuota(t, clock)
+	qt.add(500)
+	qt.Stop()
+
+	loaded := newQuotaTracker(qt.fileName)
+	loaded.now = clock.now
+	loaded.load()
+	loaded.setLimits(0, 0, 400)
+	if got := loaded.exceeded(); got != "monthly" {
+		t.Errorf("a restart forgot the monthly quota is used up, exceeded %q", got)
+	}
+	for _, period := range quotaPeriods {
+		if got := loaded.usage[period].Bytes; got != 500 {
+			t.Errorf("%s count is %d after a restart, want 500", period, got)
+		}
+	}
+
+	//Periods that passed while closed start over
+	clock.set(time.Date(2026, 11, 2, 9, 0, 0, 0, time.Local))
+	loaded = newQuotaTracker(qt.fileName)
+	loaded.now = clock.now
+	loaded.load()
+	for _, period := range quotaPeriods {
+		if got := loaded.usage[period].Bytes; got != 0 {
+			t.Errorf("%s count is %d in a new month", period, got)
+		}
+	}
+}
+
+// TestQuotaHoldsQueue runs a download into the quota, and out of it when the
+// day is over.
+func TestQuotaHoldsQueue(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 64*1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	dm := newTestManager(t)
+	clock := &testClock{t: at(time.Monday, "12:00")}
+	dm.quota.now = clock.now
+	const limit = 1024 * 1024
+	dm.quota.setLimits(limit, 0, 0)
+
+	running := srv.URL + "/file.bin"
+	waiting := srv.URL + "/other.bin"
+	dm.Tasks = []Task{
+		{ID: running, Url: running, Status: "Downloading"},
+		{ID: waiting, Url: waiting, Status: "Queued"},
+	}
+	stopped := make(chan struct{})
+	dm.launch(running, func(ctx context.Context) {
+		<-ctx.Done()
+		close(stopped)
+	})
+
+	dm.quota.add(limit)
+	<-stopped
+	waitForStatus(t, dm, running, "Quota")
+	if got := dm.heldStatus(); got != "Quota" {
+		t.Errorf("new downloads would wait in %q", got)
+	}
+
+	//A schedule holding the queue keeps it when the quota frees up
+	dm.settings.Scheduler = true
+	dm.settings.Schedule = []ScheduleWindow{{Start: "00:00", End: "00:00", Queue: "stop"}}
+	dm.scheduler.now = clock.now
+	dm.scheduler.tick()
+	clock.set(at(time.Tuesday, "00:00"))
+	dm.quota.status()
+	waitForStatus(t, dm, running, "Queued")
+	if got := dm.heldStatus(); got != "Queued" {
+		t.Errorf("queue held in %q once only the schedule holds it", got)
+	}
+
+	dm.settings.Scheduler = false
+	dm.scheduler.tick()
+	waitForStatus(t, dm, running, "Completed")
+	waitForStatus(t, dm, waiting, "Completed")
+}
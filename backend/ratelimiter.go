@@ -1,20 +1,44 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	psnet "github.com/shirou/gopsutil/v3/net"
 )
 
 type BandwidthMonitor struct {
 	mode         string
-	bytesPerSec  int64
+	bytesPerSec  int64 // limit the mode arrives at, 0 for none
 	maxBandwidth int64
 	ourBytes     int64
-	numParts     int32
+
+	// Cap set by the user, on top of the mode's limit
+	capBytesPerSec int64
+	capBurst       int64
+
+	// Shared by the parts of all running downloads
+	bucket *tokenBucket
+	// Counts our bytes against the data quotas, nil for none
+	quota *quotaTracker
+
+	// Where the machine's traffic is read from, nil to go by our own
+	// downloads alone
+	source     counterSource
+	congestion *congestionDetector
+	// Readings of the last update
+	lastTime     time.Time
+	lastRecv     uint64
+	haveRecv     bool
+	lastOurBytes int64
+
+	// Caps and weights set for tasks, and the share of the limit of tasks
+	// that read lately
+	taskLimits map[string]taskLimit
+	shares     map[string]*taskShare
+	rebalanced time.Time
 
 	mu     sync.Mutex
 	stopCh chan struct{}
@@ -25,7 +49,10 @@ func NewBandwidthMonitor() *BandwidthMonitor {
 		bytesPerSec:  0,
 		maxBandwidth: 0,
 		mode:         "auto",
-		numParts:     4,
+		bucket:       newTokenBucket(),
+		congestion:   &congestionDetector{},
+		taskLimits:   make(map[string]taskLimit),
+		shares:       make(map[string]*taskShare),
 		stopCh:       make(chan struct{}),
 	}
 	return bm
@@ -36,92 +63,134 @@ func (bm *BandwidthMonitor) Start() {
 		ticker := time.NewTicker(2 * time.Second)
 		defer ticker.Stop()
 
-		lastIO, err := psnet.IOCounters(false)
-		if err != nil {
-			log.Println("BandwidthMonitor: failed to read network stats:", err)
-			return
-		}
-
-		lastRecv := lastIO[0].BytesRecv
-		lastTime := time.Now()
-
-		atomic.StoreInt64(&bm.ourBytes, 0)
-		lastOurBytes := int64(0)
-
+		bm.update(time.Now())
 		for {
 			select {
 			case <-bm.stopCh:
 				return
-			case <-ticker.C:
-				currentIO, err := psnet.IOCounters(false)
-				if err != nil {
-					continue
-				}
+			case now := <-ticker.C:
+				bm.update(now)
+			}
+		}
+	}()
+}
 
-				now := time.Now()
-				elapsed := now.Sub(lastTime).Seconds()
-				if elapsed <= 0 {
-					continue
-				}
+// update measures the speeds since the last call and sets the limit of the
+// mode from them. Only the Start loop calls it, and tests with their own
+// clock.
+func (bm *BandwidthMonitor) update(now time.Time) {
+	bm.mu.Lock()
+	mode, source := bm.mode, bm.source
+	active := bm.activeTasksLocked(now)
+	bm.mu.Unlock()
 
-				currentRecv := currentIO[0].BytesRecv
-				totalSpeed := float64(currentRecv-lastRecv) / elapsed
+	var recv uint64
+	recvErr := errNoCounters
+	if source != nil {
+		recv, recvErr = source.Received()
+	}
+	currentOurBytes := atomic.LoadInt64(&bm.ourBytes)
+	elapsed := now.Sub(bm.lastTime).Seconds()
+	first := bm.lastTime.IsZero()
 
-				currentOurBytes := atomic.LoadInt64(&bm.ourBytes)
-				ourSpeed := float64(currentOurBytes-lastOurBytes) / elapsed
+	//The machine's traffic is only known from two readings, and not when
+	//the counters went back, as they do when an interface restarts
+	otherUsage := -1.0
+	if !first && elapsed > 0 && recvErr == nil && bm.haveRecv && recv >= bm.lastRecv {
+		totalSpeed := float64(recv-bm.lastRecv) / elapsed
+		ourSpeed := float64(currentOurBytes-bm.lastOurBytes) / elapsed
+		otherUsage = max(totalSpeed-ourSpeed, 0)
+	}
+	bm.lastRecv, bm.haveRecv = recv, recvErr == nil
+	if first || elapsed <= 0 {
+		bm.lastTime, bm.lastOurBytes = now, currentOurBytes
+		return
+	}
 
-				otherUsage := totalSpeed - ourSpeed
-				if otherUsage < 0 {
-					otherUsage = 0
-				}
+	ourSpeed := float64(currentOurBytes-bm.lastOurBytes) / elapsed
 
-				maxBW := atomic.LoadInt64(&bm.maxBandwidth)
-				if ourSpeed > float64(maxBW) {
-					atomic.StoreInt64(&bm.maxBandwidth, int64(ourSpeed))
-					maxBW = int64(ourSpeed)
-				} else if maxBW > 0 {
-					decayed := int64(float64(maxBW) * 0.98)
-					atomic.StoreInt64(&bm.maxBandwidth, decayed)
-					maxBW = decayed
-				}
+	maxBW := atomic.LoadInt64(&bm.maxBandwidth)
+	if ourSpeed > float64(maxBW) {
+		atomic.StoreInt64(&bm.maxBandwidth, int64(ourSpeed))
+		maxBW = int64(ourSpeed)
+	} else if maxBW > 0 {
+		decayed := int64(float64(maxBW) * 0.98)
+		atomic.StoreInt64(&bm.maxBandwidth, decayed)
+		maxBW = decayed
+	}
+	selfLimit := bm.congestion.update(ourSpeed, active)
 
-				bm.mu.Lock()
-				mode := bm.mode
-				bm.mu.Unlock()
-
-				var newLimit int64
-
-				switch mode {
-				case "snail":
-					newLimit = maxBW * 30 / 100
-					if newLimit < 50*1024 {
-						newLimit = 50 * 1024
-					}
-				case "auto":
-					available := float64(maxBW) - otherUsage
-					if available < float64(maxBW)*0.3 {
-						available = float64(maxBW) * 0.3
-					}
-					newLimit = int64(available)
-					if newLimit < 50*1024 {
-						newLimit = 50 * 1024
-					}
-
-					if maxBW == 0 {
-						newLimit = 0
-					}
-				case "turbo":
-					newLimit = 0
-				}
+	var newLimit int64
 
-				atomic.StoreInt64(&bm.bytesPerSec, newLimit)
+	switch mode {
+	case "snail":
+		newLimit = maxBW * 30 / 100
+		if newLimit < minAutoLimit {
+			newLimit = minAutoLimit
+		}
+	case "auto":
+		if otherUsage < 0 {
+			//Without the machine's counters, go by our own speed and latency
+			newLimit = selfLimit
+			break
+		}
+		available := float64(maxBW) - otherUsage
+		if available < float64(maxBW)*0.3 {
+			available = float64(maxBW) * 0.3
+		}
+		newLimit = int64(available)
+		if newLimit < minAutoLimit {
+			newLimit = minAutoLimit
+		}
 
-				lastRecv = currentRecv
-				lastOurBytes = currentOurBytes
-				lastTime = now
-			}
+		if maxBW == 0 {
+			newLimit = 0
 		}
-	}()
+	case "turbo":
+		newLimit = 0
+	}
+
+	atomic.StoreInt64(&bm.bytesPerSec, newLimit)
+	bm.applyLimit()
+
+	bm.lastOurBytes = currentOurBytes
+	bm.lastTime = now
+}
+
+// errNoCounters stands in for the machine's counters when auto mode goes by
+// our own downloads alone.
+var errNoCounters = errors.New("no counter source")
+
+// SetCounterSource sets where the machine's traffic is read from, nil to go
+// by our own downloads alone. A source that can't be read is left out.
+func (bm *BandwidthMonitor) SetCounterSource(source counterSource) {
+	if source != nil {
+		if _, err := source.Received(); err != nil {
+			log.Println("BandwidthMonitor: failed to read network stats, going by our own downloads:", err)
+			source = nil
+		}
+	}
+	bm.mu.Lock()
+	bm.source = source
+	bm.mu.Unlock()
+}
+
+// ObserveLatency records how long a request took to be answered, the
+// latency auto mode watches when it goes by our own downloads.
+func (bm *BandwidthMonitor) ObserveLatency(d time.Duration) {
+	bm.congestion.observeLatency(d)
+}
+
+// activeTasksLocked counts the tasks that read lately. The caller holds
+// bm.mu.
+func (bm *BandwidthMonitor) activeTasksLocked(now time.Time) int {
+	active := 0
+	for _, s := range bm.shares {
+		if now.Sub(s.lastRead) <= activeWindow {
+			active++
+		}
+	}
+	return active
 }
 
 func (bm *BandwidthMonitor) Stop() {
@@ -135,30 +204,290 @@ func (bm *BandwidthMonitor) SetMode(mode string) {
 
 	if mode == "turbo" {
 		atomic.StoreInt64(&bm.bytesPerSec, 0)
+		bm.applyLimit()
 	}
 
 	log.Println("Bandwidth mode set to:", mode)
 }
 
-func (bm *BandwidthMonitor) Wait(n int) {
-	limit := atomic.LoadInt64(&bm.bytesPerSec)
-	if limit <= 0 {
-		return
+func (bm *BandwidthMonitor) Mode() string {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	return bm.mode
+}
+
+// SetLimit caps the combined speed of all downloads at bytesPerSec, letting
+// up to burst bytes through at once after a pause. 0 removes the cap, and a
+// burst of 0 picks one from the rate.
+func (bm *BandwidthMonitor) SetLimit(bytesPerSec int64, burst int64) {
+	bm.mu.Lock()
+	bm.capBytesPerSec = max(bytesPerSec, 0)
+	bm.capBurst = max(burst, 0)
+	bm.mu.Unlock()
+	bm.applyLimit()
+}
+
+// applyLimit sets the bucket to the lower of the user's cap and the mode's
+// limit.
+func (bm *BandwidthMonitor) applyLimit() {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	bm.bucket.setRate(bm.limitLocked(), bm.capBurst)
+	bm.rebalanceLocked(time.Now())
+}
+
+// limitLocked returns the combined limit of all downloads, 0 for none. The
+// caller holds bm.mu.
+func (bm *BandwidthMonitor) limitLocked() int64 {
+	limit := bm.capBytesPerSec
+	if modeLimit := atomic.LoadInt64(&bm.bytesPerSec); modeLimit > 0 && (limit == 0 || modeLimit < limit) {
+		limit = modeLimit
+	}
+	return limit
+}
+
+// Wait blocks until the n bytes taskId just read fit under the task's share
+// and the combined limit, or ctx is done.
+func (bm *BandwidthMonitor) Wait(ctx context.Context, taskId string, n int) {
+	bm.share(taskId).bucket.wait(ctx, n)
+	bm.bucket.wait(ctx, n)
+}
+
+// taskLimit is what the user set for one task.
+type taskLimit struct {
+	bytesPerSec int64 // 0 for no cap of its own
+	weight      int   // share of the combined limit against other tasks, 1 when 0
+}
+
+func (tl taskLimit) weightOrDefault() int64 {
+	return int64(max(tl.weight, 1))
+}
+
+// taskShare holds a task to its part of the combined limit.
+type taskShare struct {
+	bucket   *tokenBucket
+	lastRead time.Time
+}
+
+const (
+	// A task that read within activeWindow competes for the limit
+	activeWindow = time.Second
+	// and the share of one idle for shareExpiry is dropped
+	shareExpiry = 10 * time.Second
+)
+
+// SetTaskLimit caps taskId at bytesPerSec, 0 for no cap, and gives it weight
+// times the share of a task of weight 1 when the combined limit is split.
+// It applies to reads in progress too.
+func (bm *BandwidthMonitor) SetTaskLimit(taskId string, bytesPerSec int64, weight int) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	limit := taskLimit{bytesPerSec: max(bytesPerSec, 0), weight: max(weight, 0)}
+	if limit == (taskLimit{}) {
+		delete(bm.taskLimits, taskId)
+	} else {
+		bm.taskLimits[taskId] = limit
 	}
+	bm.rebalanceLocked(time.Now())
+}
+
+// RemoveTask forgets the limits of a deleted task.
+func (bm *BandwidthMonitor) RemoveTask(taskId string) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	delete(bm.taskLimits, taskId)
+	delete(bm.shares, taskId)
+	bm.rebalanceLocked(time.Now())
+}
 
-	parts := int64(atomic.LoadInt32(&bm.numParts))
-	if parts < 1 {
-		parts = 1
+// share returns the share of taskId, splitting the limit again when the task
+// starts reading or the last split is getting old.
+func (bm *BandwidthMonitor) share(taskId string) *taskShare {
+	now := time.Now()
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	s, ok := bm.shares[taskId]
+	if !ok {
+		s = &taskShare{bucket: newTokenBucket()}
+		bm.shares[taskId] = s
+	}
+	joined := now.Sub(s.lastRead) > activeWindow
+	s.lastRead = now
+	if joined || now.Sub(bm.rebalanced) > activeWindow/2 {
+		bm.rebalanceLocked(now)
+	}
+	return s
+}
+
+// rebalanceLocked splits the combined limit over the tasks that are reading
+// in proportion to their weights. A task capped below its part gets its cap
+// and the rest goes to the others. Idle tasks are set to what they would get
+// if they started reading again. The caller holds bm.mu.
+func (bm *BandwidthMonitor) rebalanceLocked(now time.Time) {
+	bm.rebalanced = now
+	total := bm.limitLocked()
+
+	var active []string
+	var activeWeight int64
+	for id, s := range bm.shares {
+		idle := now.Sub(s.lastRead)
+		if idle > shareExpiry {
+			delete(bm.shares, id)
+		} else if idle <= activeWindow {
+			active = append(active, id)
+			activeWeight += bm.taskLimits[id].weightOrDefault()
+		}
+	}
+
+	rates := make(map[string]int64)
+	remaining, pending, pendingWeight := total, active, activeWeight
+	for total > 0 && len(pending) > 0 {
+		//Hand out the caps that are below a fair split, then split what is left again
+		var uncapped []string
+		var uncappedWeight int64
+		for _, id := range pending {
+			limit := bm.taskLimits[id]
+			fair := remaining * limit.weightOrDefault() / pendingWeight
+			if limit.bytesPerSec > 0 && limit.bytesPerSec <= fair {
+				rates[id] = limit.bytesPerSec
+			} else {
+				uncapped = append(uncapped, id)
+				uncappedWeight += limit.weightOrDefault()
+			}
+		}
+		if len(uncapped) == len(pending) {
+			for _, id := range pending {
+				rates[id] = max(remaining*bm.taskLimits[id].weightOrDefault()/pendingWeight, 1)
+			}
+			break
+		}
+		for _, id := range pending {
+			if rate, capped := rates[id]; capped {
+				remaining -= rate
+			}
+		}
+		pending, pendingWeight = uncapped, uncappedWeight
+	}
+
+	for id, s := range bm.shares {
+		limit := bm.taskLimits[id]
+		rate, ok := rates[id]
+		if !ok {
+			rate = limit.bytesPerSec
+			if total > 0 {
+				joining := max(total*limit.weightOrDefault()/(activeWeight+limit.weightOrDefault()), 1)
+				if rate == 0 || joining < rate {
+					rate = joining
+				}
+			}
+		}
+		s.bucket.setRate(rate, 0)
 	}
-	perPartLimit := limit / parts
-	sleepDuration := time.Duration(float64(n) / float64(perPartLimit) * float64(time.Second))
-	time.Sleep(sleepDuration)
 }
 
 func (bm *BandwidthMonitor) AddBytes(n int) {
 	atomic.AddInt64(&bm.ourBytes, int64(n))
+	if bm.quota != nil {
+		bm.quota.add(n)
+	}
+}
+
+// minBurst lets a whole read buffer through at once, however low the rate.
+const minBurst = 64 * 1024
+
+// tokenBucket holds back reads to a rate in bytes per second. Every read
+// takes its size from the bucket, which refills at the rate up to burst.
+// A read the bucket can't cover leaves it in debt and waits until the debt
+// is paid off, so reads are let through in the order they came whether one
+// connection or fifty share the bucket.
+type tokenBucket struct {
+	rate    float64 // bytes per second, 0 for no limit
+	burst   float64
+	tokens  float64
+	last    time.Time
+	changed chan struct{} // closed when the rate changes, to wake waiting reads
+
+	mu sync.Mutex
+}
+
+func newTokenBucket() *tokenBucket {
+	return &tokenBucket{changed: make(chan struct{})}
+}
+
+// refill adds the tokens earned since the last call. The caller holds tb.mu.
+func (tb *tokenBucket) refill(now time.Time) {
+	if !tb.last.IsZero() {
+		tb.tokens = min(tb.tokens+now.Sub(tb.last).Seconds()*tb.rate, tb.burst)
+	}
+	tb.last = now
 }
 
-func (bm *BandwidthMonitor) SetParts(n int) {
-	atomic.StoreInt32(&bm.numParts, int32(n))
+func (tb *tokenBucket) setRate(bytesPerSec int64, burst int64) {
+	rate := float64(bytesPerSec)
+	if burst == 0 {
+		//A quarter second of the rate keeps the speed even without starving big reads
+		burst = bytesPerSec / 4
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	newBurst := float64(max(burst, minBurst))
+	if rate == tb.rate && newBurst == tb.burst {
+		return
+	}
+	tb.refill(time.Now())
+	if tb.rate == 0 {
+		//Coming off no limit, start with a full bucket rather than the old debt
+		tb.tokens = newBurst
+	}
+	tb.rate, tb.burst = rate, newBurst
+	tb.tokens = min(tb.tokens, tb.burst)
+	close(tb.changed)
+	tb.changed = make(chan struct{})
+}
+
+// reserve takes n tokens and returns how long to wait for them to be
+// there, along with a channel that is closed if the rate changes meanwhile.
+func (tb *tokenBucket) reserve(n int) (time.Duration, <-chan struct{}) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.rate <= 0 {
+		return 0, nil
+	}
+	tb.refill(time.Now())
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0, nil
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second)), tb.changed
+}
+
+// refund gives back the tokens of a wait that was cut short.
+func (tb *tokenBucket) refund(n int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.rate > 0 {
+		tb.tokens = min(tb.tokens+float64(n), tb.burst)
+	}
+}
+
+func (tb *tokenBucket) wait(ctx context.Context, n int) {
+	for {
+		delay, changed := tb.reserve(n)
+		if delay <= 0 {
+			return
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+			return
+		case <-ctx.Done():
+			timer.Stop()
+			tb.refund(n)
+			return
+		case <-changed:
+			//Wait again at the new rate
+			timer.Stop()
+			tb.refund(n)
+		}
+	}
 }
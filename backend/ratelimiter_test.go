@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// feedTraffic feeds bm two seconds of traffic, ours and what other programs
+// received, and returns the limit auto mode arrives at.
+func feedTraffic(bm *BandwidthMonitor, fc *fakeCounters, now *time.Time, ours int, others int) int64 {
+	bm.AddBytes(ours)
+	if fc != nil {
+		fc.add(uint64(ours + others))
+	}
+	*now = now.Add(2 * time.Second)
+	bm.update(*now)
+	return atomic.LoadInt64(&bm.bytesPerSec)
+}
+
+// decayed is the best speed seen after one reading below it.
+func decayed(maxBW int64) int64 {
+	return int64(float64(maxBW) * 0.98)
+}
+
+func TestAutoModeWithCounters(t *testing.T) {
+	const mb = 1024 * 1024
+	bm := NewBandwidthMonitor()
+	fc := &fakeCounters{received: 5 * mb}
+	bm.SetCounterSource(fc)
+	now := time.Now()
+	bm.update(now)
+
+	//Alone on the link we may use all of it
+	if got := feedTraffic(bm, fc, &now, 2*mb, 0); got != mb {
+		t.Errorf("alone: limit %d, want %d", got, mb)
+	}
+	//Others taking half a MB/s leave us the rest of the best speed seen
+	maxBW := decayed(mb)
+	if got := feedTraffic(bm, fc, &now, 2*mb, mb); got != maxBW-mb/2 {
+		t.Errorf("shared: limit %d, want %d", got, maxBW-mb/2)
+	}
+	//However busy the link, we keep 30% of it
+	maxBW = decayed(maxBW)
+	if got := feedTraffic(bm, fc, &now, 0, 10*mb); got != int64(float64(maxBW)*0.3) {
+		t.Errorf("busy: limit %d, want %d", got, int64(float64(maxBW)*0.3))
+	}
+
+	//Counters that went back, as when an interface restarts, are not trusted
+	//for a reading. Our own signals show no congestion, so there is no limit
+	fc.mu.Lock()
+	fc.received = 0
+	fc.mu.Unlock()
+	if got := feedTraffic(bm, fc, &now, 2*mb, 0); got != 0 {
+		t.Errorf("after a counter reset: limit %d, want none", got)
+	}
+	maxBW = decayed(mb)
+	if got := feedTraffic(bm, fc, &now, 2*mb, 0); got != maxBW {
+		t.Errorf("after the reset: limit %d, want %d", got, maxBW)
+	}
+}
+
+func TestAutoModeWithoutCounters(t *testing.T) {
+	const mb = 1024 * 1024
+	bm := NewBandwidthMonitor()
+	now := time.Now()
+	bm.update(now)
+
+	bm.ObserveLatency(20 * time.Millisecond)
+	if got := feedTraffic(bm, nil, &now, 2*mb, 0); got != 0 {
+		t.Errorf("uncongested: limit %d, want none", got)
+	}
+	//Answers taking much longer mean someone else fills the link
+	bm.ObserveLatency(400 * time.Millisecond)
+	if got := feedTraffic(bm, nil, &now, 2*mb, 0); got != mb*8/10 {
+		t.Errorf("congested: limit %d, want %d", got, mb*8/10)
+	}
+	//The limit reaches the bucket the parts wait on
+	bm.bucket.mu.Lock()
+	rate := bm.bucket.rate
+	bm.bucket.mu.Unlock()
+	if rate != mb*8/10 {
+		t.Errorf("bucket rate %.0f, want %d", rate, mb*8/10)
+	}
+}
+
+func TestModesWithCounters(t *testing.T) {
+	const mb = 1024 * 1024
+	bm := NewBandwidthMonitor()
+	fc := &fakeCounters{}
+	bm.SetCounterSource(fc)
+	bm.SetMode("snail")
+	now := time.Now()
+	bm.update(now)
+
+	if got := feedTraffic(bm, fc, &now, 100*1024, 0); got != minAutoLimit {
+		t.Errorf("snail on a slow link: limit %d, want %d", got, minAutoLimit)
+	}
+	if got := feedTraffic(bm, fc, &now, 4*mb, 0); got != 2*mb*30/100 {
+		t.Errorf("snail: limit %d, want %d", got, 2*mb*30/100)
+	}
+	bm.SetMode("turbo")
+	if got := feedTraffic(bm, fc, &now, 4*mb, 4*mb); got != 0 {
+		t.Errorf("turbo: limit %d, want none", got)
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	tb := newTokenBucket()
+	if delay, _ := tb.reserve(10 * minBurst); delay != 0 {
+		t.Errorf("no limit made a read wait %v", delay)
+	}
+
+	tb.setRate(1024*1024, minBurst)
+	//Coming off no limit the bucket is full, so one burst goes through at once
+	if delay, _ := tb.reserve(minBurst); delay != 0 {
+		t.Errorf("first burst waited %v", delay)
+	}
+	//The next read waits for its share, 64 KiB at 1 MiB/s is 1/16 s
+	delay, changed := tb.reserve(minBurst)
+	if delay < 55*time.Millisecond || delay > 65*time.Millisecond {
+		t.Errorf("second read waits %v, want about 62ms", delay)
+	}
+	if changed == nil {
+		t.Fatal("no channel to wake the wait on a rate change")
+	}
+	tb.setRate(2*1024*1024, 0)
+	select {
+	case <-changed:
+	default:
+		t.Error("rate change did not wake the waiting read")
+	}
+}
+
+func TestTokenBucketSharedRate(t *testing.T) {
+	const rate = 1024 * 1024
+	tb := newTokenBucket()
+	tb.setRate(rate, minBurst)
+
+	//Eight readers share the rate, however many of them there are
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 8 {
+				tb.wait(context.Background(), 8*1024)
+			}
+		}()
+	}
+	wg.Wait()
+	//512 KiB at 1 MiB/s, less the first burst, is 7/16 s
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Errorf("512 KiB took %v at 1 MiB/s", elapsed)
+	}
+}
+
+func TestTokenBucketWaitEnds(t *testing.T) {
+	tb := newTokenBucket()
+	tb.setRate(1, 0)
+	tb.reserve(minBurst)
+
+	//A canceled read stops waiting and gives its tokens back
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	tb.wait(ctx, minBurst)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("canceled wait took %v", elapsed)
+	}
+	tb.mu.Lock()
+	tokens := tb.tokens
+	tb.mu.Unlock()
+	if tokens < -minBurst-1 {
+		t.Errorf("bucket is %v in debt after the refund, want at most one read", tokens)
+	}
+
+	//Lifting the limit lets a waiting read go
+	done := make(chan struct{})
+	go func() {
+		tb.wait(context.Background(), minBurst)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	tb.setRate(0, 0)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("read still waits after the limit was lifted")
+	}
+}
+
+func TestSetLimitTakesTheLowerLimit(t *testing.T) {
+	bm := NewBandwidthMonitor()
+	rate := func() float64 {
+		bm.bucket.mu.Lock()
+		defer bm.bucket.mu.Unlock()
+		return bm.bucket.rate
+	}
+
+	bm.SetLimit(2*1024*1024, 0)
+	if got := rate(); got != 2*1024*1024 {
+		t.Errorf("rate %v, want the cap", got)
+	}
+	bm.bytesPerSec = 1024 * 1024
+	bm.applyLimit()
+	if got := rate(); got != 1024*1024 {
+		t.Errorf("rate %v, want the lower mode limit", got)
+	}
+	bm.SetLimit(0, 0)
+	if got := rate(); got != 1024*1024 {
+		t.Errorf("rate %v after removing the cap, want the mode limit", got)
+	}
+	bm.SetMode("turbo")
+	if got := rate(); got != 0 {
+		t.Errorf("rate %v in turbo mode without a cap, want none", got)
+	}
+}
+
+func TestRebalanceSplitsByWeight(t *testing.T) {
+	const mb = 1024 * 1024
+	bm := NewBandwidthMonitor()
+	bm.SetLimit(3*mb, 0)
+	rate := func(taskId string) float64 {
+		bm.mu.Lock()
+		tb := bm.shares[taskId].bucket
+		bm.mu.Unlock()
+		tb.mu.Lock()
+		defer tb.mu.Unlock()
+		return tb.rate
+	}
+
+	bm.SetTaskLimit("a", 0, 2)
+	bm.share("a")
+	if got := rate("a"); got != 3*mb {
+		t.Errorf("a alone gets %v, want all of the limit", got)
+	}
+	bm.share("b")
+	if a, b := rate("a"), rate("b"); a != 2*mb || b != mb {
+		t.Errorf("a and b get %v and %v, want 2 MiB and 1 MiB by weight", a, b)
+	}
+
+	//A cap below its part leaves the rest to the others
+	bm.SetTaskLimit("a", mb/2, 2)
+	if a, b := rate("a"), rate("b"); a != mb/2 || b != 3*mb-mb/2 {
+		t.Errorf("with a capped, a and b get %v and %v", a, b)
+	}
+
+	//A task that stopped reading no longer holds on to its part
+	bm.mu.Lock()
+	bm.shares["a"].lastRead = time.Now().Add(-2 * activeWindow)
+	bm.rebalanceLocked(time.Now())
+	bm.mu.Unlock()
+	if got := rate("b"); got != 3*mb {
+		t.Errorf("b alone gets %v, want all of the limit", got)
+	}
+
+	bm.RemoveTask("a")
+	bm.mu.Lock()
+	_, limited := bm.taskLimits["a"]
+	bm.mu.Unlock()
+	if limited {
+		t.Error("deleted task kept its limit")
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errLinkExpired is returned for a request to a signed URL that has run out.
+var errLinkExpired = errors.New("download link expired")
+
+// Resolver turns the URL of a page on some site, such as a video page, into
+// the URLs the file behind it is actually served from.
+type Resolver interface {
+	// Name identifies the resolver in logs and error messages.
+	Name() string
+	// Match reports whether the resolver handles u.
+	Match(u *neturl.URL) bool
+	// Resolve looks up where the file behind pageUrl can be downloaded.
+	Resolve(ctx context.Context, pageUrl string, opts ResolveOptions) (*Resolution, error)
+}
+
+// ResolveOptions are the preferences of the task being resolved.
+type ResolveOptions struct {
+	Quality string
+	Itag    int
+}
+
+// Resolution is where a resolver found the file. It is saved with the task.
+type Resolution struct {
+	Urls     []string    `json:"urls"`              // direct URLs, the first one is the primary and the rest are mirrors
+	FileName string      `json:"fileName"`          // suggested name, "" to go by the server's
+	Variant  string      `json:"variant,omitempty"` // what was picked, for display
+	Headers  http.Header `json:"-"`                 // sent with every request for Urls, sealed with the task's secrets
+	Expires  time.Time   `json:"expires,omitzero"`  // when Urls stop working, zero if they don't
+}
+
+// resolverRegistry holds the resolvers a download is matched against.
+type resolverRegistry struct {
+	resolvers []Resolver
+	mu        sync.RWMutex
+}
+
+func newResolverRegistry() *resolverRegistry {
+	return &resolverRegistry{}
+}
+
+// Register adds r in front of the ones already there, so it can take over
+// sites a built-in resolver handles.
+func (rr *resolverRegistry) Register(r Resolver) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.resolvers = append([]Resolver{r}, rr.resolvers...)
+}
+
+// lookup returns the first resolver matching u, or nil if none does.
+func (rr *resolverRegistry) lookup(u *neturl.URL) Resolver {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	for _, r := range rr.resolvers {
+		if r.Match(u) {
+			return r
+		}
+	}
+	return nil
+}
+
+// RegisterResolver makes downloads of the URLs r matches go through it.
+func (dm *DownloadManager) RegisterResolver(r Resolver) {
+	dm.resolvers.Register(r)
+}
+
+// download runs a task the way its URL calls for: playlists expand into
+// their videos, site pages go through their resolver and anything else is
+// downloaded as it is.
+func (dm *DownloadManager) download(ctx context.Context, taskId string, u *neturl.URL) {
+	if isYoutubeGroup(u) {
+		dm.downloadYoutubeGroup(ctx, taskId)
+	} else if r := dm.resolvers.lookup(u); r != nil {
+		dm.downloadResolved(ctx, taskId, r)
+	} else {
+		dm.downloadDirect(ctx, taskId, u.String())
+	}
+}
+
+// downloadDirect downloads a URL that points at the file itself, or at an
+// HLS or DASH manifest of it.
+func (dm *DownloadManager) downloadDirect(ctx context.Context, taskId string, rawUrl string, customName ...string) {
+	var ext string
+	if u, err := neturl.Parse(rawUrl); err == nil {
+		ext = strings.ToLower(path.Ext(u.Path))
+	}
+	switch ext {
+	case ".m3u8":
+		dm.downloadHLS(ctx, taskId, rawUrl)
+	case ".mpd":
+		dm.downloadDASH(ctx, taskId, rawUrl)
+	default:
+		dm.processDownload(ctx, taskId, rawUrl, customName...)
+	}
+}
+
+// downloadResolved asks r where the file behind the task's URL is and
+// downloads it from there.
+func (dm *DownloadManager) downloadResolved(ctx context.Context, taskId string, r Resolver) {
+	var pageUrl string
+	var opts ResolveOptions
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].ID == taskId {
+			pageUrl = dm.Tasks[i].Url
+			opts = ResolveOptions{Quality: dm.Tasks[i].Quality, Itag: dm.Tasks[i].Itag}
+			break
+		}
+	}
+	dm.dataMutex.Unlock()
+
+	log.Println("Resolving", pageUrl, "with", r.Name())
+	res, err := r.Resolve(ctx, pageUrl, opts)
+	if err == nil && len(res.Urls) == 0 {
+		err = errors.New("no download URL found")
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("Error resolving", pageUrl, err)
+		dm.setTaskError(taskId, r.Name()+": "+err.Error())
+		SendError(taskId, "Failed to resolve link: "+err.Error())
+		return
+	}
+	log.Println("Resolved to", len(res.Urls), "URL(s)", res.Variant)
+
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].ID == taskId {
+			dm.Tasks[i].Resolved = res
+			dm.Tasks[i].Variant = res.Variant
+			if res.FileName != "" {
+				dm.Tasks[i].FileName = res.FileName
+			}
+			break
+		}
+	}
+	dm.dataMutex.Unlock()
+	dm.SaveTasks()
+
+	var customName []string
+	if res.FileName != "" {
+		customName = append(customName, res.FileName)
+	}
+	dm.downloadDirect(ctx, taskId, res.Urls[0], customName...)
+}
+
+// urlExpiry reads when a signed URL stops working from its query, or
+// returns the zero time if it doesn't say.
+func urlExpiry(u *neturl.URL) time.Time {
+	q := u.Query()
+	//YouTube, CloudFront and S3 (v2 signatures) give a unix time
+	for _, name := range []string{"expire", "Expires", "expires"} {
+		if unix, err := strconv.ParseInt(q.Get(name), 10, 64); err == nil {
+			return time.Unix(unix, 0)
+		}
+	}
+	//S3 and GCS v4 signatures give the signing time and a lifetime in seconds
+	for _, prefix := range []string{"X-Amz-", "X-Goog-"} {
+		signed, err := time.Parse("20060102T150405Z", q.Get(prefix+"Date"))
+		seconds, err2 := strconv.Atoi(q.Get(prefix + "Expires"))
+		if err == nil && err2 == nil {
+			return signed.Add(time.Duration(seconds) * time.Second)
+		}
+	}
+	//Azure SAS tokens give the end of their validity
+	if end, err := time.Parse(time.RFC3339, q.Get("se")); err == nil && q.Get("sig") != "" {
+		return end
+	}
+	return time.Time{}
+}
+
+// linkRefresher gets a new URL from a task's resolver when the one a
+// download started with expires. Parts that hit the expiry together share
+// one lookup.
+type linkRefresher struct {
+	dm       *DownloadManager
+	taskId   string
+	resolver Resolver
+	client   *http.Client
+	remote   remoteValidators // the file the parts on disk belong to
+
+	mu        sync.Mutex
+	refreshes int
+}
+
+// maxLinkRefreshes bounds the lookups of one run, a resolver handing out
+// links that are dead on arrival would loop forever otherwise.
+const maxLinkRefreshes = 5
+
+// newLinkRefresher returns nil if nothing resolved the task's URL, such as
+// a presigned link the user pasted, since there is nowhere to ask then.
+// Fresh links are checked with client against remote.
+func (dm *DownloadManager) newLinkRefresher(taskId string, client *http.Client, remote remoteValidators) *linkRefresher {
+	var pageUrl string
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].ID == taskId {
+			if dm.Tasks[i].Resolved != nil {
+				pageUrl = dm.Tasks[i].Url
+			}
+			break
+		}
+	}
+	dm.dataMutex.Unlock()
+
+	u, err := neturl.Parse(pageUrl)
+	if pageUrl == "" || err != nil {
+		return nil
+	}
+	r := dm.resolvers.lookup(u)
+	if r == nil {
+		return nil
+	}
+	return &linkRefresher{dm: dm, taskId: taskId, resolver: r, client: client, remote: remote}
+}
+
+// refresh points the primary mirror at a fresh URL, unless another part
+// already did since it failed with expired. It returns errRemoteChanged when
+// the fresh URL serves another version of the file.
+func (lr *linkRefresher) refresh(ctx context.Context, mirrors *mirrorPool, expired string) error {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	primary := mirrors.mirrors[0]
+	if mirrors.urlOf(primary) != expired {
+		return nil
+	}
+	if lr.refreshes >= maxLinkRefreshes {
+		return fmt.Errorf("%w, %d fresh links did not help", errLinkExpired, lr.refreshes)
+	}
+	lr.refreshes++
+
+	var pageUrl string
+	var opts ResolveOptions
+	lr.dm.dataMutex.Lock()
+	for i := range lr.dm.Tasks {
+		if lr.dm.Tasks[i].ID == lr.taskId {
+			pageUrl = lr.dm.Tasks[i].Url
+			opts = ResolveOptions{Quality: lr.dm.Tasks[i].Quality, Itag: lr.dm.Tasks[i].Itag}
+			break
+		}
+	}
+	lr.dm.dataMutex.Unlock()
+
+	log.Println("Download link expired, resolving", pageUrl, "again")
+	res, err := lr.resolver.Resolve(ctx, pageUrl, opts)
+	if err == nil && len(res.Urls) == 0 {
+		err = errors.New("no download URL found")
+	}
+	if err != nil {
+		return fmt.Errorf("%w, resolving again failed: %v", errLinkExpired, err)
+	}
+
+	//Keep the saved resolution current, the parts carry on from where they are
+	var reqOpts requestOptions
+	lr.dm.dataMutex.Lock()
+	for i := range lr.dm.Tasks {
+		if lr.dm.Tasks[i].ID == lr.taskId {
+			lr.dm.Tasks[i].Resolved = res
+			reqOpts = lr.dm.Tasks[i].requestOptions()
+			break
+		}
+	}
+	lr.dm.dataMutex.Unlock()
+	lr.dm.SaveTasks()
+
+	//The parts carry on over the new link only if it serves the file they hold
+	remote, err := lr.check(ctx, res.Urls[0], reqOpts)
+	if err != nil {
+		return fmt.Errorf("%w, fresh link failed: %v", errLinkExpired, err)
+	}
+	mirrors.replace(primary, res.Urls[0], reqOpts, remote.ifRange())
+	if lr.remote.differ(remote) {
+		return fmt.Errorf("%w, the fresh link serves another version", errRemoteChanged)
+	}
+	return nil
+}
+
+// check asks for the headers of a fresh link to compare its file with the
+// one the download started with.
+func (lr *linkRefresher) check(ctx context.Context, url string, opts requestOptions) (remoteValidators, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return remoteValidators{}, err
+	}
+	opts.apply(req)
+	res, err := lr.client.Do(req)
+	if err != nil {
+		return remoteValidators{}, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return remoteValidators{}, fmt.Errorf("status %d", res.StatusCode)
+	}
+	return validatorsFrom(res), nil
+}
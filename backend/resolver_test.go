@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver handles the pages of one host. Each Resolve hands out the
+// next of urls, repeating the last one once they run out.
+type fakeResolver struct {
+	name     string
+	host     string
+	urls     []string
+	fileName string
+	err      error
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (fr *fakeResolver) Name() string {
+	return fr.name
+}
+
+func (fr *fakeResolver) Match(u *neturl.URL) bool {
+	return u.Hostname() == fr.host
+}
+
+func (fr *fakeResolver) Resolve(ctx context.Context, pageUrl string, opts ResolveOptions) (*Resolution, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.calls++
+	if fr.err != nil {
+		return nil, fr.err
+	}
+	u := fr.urls[min(fr.calls, len(fr.urls))-1]
+	res := &Resolution{Urls: []string{u}, FileName: fr.fileName, Variant: opts.Quality}
+	if parsed, err := neturl.Parse(u); err == nil {
+		res.Expires = urlExpiry(parsed)
+	}
+	return res, nil
+}
+
+func (fr *fakeResolver) callCount() int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.calls
+}
+
+func mustParse(t *testing.T, rawUrl string) *neturl.URL {
+	t.Helper()
+	u, err := neturl.Parse(rawUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestResolverRegistryLookup(t *testing.T) {
+	rr := newResolverRegistry()
+	yt := &youtubeResolver{client: &fakeYoutubeClient{}}
+	videos := &fakeResolver{name: "videos", host: "video.example"}
+	rr.Register(yt)
+	rr.Register(videos)
+
+	tests := []struct {
+		url  string
+		want Resolver
+	}{
+		{"https://video.example/watch/1", videos},
+		{"https://www.youtube.com/watch?v=abc", yt},
+		{"https://youtu.be/abc", yt},
+		{"https://files.example/file.zip", nil},
+	}
+	for _, tt := range tests {
+		if got := rr.lookup(mustParse(t, tt.url)); got != tt.want {
+			t.Errorf("lookup(%s) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+
+	//A resolver registered later takes over the sites of earlier ones
+	override := &fakeResolver{name: "override", host: "youtu.be"}
+	rr.Register(override)
+	if got := rr.lookup(mustParse(t, "https://youtu.be/abc")); got != override {
+		t.Errorf("lookup after override = %v, want the override", got)
+	}
+	if got := rr.lookup(mustParse(t, "https://www.youtube.com/watch?v=abc")); got != yt {
+		t.Errorf("override took hosts it doesn't match: %v", got)
+	}
+}
+
+func TestUrlExpiry(t *testing.T) {
+	tests := []struct {
+		url  string
+		want time.Time
+	}{
+		{"https://rr1.googlevideo.com/videoplayback?expire=1760000000&sig=x", time.Unix(1760000000, 0)},
+		{"https://d111.cloudfront.net/f.mp4?Expires=1760000000&Signature=x", time.Unix(1760000000, 0)},
+		{"https://bucket.s3.amazonaws.com/f?X-Amz-Date=20261018T120000Z&X-Amz-Expires=3600&X-Amz-Signature=x", time.Date(2026, 10, 18, 13, 0, 0, 0, time.UTC)},
+		{"https://storage.googleapis.com/b/f?X-Goog-Date=20261018T120000Z&X-Goog-Expires=60", time.Date(2026, 10, 18, 12, 1, 0, 0, time.UTC)},
+		{"https://acct.blob.core.windows.net/c/f?se=2026-10-18T12:00:00Z&sig=x", time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)},
+		{"https://acct.blob.core.windows.net/c/f?se=2026-10-18T12:00:00Z", time.Time{}},
+		{"https://files.example/file.zip", time.Time{}},
+	}
+	for _, tt := range tests {
+		if got := urlExpiry(mustParse(t, tt.url)); !got.Equal(tt.want) {
+			t.Errorf("urlExpiry(%s) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestLinkRefresher(t *testing.T) {
+	content := testContent(1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("token") {
+		case "missing":
+			http.NotFound(w, r)
+			return
+		case "changed":
+			w.Header().Set("ETag", `"v2"`)
+		default:
+			w.Header().Set("ETag", `"v1"`)
+		}
+		http.ServeContent(w, r, "v", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+	remote := remoteValidators{ETag: `"v1"`, Size: int64(len(content))}
+
+	dm := newTestManager(t)
+	fr := &fakeResolver{name: "videos", host: "video.example", urls: []string{srv.URL + "/v?token=1", srv.URL + "/v?token=2"}}
+	dm.RegisterResolver(fr)
+	dm.Tasks = []Task{
+		{ID: "pasted", Url: srv.URL + "/v?token=0"},
+		{ID: "resolved", Url: "https://video.example/watch/1", Quality: "720p", Resolved: &Resolution{Urls: []string{srv.URL + "/v?token=0"}}},
+	}
+
+	if lr := dm.newLinkRefresher("pasted", srv.Client(), remote); lr != nil {
+		t.Fatal("got a refresher for a link no resolver handed out")
+	}
+	lr := dm.newLinkRefresher("resolved", srv.Client(), remote)
+	if lr == nil {
+		t.Fatal("no refresher for a resolved task")
+	}
+
+	mirrors := newMirrorPool(srv.URL+"/v?token=0", "")
+	if err := lr.refresh(context.Background(), mirrors, srv.URL+"/v?token=0"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mirrors.urlOf(mirrors.mirrors[0]); got != srv.URL+"/v?token=1" {
+		t.Errorf("primary is %s after a refresh", got)
+	}
+	if got := mirrors.ifRangeOf(mirrors.mirrors[0]); got != `"v1"` {
+		t.Errorf("primary sends If-Range %s after a refresh", got)
+	}
+	if got := dm.Tasks[1].Resolved; got.Urls[0] != srv.URL+"/v?token=1" || got.Variant != "720p" {
+		t.Errorf("saved resolution %+v", got)
+	}
+
+	//Parts that failed on the old link don't resolve again
+	if err := lr.refresh(context.Background(), mirrors, srv.URL+"/v?token=0"); err != nil || fr.callCount() != 1 {
+		t.Errorf("stale refresh: err %v, %d lookups", err, fr.callCount())
+	}
+
+	for i := 1; i < maxLinkRefreshes; i++ {
+		if err := lr.refresh(context.Background(), mirrors, mirrors.urlOf(mirrors.mirrors[0])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lr.refresh(context.Background(), mirrors, mirrors.urlOf(mirrors.mirrors[0])); !errors.Is(err, errLinkExpired) {
+		t.Errorf("refresh %d: got %v, want it to give up", maxLinkRefreshes+1, err)
+	}
+
+	//A fresh link to another version of the file restarts the download from it
+	fr.urls = []string{srv.URL + "/v?token=changed"}
+	lr = dm.newLinkRefresher("resolved", srv.Client(), remote)
+	if err := lr.refresh(context.Background(), mirrors, mirrors.urlOf(mirrors.mirrors[0])); !errors.Is(err, errRemoteChanged) {
+		t.Errorf("changed file: got %v", err)
+	}
+	if got := mirrors.urlOf(mirrors.mirrors[0]); got != srv.URL+"/v?token=changed" {
+		t.Errorf("primary is %s after a refresh to a changed file", got)
+	}
+
+	fr.urls = []string{srv.URL + "/v?token=missing"}
+	lr = dm.newLinkRefresher("resolved", srv.Client(), remote)
+	if err := lr.refresh(context.Background(), mirrors, mirrors.urlOf(mirrors.mirrors[0])); !errors.Is(err, errLinkExpired) || !strings.Contains(err.Error(), "404") {
+		t.Errorf("dead fresh link: got %v", err)
+	}
+
+	fr.err = errors.New("page gone")
+	lr = dm.newLinkRefresher("resolved", srv.Client(), remote)
+	if err := lr.refresh(context.Background(), mirrors, mirrors.urlOf(mirrors.mirrors[0])); !errors.Is(err, errLinkExpired) || !strings.Contains(err.Error(), "page gone") {
+		t.Errorf("failed lookup: got %v", err)
+	}
+}
+
+// TestResolvedDownloadRefreshesExpiredLink downloads a page whose first
+// link is refused, and expects the parts to carry on over a fresh one.
+func TestResolvedDownloadRefreshesExpiredLink(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Query().Get("token") != "fresh" {
+			http.Error(w, "signature expired", http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "clip.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	dm := newTestManager(t)
+	expires := time.Now().Add(time.Hour).Unix()
+	fr := &fakeResolver{name: "videos", host: "video.example", fileName: "clip.bin", urls: []string{
+		fmt.Sprintf("%s/clip?token=stale&expires=%d", srv.URL, expires),
+		fmt.Sprintf("%s/clip?token=fresh&expires=%d", srv.URL, expires),
+	}}
+	dm.RegisterResolver(fr)
+	dm.Tasks = []Task{{ID: "t1", Url: "https://video.example/watch/1", Status: "Downloading"}}
+
+	dm.download(context.Background(), "t1", mustParse(t, dm.Tasks[0].Url))
+
+	if dm.Tasks[0].Status != "Completed" {
+		t.Fatalf("task ended %s", dm.Tasks[0].Status)
+	}
+	if n := fr.callCount(); n != 2 {
+		t.Errorf("resolved %d times, want once to start and once on expiry", n)
+	}
+	if !strings.Contains(dm.Tasks[0].Resolved.Urls[0], "token=fresh") {
+		t.Errorf("saved resolution still points at %s", dm.Tasks[0].Resolved.Urls[0])
+	}
+	got, err := os.ReadFile(filepath.Join("downloads", "clip.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("downloaded %d bytes that differ from the %d served", len(got), len(content))
+	}
+}
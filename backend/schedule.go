@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ScheduleWindow is a stretch of the week in which the queue is run or held
+// and a bandwidth mode applies, such as snail on weekdays from 09:00 to 18:00.
+type ScheduleWindow struct {
+	Days  []string `json:"days"`  // "mon" to "sun", every day when empty
+	Start string   `json:"start"` // "15:04" in local time
+	End   string   `json:"end"`   // before Start for a window that runs past midnight, equal to it for the whole day
+	Queue string   `json:"queue"` // "start" runs the queue, "stop" holds it, "" leaves it alone
+	Mode  string   `json:"mode"`  // snail, auto or turbo, "" keeps the mode that is set
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w ScheduleWindow) validate() error {
+	for _, day := range w.Days {
+		if !slices.Contains(weekdays, strings.ToLower(day)) {
+			return fmt.Errorf("invalid day %q", day)
+		}
+	}
+	if _, err := parseClock(w.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(w.End); err != nil {
+		return err
+	}
+	switch w.Queue {
+	case "", "start", "stop":
+	default:
+		return fmt.Errorf("invalid queue action %q", w.Queue)
+	}
+	switch w.Mode {
+	case "", "snail", "auto", "turbo":
+	default:
+		return fmt.Errorf("invalid mode %q", w.Mode)
+	}
+	return nil
+}
+
+func (w ScheduleWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if strings.EqualFold(d, weekdays[day]) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether t falls in the window. A window past midnight
+// belongs to the day it starts on.
+func (w ScheduleWindow) contains(t time.Time) bool {
+	start, err := parseClock(w.Start)
+	end, err2 := parseClock(w.End)
+	if err != nil || err2 != nil {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	switch {
+	case start < end:
+		return w.onDay(day) && minute >= start && minute < end
+	case start > end:
+		return (w.onDay(day) && minute >= start) || (w.onDay((day+6)%7) && minute < end)
+	default:
+		return w.onDay(day)
+	}
+}
+
+func validateSchedule(windows []ScheduleWindow) error {
+	for i, w := range windows {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("schedule window %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// scheduleState is what the schedule asks for at some moment.
+type scheduleState struct {
+	hold bool   // the queue waits, running downloads are paused
+	mode string // "" for the mode the user set
+}
+
+// stateAt works out the schedule at t. Where windows overlap the later one
+// wins. When some window starts the queue, the queue is held outside of
+// those windows.
+func stateAt(windows []ScheduleWindow, t time.Time) scheduleState {
+	var state scheduleState
+	queue := ""
+	for _, w := range windows {
+		if w.Queue == "start" {
+			state.hold = true
+		}
+		if !w.contains(t) {
+			continue
+		}
+		if w.Queue != "" {
+			queue = w.Queue
+		}
+		if w.Mode != "" {
+			state.mode = w.Mode
+		}
+	}
+	switch queue {
+	case "start":
+		state.hold = false
+	case "stop":
+		state.hold = true
+	}
+	return state
+}
+
+// scheduler applies Settings.Schedule while Settings.Scheduler is on. It
+// only acts when the schedule changes, so pausing or resuming a download by
+// hand within a window sticks until the next one.
+type scheduler struct {
+	dm  *DownloadManager
+	now func() time.Time // the clock, time.Now outside of tests
+
+	state     scheduleState // last applied
+	savedMode string        // the user's mode, put back when a window's mode ends
+	held      atomic.Bool   // state.hold, for readers that can't wait for a tick
+
+	mu     sync.Mutex
+	stopCh chan struct{}
+}
+
+func newScheduler(dm *DownloadManager) *scheduler {
+	return &scheduler{dm: dm, now: time.Now, stopCh: make(chan struct{})}
+}
+
+// Start applies the schedule now and then every 15 seconds.
+func (s *scheduler) Start() {
+	s.tick()
+	go func() {
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopCh:
+				return
+			case <-ticker.C:
+				s.tick()
+			}
+		}
+	}()
+}
+
+func (s *scheduler) Stop() {
+	close(s.stopCh)
+}
+
+// holding reports whether the schedule holds the queue, new downloads wait
+// as Queued then.
+func (s *scheduler) holding() bool {
+	return s.held.Load()
+}
+
+// tick brings the downloads and the bandwidth mode in line with the
+// schedule.
+func (s *scheduler) tick() {
+	s.dm.dataMutex.Lock()
+	var want scheduleState
+	if s.dm.settings.Scheduler {
+		want = stateAt(s.dm.settings.Schedule, s.now())
+	}
+	s.dm.dataMutex.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	was := s.state
+	s.state = want
+	s.held.Store(want.hold)
+	if want.mode != was.mode {
+		if was.mode == "" {
+			s.savedMode = s.dm.limiter.Mode()
+		}
+		mode := want.mode
+		if mode == "" {
+			mode = s.savedMode
+		}
+		log.Println("Schedule sets bandwidth mode to", mode)
+		s.dm.limiter.SetMode(mode)
+	}
+
+	if want.hold && !was.hold {
+		log.Println("Schedule holds the queue")
+		s.dm.holdQueue("Queued")
+	} else if !want.hold && was.hold {
+		log.Println("Schedule runs the queue")
+		s.dm.runQueue("Queued")
+	}
+}
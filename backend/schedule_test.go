@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// at is a local time on day of the week from Sunday 2026-10-18 on.
+func at(day time.Weekday, clock string) time.Time {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		panic(err)
+	}
+	return time.Date(2026, 10, 18+int(day), t.Hour(), t.Minute(), 0, 0, time.Local)
+}
+
+func TestScheduleWindowContains(t *testing.T) {
+	weekdays := ScheduleWindow{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "18:00"}
+	fridayNight := ScheduleWindow{Days: []string{"fri"}, Start: "23:00", End: "06:00"}
+	sundayNight := ScheduleWindow{Days: []string{"Sun"}, Start: "22:00", End: "02:00"}
+	saturdayNight := ScheduleWindow{Days: []string{"sat"}, Start: "22:00", End: "02:00"}
+	sunday := ScheduleWindow{Days: []string{"sun"}, Start: "00:00", End: "00:00"}
+	nightly := ScheduleWindow{Start: "01:00", End: "07:00"}
+
+	tests := []struct {
+		name   string
+		window ScheduleWindow
+		t      time.Time
+		want   bool
+	}{
+		{"before the start", weekdays, at(time.Monday, "08:59"), false},
+		{"at the start", weekdays, at(time.Monday, "09:00"), true},
+		{"before the end", weekdays, at(time.Friday, "17:59"), true},
+		{"at the end", weekdays, at(time.Friday, "18:00"), false},
+		{"other day", weekdays, at(time.Saturday, "12:00"), false},
+		{"overnight before midnight", fridayNight, at(time.Friday, "23:30"), true},
+		{"overnight after midnight belongs to the day before", fridayNight, at(time.Saturday, "05:59"), true},
+		{"overnight end", fridayNight, at(time.Saturday, "06:00"), false},
+		{"overnight on the next evening", fridayNight, at(time.Saturday, "23:30"), false},
+		{"overnight morning of its own day", fridayNight, at(time.Friday, "05:00"), false},
+		{"wraps from sunday into monday", sundayNight, at(time.Monday, "01:00"), true},
+		{"not from monday into tuesday", sundayNight, at(time.Tuesday, "01:00"), false},
+		{"wraps from saturday into sunday", saturdayNight, at(time.Sunday, "01:59"), true},
+		{"not from friday into saturday", saturdayNight, at(time.Saturday, "01:00"), false},
+		{"whole day from midnight", sunday, at(time.Sunday, "00:00"), true},
+		{"whole day until midnight", sunday, at(time.Sunday, "23:59"), true},
+		{"whole day not the next", sunday, at(time.Monday, "00:00"), false},
+		{"no days is every day", nightly, at(time.Wednesday, "03:00"), true},
+		{"no days outside the hours", nightly, at(time.Wednesday, "08:00"), false},
+	}
+	for _, tt := range tests {
+		if got := tt.window.contains(tt.t); got != tt.want {
+			t.Errorf("%s: contains(%s) = %v, want %v", tt.name, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestStateAt(t *testing.T) {
+	windows := []ScheduleWindow{
+		{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "18:00", Mode: "snail"},
+		{Start: "23:00", End: "07:00", Queue: "start", Mode: "turbo"},
+		{Days: []string{"sat"}, Start: "00:00", End: "00:00", Queue: "stop"},
+	}
+	tests := []struct {
+		name string
+		t    time.Time
+		want scheduleState
+	}{
+		{"outside every start window the queue is held", at(time.Monday, "20:00"), scheduleState{hold: true}},
+		{"a window's mode applies while it holds", at(time.Monday, "10:00"), scheduleState{hold: true, mode: "snail"}},
+		{"start window runs the queue", at(time.Monday, "23:30"), scheduleState{mode: "turbo"}},
+		{"start window past midnight", at(time.Tuesday, "06:59"), scheduleState{mode: "turbo"}},
+		{"held again when it ends", at(time.Tuesday, "07:00"), scheduleState{hold: true}},
+		{"the later window wins", at(time.Saturday, "02:00"), scheduleState{hold: true, mode: "turbo"}},
+		{"friday night runs into the stop window", at(time.Saturday, "00:30"), scheduleState{hold: true, mode: "turbo"}},
+	}
+	for _, tt := range tests {
+		if got := stateAt(windows, tt.t); got != tt.want {
+			t.Errorf("%s: stateAt(%s) = %+v, want %+v", tt.name, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+
+	//With only stop windows the queue runs outside of them
+	stops := []ScheduleWindow{{Start: "09:00", End: "17:00", Queue: "stop"}}
+	if got := stateAt(stops, at(time.Monday, "08:00")); got.hold {
+		t.Error("held outside the only stop window")
+	}
+	if got := stateAt(stops, at(time.Monday, "12:00")); !got.hold {
+		t.Error("ran inside the stop window")
+	}
+	if got := stateAt(nil, at(time.Monday, "12:00")); got != (scheduleState{}) {
+		t.Errorf("empty schedule gives %+v", got)
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	valid := []ScheduleWindow{{Days: []string{"Mon"}, Start: "22:00", End: "06:00", Queue: "start", Mode: "turbo"}}
+	if err := validateSchedule(valid); err != nil {
+		t.Errorf("valid schedule: %v", err)
+	}
+	for _, w := range []ScheduleWindow{
+		{Days: []string{"monday"}, Start: "09:00", End: "17:00"},
+		{Start: "9am", End: "17:00"},
+		{Start: "09:00", End: "24:00"},
+		{Start: "09:00", End: "17:00", Queue: "pause"},
+		{Start: "09:00", End: "17:00", Mode: "fast"},
+	} {
+		if err := validateSchedule([]ScheduleWindow{w}); err == nil {
+			t.Errorf("accepted %+v", w)
+		}
+	}
+}
+
+// waitForStatus polls until the task with id has status, the way a client
+// following the WebSocket would see it.
+func waitForStatus(t *testing.T, dm *DownloadManager, id string, status string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dm.dataMutex.Lock()
+		var got string
+		for i := range dm.Tasks {
+			if dm.Tasks[i].ID == id {
+				got = dm.Tasks[i].Status
+			}
+		}
+		dm.dataMutex.Unlock()
+		if got == status {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task %s is %s, want %s", id, got, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSchedulerTick(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 256*1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	dm := newTestManager(t)
+	now := at(time.Monday, "21:00")
+	dm.scheduler.now = func() time.Time { return now }
+	dm.settings.Scheduler = true
+	dm.settings.Schedule = []ScheduleWindow{{Start: "23:00", End: "06:00", Queue: "start", Mode: "turbo"}}
+	dm.limiter.SetMode("snail")
+
+	running := srv.URL + "/file.bin"
+	dm.Tasks = []Task{{ID: running, Url: running, Status: "Downloading"}}
+	stopped := make(chan struct{})
+	dm.launch(running, func(ctx context.Context) {
+		<-ctx.Done()
+		close(stopped)
+	})
+
+	//Outside the window the running download is held
+	dm.scheduler.tick()
+	<-stopped
+	if got := dm.Tasks[0].Status; got != "Queued" {
+		t.Fatalf("held download is %s", got)
+	}
+	if dm.heldStatus() != "Queued" {
+		t.Error("new downloads would not wait")
+	}
+	if got := dm.limiter.Mode(); got != "snail" {
+		t.Errorf("mode %s outside any window's mode", got)
+	}
+
+	//A tick without a change leaves downloads the user resumed alone
+	dm.Tasks[0].Status = "Paused"
+	dm.scheduler.tick()
+	if got := dm.Tasks[0].Status; got != "Paused" {
+		t.Errorf("unchanged schedule moved a paused task to %s", got)
+	}
+	dm.Tasks[0].Status = "Queued"
+
+	//The window runs the queue in its mode
+	now = at(time.Monday, "23:00")
+	dm.scheduler.tick()
+	if dm.heldStatus() != "" {
+		t.Error("queue still held inside the window")
+	}
+	if got := dm.limiter.Mode(); got != "turbo" {
+		t.Errorf("mode %s inside the window", got)
+	}
+	waitForStatus(t, dm, running, "Completed")
+
+	//Past the window the user's mode comes back
+	now = at(time.Tuesday, "06:00")
+	dm.scheduler.tick()
+	if got := dm.limiter.Mode(); got != "snail" {
+		t.Errorf("mode %s after the window, want the user's", got)
+	}
+	if dm.heldStatus() != "Queued" {
+		t.Error("queue not held after the window")
+	}
+
+	//Turning the scheduler off runs the queue
+	dm.settings.Scheduler = false
+	dm.scheduler.tick()
+	if dm.heldStatus() != "" {
+		t.Error("queue held with the scheduler off")
+	}
+}
+
+// TestResumeWhileHeld resumes a download while the schedule holds the queue,
+// which says why it waits, and once more with force.
+func TestResumeWhileHeld(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 64*1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	gin.SetMode(gin.TestMode)
+	dm := newTestManager(t)
+	dm.settings.ForceHttps = false
+	dm.settings.Scheduler = true
+	dm.settings.Schedule = []ScheduleWindow{{Start: "00:00", End: "00:00", Queue: "stop"}}
+	dm.scheduler.tick()
+	r := gin.New()
+	r.POST("/resume", dm.ResumeDownloadHandler)
+
+	fileUrl := srv.URL + "/file.bin"
+	dm.Tasks = []Task{{ID: fileUrl, Url: fileUrl, Status: "Paused"}}
+	resume := func(body string) map[string]any {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/resume", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		var reply map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("resume gave %d %s", rec.Code, rec.Body)
+		}
+		return reply
+	}
+
+	reply := resume(`{"url":"` + fileUrl + `"}`)
+	if reply["status"] != "Queued" || !strings.Contains(reply["message"].(string), "schedule") {
+		t.Errorf("held resume answered %v", reply)
+	}
+	if got := dm.Tasks[0].Status; got != "Queued" {
+		t.Errorf("held resume left the task %s", got)
+	}
+
+	if reply := resume(`{"url":"` + fileUrl + `","force":true}`); reply["message"] != "Download started" {
+		t.Errorf("forced resume answered %v", reply)
+	}
+	waitForStatus(t, dm, fileUrl, "Completed")
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Ranges smaller than this are not worth another connection, so an idle
+// worker only steals from a part with at least twice this much left.
+const minStealSize = 1024 * 1024
+
+// Part struct for handling chunks. End can shrink while the download is
+// running when an idle worker takes over the tail of the range.
+type Part struct {
+	Index int   `json:"index"`
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+
+	done    int64 // bytes written to disk
+	claimed int64 // bytes handed to the writer, always >= done
+	durable int64 // bytes known to be flushed, what the manifest records
+	active  bool
+	failed  bool
+}
+
+func (p *Part) size() int64 {
+	return p.End - p.Start + 1
+}
+
+func (p *Part) complete() bool {
+	return p.End >= 0 && p.done >= p.size()
+}
+
+// segmentTracker owns the part layout of one download. Every access to a
+// Part's boundaries goes through it since workers split ranges concurrently.
+type segmentTracker struct {
+	taskId   string
+	manifest taskManifest // everything but the parts, which live here
+	parts    []*Part
+	// Bumped whenever written bytes are dropped or parts move, so a
+	// checkpoint taken before that is not applied to the new layout
+	generation int
+	mu         sync.Mutex
+}
+
+func newSegmentTracker(taskId string, m *taskManifest) *segmentTracker {
+	t := &segmentTracker{taskId: taskId, manifest: *m}
+	parts := m.parts()
+	for i := range parts {
+		p := parts[i]
+		t.parts = append(t.parts, &p)
+	}
+	return t
+}
+
+// next hands out a part nobody is working on, or splits the largest
+// remaining range of a running part in half. Nil means nothing is left.
+func (t *segmentTracker) next() *Part {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, p := range t.parts {
+		if !p.active && !p.failed && !p.complete() {
+			p.active = true
+			return p
+		}
+	}
+
+	var victim *Part
+	var largest int64
+	for _, p := range t.parts {
+		if !p.active || p.End < 0 {
+			continue
+		}
+		remaining := p.End - (p.Start + p.claimed) + 1
+		if remaining > largest {
+			victim = p
+			largest = remaining
+		}
+	}
+	if victim == nil || largest < 2*minStealSize {
+		return nil
+	}
+
+	mid := victim.Start + victim.claimed + largest/2
+	stolen := &Part{Index: len(t.parts), Start: mid, End: victim.End, active: true}
+	victim.End = mid - 1
+	t.parts = append(t.parts, stolen)
+	log.Printf("Part %d split at %d, part %d takes over the rest", victim.Index, mid, stolen.Index)
+
+	// Persist before the new part writes anything. If we crash before this,
+	// the old layout is still valid because the victim never writes past mid.
+	t.saveLocked()
+	return stolen
+}
+
+// reset syncs a part with the bytes already on disk before a (re)try.
+func (t *segmentTracker) reset(p *Part, onDisk int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p.End >= 0 && onDisk > p.size() {
+		onDisk = p.size()
+	}
+	p.done = onDisk
+	p.claimed = onDisk
+	p.durable = onDisk
+}
+
+// rewind drops claims that never made it to disk, so a retry in direct
+// mode continues right after the last written byte.
+func (t *segmentTracker) rewind(p *Part) {
+	t.mu.Lock()
+	p.claimed = p.done
+	t.mu.Unlock()
+}
+
+// bounds returns the next offset to fetch and the current end of the part.
+func (t *segmentTracker) bounds(p *Part) (int64, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return p.Start + p.claimed, p.End
+}
+
+// claim reserves up to n bytes for writing. It returns the file offset to
+// write at and how many bytes fit before the (possibly shrunk) end of the part.
+func (t *segmentTracker) claim(p *Part, n int) (int64, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p.End >= 0 {
+		left := p.size() - p.claimed
+		if left < int64(n) {
+			n = int(max(left, 0))
+		}
+	}
+	offset := p.Start + p.claimed
+	p.claimed += int64(n)
+	return offset, n
+}
+
+func (t *segmentTracker) commit(p *Part, n int) {
+	t.mu.Lock()
+	p.done += int64(n)
+	t.mu.Unlock()
+}
+
+// reached reports whether the part has everything up to its current end.
+func (t *segmentTracker) reached(p *Part) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return p.complete()
+}
+
+func (t *segmentTracker) finish(p *Part) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p.End < 0 {
+		// Unknown size, the stream ended where the server stopped sending
+		p.End = p.Start + p.done - 1
+	}
+	p.active = false
+}
+
+func (t *segmentTracker) fail(p *Part) {
+	t.mu.Lock()
+	p.active = false
+	p.failed = true
+	t.mu.Unlock()
+}
+
+// covered reports whether every byte of [start, end] has been written and the
+// range can be refetched safely. A running part whose range ends inside it
+// is about to finish and is left alone until it has.
+func (t *segmentTracker) covered(start int64, end int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range t.parts {
+		if p.End < start || p.Start > end {
+			continue
+		}
+		upTo := min(end, p.End)
+		if p.Start+p.done-1 < upTo {
+			return false
+		}
+		if p.active && upTo == p.End {
+			return false
+		}
+	}
+	return true
+}
+
+// refetch splits the parts over [start, end] so the range becomes parts of
+// its own with nothing written, for the workers to download again. A running
+// part always keeps the piece of its range its writer is in. It returns how
+// many written bytes were dropped. Only used in direct mode, where a part's
+// data does not depend on its boundaries.
+func (t *segmentTracker) refetch(start int64, end int64) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.generation++
+	var dropped int64
+	for _, p := range append([]*Part(nil), t.parts...) {
+		if p.End < start || p.Start > end {
+			continue
+		}
+		from, to := max(p.Start, start), min(p.End, end)
+		if from > p.Start {
+			head := &Part{Index: len(t.parts), Start: p.Start, End: from - 1}
+			head.done = head.size()
+			head.claimed = head.size()
+			head.durable = min(p.durable, head.size())
+			t.parts = append(t.parts, head)
+			p.shift(from)
+		}
+		if to < p.End {
+			t.parts = append(t.parts, &Part{Index: len(t.parts), Start: from, End: to})
+			dropped += to - from + 1
+			p.shift(to + 1)
+		} else {
+			dropped += p.done
+			p.done = 0
+			p.claimed = 0
+			p.durable = 0
+			p.failed = false
+		}
+	}
+	t.saveLocked()
+	return dropped
+}
+
+// shift moves the start of a part forward, keeping its write position.
+func (p *Part) shift(newStart int64) {
+	delta := newStart - p.Start
+	p.Start = newStart
+	p.done -= delta
+	p.claimed -= delta
+	p.durable = max(p.durable-delta, 0)
+}
+
+func (t *segmentTracker) downloaded() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var total int64
+	for _, p := range t.parts {
+		total += p.done
+	}
+	return total
+}
+
+func (t *segmentTracker) allComplete() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range t.parts {
+		if !p.complete() {
+			return false
+		}
+	}
+	return true
+}
+
+// layout returns a copy of the parts ordered by file offset.
+func (t *segmentTracker) layout() []Part {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.layoutLocked()
+}
+
+func (t *segmentTracker) layoutLocked() []Part {
+	parts := make([]Part, len(t.parts))
+	for i, p := range t.parts {
+		parts[i] = *p
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Start < parts[j].Start })
+	return parts
+}
+
+func (t *segmentTracker) save() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.saveLocked()
+}
+
+// checkpoint flushes the output file and then records how far each part
+// got. Progress is snapshotted before the flush so the manifest never
+// claims bytes that might still be sitting in the page cache. A snapshot
+// that a refetch overtook during the flush is thrown away, the bytes it
+// counted may have been dropped or belong to other offsets now.
+func (t *segmentTracker) checkpoint(out *os.File) {
+	t.mu.Lock()
+	generation := t.generation
+	written := make([]int64, len(t.parts))
+	for i, p := range t.parts {
+		written[i] = p.done
+	}
+	t.mu.Unlock()
+
+	if err := out.Sync(); err != nil {
+		log.Println("Error flushing output file:", err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.generation != generation {
+		return
+	}
+	for i := range written {
+		t.parts[i].durable = min(written[i], t.parts[i].done)
+	}
+	t.saveLocked()
+}
+
+func (t *segmentTracker) saveLocked() {
+	m := t.manifest
+	m.Parts = nil
+	for _, p := range t.layoutLocked() {
+		done := p.done
+		if m.Output != "" {
+			done = p.durable
+		}
+		m.Parts = append(m.Parts, partRecord{Index: p.Index, Start: p.Start, End: p.End, Done: done})
+	}
+	if err := writeManifest(t.taskId, &m); err != nil {
+		log.Println("Error saving manifest:", err)
+	}
+}
+
+func partFileName(taskId string, index int) string {
+	return fmt.Sprintf("%s_part_%d.tmp", taskHash(taskId), index)
+}
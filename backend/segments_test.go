@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+const mib = 1024 * 1024
+
+func TestNextSplitsTheLargestPart(t *testing.T) {
+	t.Chdir(t.TempDir())
+	tracker := newSegmentTracker("https://example.com/file.bin", &taskManifest{Parts: []partRecord{{Index: 0, Start: 0, End: 16*mib - 1}}})
+
+	first := tracker.next()
+	if first == nil || first.Index != 0 {
+		t.Fatalf("first part is %+v", first)
+	}
+	tracker.reset(first, 2*mib)
+
+	//An idle worker takes the second half of what part 0 has left
+	stolen := tracker.next()
+	if stolen == nil {
+		t.Fatal("no part split off a running one")
+	}
+	if stolen.Start != 9*mib || stolen.End != 16*mib-1 {
+		t.Errorf("split off %d-%d, want %d-%d", stolen.Start, stolen.End, 9*mib, 16*mib-1)
+	}
+	if first.End != 9*mib-1 {
+		t.Errorf("part 0 ends at %d, want %d", first.End, 9*mib-1)
+	}
+	if !tiles(tracker.layout(), 16*mib) {
+		t.Errorf("parts no longer tile the file: %+v", tracker.layout())
+	}
+
+	//Each half is still worth splitting
+	if p := tracker.next(); p == nil || p.Index != 2 {
+		t.Errorf("third worker got %+v", p)
+	}
+}
+
+func TestNextLeavesSmallPartsAlone(t *testing.T) {
+	t.Chdir(t.TempDir())
+	tracker := newSegmentTracker("https://example.com/file.bin", &taskManifest{Parts: []partRecord{{Index: 0, Start: 0, End: 2*minStealSize - 2}}})
+	if p := tracker.next(); p == nil {
+		t.Fatal("no part handed out")
+	}
+	if p := tracker.next(); p != nil {
+		t.Errorf("split a part with less than twice the minimum left: %+v", p)
+	}
+
+	//Parts of unknown size have no middle to split at
+	unknown := newSegmentTracker("https://example.com/stream", &taskManifest{Parts: []partRecord{{Index: 0, Start: 0, End: -1}}})
+	unknown.next()
+	if p := unknown.next(); p != nil {
+		t.Errorf("split a part of unknown size: %+v", p)
+	}
+}
+
+// tiles tells if parts cover size bytes without gaps or overlaps.
+func tiles(parts []Part, size int64) bool {
+	var next int64
+	for _, p := range parts {
+		if p.Start != next {
+			return false
+		}
+		next = p.End + 1
+	}
+	return next == size
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mediaSegment is one file, or byte range of a file, of a segmented stream
+// such as HLS or DASH.
+type mediaSegment struct {
+	Url    string      `json:"url"`
+	Offset int64       `json:"offset,omitempty"`
+	Length int64       `json:"length,omitempty"` // 0 fetches the whole resource
+	Key    *segmentKey `json:"key,omitempty"`
+}
+
+// segmentKey is the AES-128 key a segment is encrypted with, as HLS does it.
+type segmentKey struct {
+	Url string `json:"url"`
+	IV  []byte `json:"iv"`
+}
+
+// streamTrack becomes one output file, its segments joined in order.
+type streamTrack struct {
+	FileName string         `json:"fileName"`
+	Segments []mediaSegment `json:"segments"`
+}
+
+// streamManifest is saved with the segments of an unfinished stream, so a
+// resume keeps them only if it picked the same variant again.
+type streamManifest struct {
+	Source string        `json:"source"` // the variant or representation picked
+	Tracks []streamTrack `json:"tracks"`
+}
+
+// sameLayout reports whether o lists the very segments of s. A live or
+// rewritten playlist can keep the count while its segments move on.
+func (s *streamManifest) sameLayout(o *streamManifest) bool {
+	if s.Source != o.Source || len(s.Tracks) != len(o.Tracks) {
+		return false
+	}
+	for i := range s.Tracks {
+		if len(s.Tracks[i].Segments) != len(o.Tracks[i].Segments) {
+			return false
+		}
+		for j, seg := range s.Tracks[i].Segments {
+			other := o.Tracks[i].Segments[j]
+			if seg.Url != other.Url || seg.Offset != other.Offset || seg.Length != other.Length {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *streamManifest) segmentCount() int {
+	count := 0
+	for _, t := range s.Tracks {
+		count += len(t.Segments)
+	}
+	return count
+}
+
+func streamDirName(taskId string) string {
+	return fmt.Sprintf("%s_segments", taskHash(taskId))
+}
+
+func segmentFileName(taskId string, track int, index int) string {
+	return filepath.Join(streamDirName(taskId), fmt.Sprintf("%d_%05d.seg", track, index))
+}
+
+func loadStreamManifest(taskId string) *streamManifest {
+	bytes, err := os.ReadFile(filepath.Join(streamDirName(taskId), "stream.json"))
+	if err != nil {
+		return nil
+	}
+	var s streamManifest
+	if err := json.Unmarshal(bytes, &s); err != nil {
+		return nil
+	}
+	return &s
+}
+
+func writeStreamManifest(taskId string, s *streamManifest) error {
+	bytes, err := json.MarshalIndent(s, "", " ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(streamDirName(taskId), "stream.json"), bytes, 0644)
+}
+
+// streamVariant is what quality selection looks at in an HLS variant or a
+// DASH representation.
+type streamVariant struct {
+	Bandwidth int64
+	Width     int
+	Height    int
+}
+
+func (v streamVariant) String() string {
+	if v.Height > 0 {
+		return fmt.Sprintf("%dx%d %d kbps", v.Width, v.Height, v.Bandwidth/1000)
+	}
+	return fmt.Sprintf("%d kbps", v.Bandwidth/1000)
+}
+
+// pickVariant returns the index of the variant that fits quality best:
+// "best" (the default) or "worst" by bandwidth, or a height such as "720p"
+// for the best variant up to that height.
+func pickVariant(variants []streamVariant, quality string) int {
+	quality = strings.ToLower(strings.TrimSpace(quality))
+	maxHeight := 0
+	if h, err := strconv.Atoi(strings.TrimSuffix(quality, "p")); err == nil {
+		maxHeight = h
+	}
+
+	best := -1
+	for i, v := range variants {
+		if maxHeight > 0 && v.Height > maxHeight {
+			continue
+		}
+		if best < 0 ||
+			(quality == "worst" && v.Bandwidth < variants[best].Bandwidth) ||
+			(quality != "worst" && v.Bandwidth > variants[best].Bandwidth) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		return best
+	}
+
+	//Nothing is small enough, take the smallest there is
+	best = 0
+	for i, v := range variants {
+		if v.Bandwidth < variants[best].Bandwidth {
+			best = i
+		}
+	}
+	return best
+}
+
+type segmentJob struct {
+	track int
+	index int
+}
+
+// downloadStream fetches the segments of every track in parallel, each into
+// a file of its own, and joins them once all are there. Finished segments
+// survive a pause, so a resume only fetches the missing ones.
+func (dm *DownloadManager) downloadStream(ctx context.Context, taskId string, stream *streamManifest) {
+	if saved := loadStreamManifest(taskId); saved == nil || !saved.sameLayout(stream) {
+		discardDownload(taskId)
+	}
+	if err := os.MkdirAll(streamDirName(taskId), 0755); err != nil {
+		dm.setTaskError(taskId, "Cannot create segment folder")
+		SendError(taskId, "Cannot create segment folder")
+		return
+	}
+	if err := writeStreamManifest(taskId, stream); err != nil {
+		log.Println("Error saving stream manifest:", err)
+	}
+
+	var opts requestOptions
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].ID == taskId {
+			opts = dm.Tasks[i].requestOptions()
+			break
+		}
+	}
+	dm.dataMutex.Unlock()
+
+	client := dm.httpClient()
+	fileName := stream.Tracks[0].FileName
+	total := stream.segmentCount()
+
+	//Segments already on disk count as done
+	var doneSegments, doneBytes, transferred int64
+	jobs := make(chan segmentJob, total)
+	for t, track := range stream.Tracks {
+		for i, seg := range track.Segments {
+			if stat, err := os.Stat(segmentFileName(taskId, t, i)); err == nil && seg.complete(stat.Size()) {
+				doneSegments++
+				doneBytes += stat.Size()
+				continue
+			}
+			jobs <- segmentJob{track: t, index: i}
+		}
+	}
+	close(jobs)
+	log.Printf("Stream has %d segments, %d already downloaded", total, doneSegments)
+
+	keys := &segmentKeys{keys: make(map[string][]byte)}
+	workerCtx, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+	errChan := make(chan error, dm.config.PartsPerFile)
+
+	var wg sync.WaitGroup
+	for range dm.config.PartsPerFile {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				seg := stream.Tracks[job.track].Segments[job.index]
+				err := dm.retry(workerCtx, fmt.Sprintf("Segment %d", job.index), func() error {
+					n, err := dm.downloadSegment(workerCtx, taskId, client, keys, seg, segmentFileName(taskId, job.track, job.index), opts, &transferred)
+					if err == nil {
+						atomic.AddInt64(&doneBytes, n)
+						atomic.AddInt64(&doneSegments, 1)
+					}
+					return err
+				}, nil)
+				if workerCtx.Err() != nil {
+					return
+				}
+				if err != nil {
+					errChan <- err
+					stopWorkers()
+					return
+				}
+			}
+		}()
+	}
+
+	//Progress goes by whole segments, the size is estimated from the ones done
+	estimate := func() (float64, int64) {
+		done := atomic.LoadInt64(&doneSegments)
+		percent := float64(done) / float64(total) * 100
+		if done == 0 {
+			return percent, 0
+		}
+		return percent, atomic.LoadInt64(&doneBytes) * int64(total) / done
+	}
+	stopProgress := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		lastBytes := atomic.LoadInt64(&transferred)
+		lastSent := time.Now()
+		for {
+			select {
+			case <-stopProgress:
+				return
+			case <-ticker.C:
+				currBytes := atomic.LoadInt64(&transferred)
+				speed := float64(currBytes-lastBytes) / time.Since(lastSent).Seconds()
+				percent, totalSize := estimate()
+				var eta float64
+				if speed > 0 && totalSize > 0 {
+					eta = float64(totalSize-atomic.LoadInt64(&doneBytes)) / speed
+				}
+				SendProgress(taskId, fileName, percent, totalSize, speed, eta)
+				lastBytes = currBytes
+				lastSent = time.Now()
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(stopProgress)
+	close(errChan)
+
+	if ctx.Err() != nil {
+		_, totalSize := estimate()
+		dm.dataMutex.Lock()
+		for i := range dm.Tasks {
+			if dm.Tasks[i].ID == taskId {
+				if !isHeld(dm.Tasks[i].Status) {
+					dm.Tasks[i].Status = "Paused"
+				}
+				dm.Tasks[i].Downloaded = atomic.LoadInt64(&doneBytes)
+				dm.Tasks[i].TotalSize = totalSize
+				break
+			}
+		}
+		dm.dataMutex.Unlock()
+		dm.SaveTasks()
+		log.Println("Download Paused")
+		return
+	}
+
+	if err := <-errChan; err != nil {
+		log.Println("Stream download failed:", err)
+		dm.setTaskError(taskId, "Download failed after retries")
+		SendError(taskId, "Download failed after retries")
+		return
+	}
+
+	var outputs []string
+	for t, track := range stream.Tracks {
+		outputPath, err := joinSegments(taskId, t, track, dm.config.DownloadDir)
+		if err != nil {
+			log.Println("Error joining segments:", err)
+			dm.setTaskError(taskId, "Cannot assemble file")
+			SendError(taskId, "Cannot assemble file")
+			return
+		}
+		outputs = append(outputs, outputPath)
+	}
+	os.RemoveAll(streamDirName(taskId))
+
+	size := atomic.LoadInt64(&doneBytes)
+	SendProgress(taskId, fileName, 100.0, size, 0, 0)
+	dm.dataMutex.Lock()
+	for i := range dm.Tasks {
+		if dm.Tasks[i].ID == taskId {
+			dm.Tasks[i].Status = "Completed"
+			dm.Tasks[i].FileName = filepath.Base(outputs[0])
+			dm.Tasks[i].Downloaded = size
+			dm.Tasks[i].TotalSize = size
+			break
+		}
+	}
+	dm.dataMutex.Unlock()
+	dm.SaveTasks()
+	log.Println("Download Complete:", outputs)
+}
+
+// downloadSegment fetches one segment into fileName, decrypting it if
+// needed. It is written under a temporary name first, so a file by the
+// segment's name always holds all of it. It returns the size written.
+func (dm *DownloadManager) downloadSegment(ctx context.Context, taskId string, client *http.Client, keys *segmentKeys, seg mediaSegment, fileName string, opts requestOptions, transferred *int64) (int64, error) {
+	onRead := func(n int) {
+		atomic.AddInt64(transferred, int64(n))
+		dm.limiter.AddBytes(n)
+		dm.limiter.Wait(ctx, taskId, n)
+	}
+
+	tmpFile := fileName + ".tmp"
+	file, err := os.Create(tmpFile)
+	if err != nil {
+		return 0, fmt.Errorf("disk write error: %w", err)
+	}
+	var size int64
+	if seg.Key == nil {
+		size, err = fetchRangeTo(ctx, client, seg.Url, seg.Offset, seg.Length, opts, file, onRead)
+	} else {
+		//Encrypted segments are decrypted in memory, HLS keeps them small
+		size, err = dm.fetchEncrypted(ctx, client, keys, seg, opts, file, onRead)
+	}
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("disk write error: %w", closeErr)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return 0, err
+	}
+
+	//No sync for every segment, a stream has thousands of them. A power cut
+	//can leave a short one behind, a resume fetches those again
+	if err := os.Rename(tmpFile, fileName); err != nil {
+		os.Remove(tmpFile)
+		return 0, fmt.Errorf("disk write error: %w", err)
+	}
+	return size, nil
+}
+
+// complete tells if a segment file of size holds all of seg.
+func (seg mediaSegment) complete(size int64) bool {
+	if seg.Length > 0 && seg.Key == nil {
+		return size == seg.Length
+	}
+	return size > 0
+}
+
+func (dm *DownloadManager) fetchEncrypted(ctx context.Context, client *http.Client, keys *segmentKeys, seg mediaSegment, opts requestOptions, w io.Writer, onRead func(n int)) (int64, error) {
+	data, err := fetchRange(ctx, client, seg.Url, seg.Offset, seg.Length, opts, onRead)
+	if err != nil {
+		return 0, err
+	}
+	key, err := keys.get(ctx, client, seg.Key.Url, opts)
+	if err != nil {
+		return 0, fmt.Errorf("fetching key: %w", err)
+	}
+	data, err = decryptSegment(data, key, seg.Key.IV)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return 0, fmt.Errorf("disk write error: %w", err)
+	}
+	return int64(len(data)), nil
+}
+
+// fetchRange reads a whole resource, or length bytes of it from offset,
+// into memory. Only for small things such as keys and indexes.
+func fetchRange(ctx context.Context, client *http.Client, rawUrl string, offset int64, length int64, opts requestOptions, onRead func(n int)) ([]byte, error) {
+	var data bytes.Buffer
+	if _, err := fetchRangeTo(ctx, client, rawUrl, offset, length, opts, &data, onRead); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// fetchRangeTo copies a whole resource, or length bytes of it from offset,
+// to w and returns how many bytes that was.
+func fetchRangeTo(ctx context.Context, client *http.Client, rawUrl string, offset int64, length int64, opts requestOptions, w io.Writer, onRead func(n int)) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawUrl, nil)
+	if err != nil {
+		return 0, err
+	}
+	if length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+	opts.apply(req)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 && res.StatusCode != 206 {
+		return 0, fmt.Errorf("Bad status code: %d", res.StatusCode)
+	}
+	if length > 0 && res.StatusCode == 200 {
+		return 0, fmt.Errorf("Server ignored range request for bytes %d-%d", offset, offset+length-1)
+	}
+
+	var written int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return written, fmt.Errorf("disk write error: %w", err)
+			}
+			written += int64(n)
+			if onRead != nil {
+				onRead(n)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	if length > 0 && written != length {
+		return written, fmt.Errorf("Server hung up early after %d of %d bytes", written, length)
+	}
+	return written, nil
+}
+
+// segmentKeys fetches every key once per stream, most playlists use one key
+// for all segments.
+type segmentKeys struct {
+	keys map[string][]byte
+	mu   sync.Mutex
+}
+
+func (sk *segmentKeys) get(ctx context.Context, client *http.Client, keyUrl string, opts requestOptions) ([]byte, error) {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	if key, ok := sk.keys[keyUrl]; ok {
+		return key, nil
+	}
+	key, err := fetchRange(ctx, client, keyUrl, 0, 0, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 16 {
+		return nil, fmt.Errorf("AES-128 key is %d bytes long", len(key))
+	}
+	sk.keys[keyUrl] = key
+	return key, nil
+}
+
+// decryptSegment undoes AES-128-CBC with PKCS#7 padding.
+func decryptSegment(data []byte, key []byte, iv []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted segment is %d bytes, not a multiple of the block size", len(data))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize || pad > len(plain) || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("segment decryption failed, wrong key or IV")
+	}
+	return plain[:len(plain)-pad], nil
+}
+
+// joinSegments writes the segments of one track into its output file.
+func joinSegments(taskId string, track int, t streamTrack, downloadDir string) (string, error) {
+	os.MkdirAll(downloadDir, 0755)
+	outputPath := uniqueOutputPath(downloadDir, t.FileName)
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("creating final file: %w", err)
+	}
+	defer outFile.Close()
+
+	for i := range t.Segments {
+		segFile, err := os.Open(segmentFileName(taskId, track, i))
+		if err == nil {
+			_, err = io.Copy(outFile, segFile)
+			segFile.Close()
+		}
+		if err != nil {
+			outFile.Close()
+			os.Remove(outputPath)
+			return "", fmt.Errorf("joining segment %d: %w", i, err)
+		}
+	}
+	log.Println("Segments joined into:", outputPath)
+	return outputPath, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFileRanges(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 2*fileRangeSize+1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/noranges.mp4" {
+			w.Header().Set("Content-Length", "1000")
+			return
+		}
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	segments := fileRanges(context.Background(), srv.Client(), srv.URL+"/video.mp4", requestOptions{})
+	want := []mediaSegment{
+		{Url: srv.URL + "/video.mp4", Offset: 0, Length: fileRangeSize},
+		{Url: srv.URL + "/video.mp4", Offset: fileRangeSize, Length: fileRangeSize},
+		{Url: srv.URL + "/video.mp4", Offset: 2 * fileRangeSize, Length: 1000},
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("got %d segments, want %d", len(segments), len(want))
+	}
+	for i := range want {
+		if segments[i] != want[i] {
+			t.Errorf("segment %d is %+v, want %+v", i, segments[i], want[i])
+		}
+	}
+
+	segments = fileRanges(context.Background(), srv.Client(), srv.URL+"/noranges.mp4", requestOptions{})
+	if len(segments) != 1 || segments[0].Length != 0 {
+		t.Errorf("server without ranges gave %+v, want the whole file", segments)
+	}
+}
+
+func TestStreamManifestSameLayout(t *testing.T) {
+	layout := func(urls ...string) *streamManifest {
+		m := &streamManifest{Source: "720p", Tracks: []streamTrack{{FileName: "video.ts"}}}
+		for i, u := range urls {
+			m.Tracks[0].Segments = append(m.Tracks[0].Segments, mediaSegment{Url: u, Offset: int64(i) * 100, Length: 100})
+		}
+		return m
+	}
+	saved := layout("https://cdn.example/seg1.ts", "https://cdn.example/seg2.ts")
+
+	if !saved.sameLayout(layout("https://cdn.example/seg1.ts", "https://cdn.example/seg2.ts")) {
+		t.Error("the same playlist is a different layout")
+	}
+	//A live playlist that slid forward keeps its length
+	if saved.sameLayout(layout("https://cdn.example/seg2.ts", "https://cdn.example/seg3.ts")) {
+		t.Error("segments that moved on count as the same layout")
+	}
+	moved := layout("https://cdn.example/seg1.ts", "https://cdn.example/seg2.ts")
+	moved.Tracks[0].Segments[1].Offset = 150
+	if saved.sameLayout(moved) {
+		t.Error("a segment with another byte range counts as the same")
+	}
+	other := layout("https://cdn.example/seg1.ts", "https://cdn.example/seg2.ts")
+	other.Source = "1080p"
+	if saved.sameLayout(other) {
+		t.Error("another variant counts as the same layout")
+	}
+}
+
+// TestDownloadStreamRefetchesShortSegments resumes a stream whose first
+// segment made it to disk and whose second was cut short.
+func TestDownloadStreamRefetchesShortSegments(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuv")
+	var ranges atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges.Add(1)
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	dm := newTestManager(t)
+	fileUrl := srv.URL + "/video.mp4"
+	stream := &streamManifest{Source: "video", Tracks: []streamTrack{{FileName: "video.mp4", Segments: []mediaSegment{
+		{Url: fileUrl, Offset: 0, Length: 10},
+		{Url: fileUrl, Offset: 10, Length: 10},
+		{Url: fileUrl, Offset: 20, Length: 12},
+	}}}}
+	dm.Tasks = []Task{{ID: fileUrl, Url: fileUrl, Status: "Downloading"}}
+
+	if err := os.MkdirAll(streamDirName(fileUrl), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStreamManifest(fileUrl, stream); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(segmentFileName(fileUrl, 0, 0), content[:10], 0644)
+	os.WriteFile(segmentFileName(fileUrl, 0, 1), content[10:14], 0644)
+
+	dm.downloadStream(context.Background(), fileUrl, stream)
+
+	if got := dm.Tasks[0].Status; got != "Completed" {
+		t.Fatalf("task is %s", got)
+	}
+	if got := ranges.Load(); got != 2 {
+		t.Errorf("fetched %d segments, want the short and the missing one", got)
+	}
+	got, err := os.ReadFile(filepath.Join("downloads", "video.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("joined file is %q", got)
+	}
+	if _, err := os.Stat(streamDirName(fileUrl)); !os.IsNotExist(err) {
+		t.Error("segment folder left behind")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+)
+
+// taskSecret is the part of a task that must not be sent to clients or
+// written to tasks.json in the clear.
+type taskSecret struct {
+	Username string            `json:"username,omitempty"`
+	Password string            `json:"password,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Cookies  string            `json:"cookies,omitempty"`
+	// Headers the resolver asked for, such as a session for signed URLs
+	ResolvedHeaders http.Header `json:"resolvedHeaders,omitempty"`
+}
+
+func (t *Task) secret() taskSecret {
+	s := taskSecret{Username: t.Username, Password: t.Password, Headers: t.Headers, Cookies: t.Cookies}
+	if t.Resolved != nil {
+		s.ResolvedHeaders = t.Resolved.Headers
+	}
+	return s
+}
+
+func (t *Task) setSecret(s taskSecret) {
+	t.Username, t.Password = s.Username, s.Password
+	t.Headers, t.Cookies = s.Headers, s.Cookies
+	if t.Resolved != nil {
+		t.Resolved.Headers = s.ResolvedHeaders
+	}
+}
+
+func (s taskSecret) empty() bool {
+	return s.Username == "" && s.Password == "" && len(s.Headers) == 0 && s.Cookies == "" && len(s.ResolvedHeaders) == 0
+}
+
+// saveTaskSecrets writes the secrets of tasks to fileName, each sealed with
+// the store's key.
+func (cs *credentialStore) saveTaskSecrets(fileName string, tasks []Task) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	gcm, err := cs.newGCM()
+	if err != nil {
+		return err
+	}
+	saved := make(map[string]string)
+	for i := range tasks {
+		secret := tasks[i].secret()
+		if secret.empty() {
+			continue
+		}
+		plain, err := json.Marshal(secret)
+		if err != nil {
+			return err
+		}
+		if saved[tasks[i].ID], err = seal(gcm, string(plain)); err != nil {
+			return err
+		}
+	}
+
+	bytes, err := json.MarshalIndent(saved, "", " ")
+	if err != nil {
+		return err
+	}
+	//Created private, the sealed logins are no one else's business either
+	return writeFileAtomic(fileName, bytes, 0600)
+}
+
+// loadTaskSecrets puts the secrets saved in fileName back into tasks.
+func (cs *credentialStore) loadTaskSecrets(fileName string, tasks []Task) {
+	bytes, err := os.ReadFile(fileName)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("Error reading task secrets:", err)
+		}
+		return
+	}
+	var saved map[string]string
+	if err := json.Unmarshal(bytes, &saved); err != nil {
+		log.Println("Error parsing", fileName, err)
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	gcm, err := cs.newGCM()
+	if err != nil {
+		log.Println("Error loading credential key:", err)
+		return
+	}
+	for i := range tasks {
+		sealed, ok := saved[tasks[i].ID]
+		if !ok {
+			continue
+		}
+		plain, err := unseal(gcm, sealed)
+		var secret taskSecret
+		if err == nil {
+			err = json.Unmarshal([]byte(plain), &secret)
+		}
+		if err != nil {
+			log.Println("Skipping secrets of", tasks[i].FileName+":", err)
+			continue
+		}
+		tasks[i].setSecret(secret)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTaskLoginsStaySealed(t *testing.T) {
+	dm := newTestManager(t)
+	dm.Tasks = []Task{
+		{ID: "ftp://example.com/a.iso", Url: "ftp://example.com/a.iso", FileName: "a.iso", Status: "Paused", Username: "joe", Password: "hunter2",
+			Headers: map[string]string{"X-Api-Key": "hunter2"}, Cookies: "sid=hunter2"},
+		{ID: "https://example.com/b.zip", Url: "https://example.com/b.zip", FileName: "b.zip", Status: "Completed"},
+		{ID: "https://example.com/watch", Url: "https://example.com/watch", FileName: "c.mp4", Status: "Paused", Resolved: &Resolution{
+			Urls:    []string{"https://cdn.example.com/c.mp4"},
+			Headers: http.Header{"Authorization": {"Bearer hunter2"}},
+		}},
+	}
+	dm.SaveTasks()
+
+	for _, name := range []string{"tasks.json", "task-secrets.json"} {
+		bytes, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(bytes), "hunter2") || strings.Contains(string(bytes), "joe") {
+			t.Errorf("%s holds the login in the clear:\n%s", name, bytes)
+		}
+	}
+	if info, err := os.Stat("task-secrets.json"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("task-secrets.json is %v, %v, want mode 0600", info.Mode().Perm(), err)
+	}
+
+	loaded := NewDownloadManager()
+	loaded.LoadTasks()
+	if len(loaded.Tasks) != 3 {
+		t.Fatalf("loaded %d tasks", len(loaded.Tasks))
+	}
+	if got := loaded.Tasks[0]; got.Username != "joe" || got.Password != "hunter2" {
+		t.Errorf("login came back as %q/%q", got.Username, got.Password)
+	}
+	if got := loaded.Tasks[0]; got.Headers["X-Api-Key"] != "hunter2" || got.Cookies != "sid=hunter2" {
+		t.Errorf("headers came back as %v, cookies as %q", got.Headers, got.Cookies)
+	}
+	if got := loaded.Tasks[1]; got.Username != "" || got.Password != "" {
+		t.Errorf("task without a login got %q/%q", got.Username, got.Password)
+	}
+	if got := loaded.Tasks[2].Resolved; got == nil || got.Headers.Get("Authorization") != "Bearer hunter2" || len(got.Urls) != 1 {
+		t.Errorf("resolution came back as %+v", got)
+	}
+
+	//Secrets sealed with another key are dropped rather than misread
+	os.Remove("credentials.key")
+	rekeyed := NewDownloadManager()
+	rekeyed.LoadTasks()
+	if got := rekeyed.Tasks[0]; got.Username != "" {
+		t.Errorf("login unsealed with the wrong key: %q", got.Username)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kkdai/youtube/v2"
+)
+
+// youtubeClient is the part of the kkdai client we use, so a fake can stand
+// in for it.
+type youtubeClient interface {
+	GetVideoContext(ctx context.Context, url string) (*youtube.Video, error)
+	GetStreamURLContext(ctx context.Context, video *youtube.Video, format *youtube.Format) (string, error)
+	GetPlaylistContext(ctx context.Context, url string) (*youtube.Playlist, error)
+}
+
+// youtubeFormat is a format as the formats endpoint lists it.
+type youtubeFormat struct {
+	Itag     int    `json:"itag"`
+	MimeType string `json:"mimeType"`
+	Quality  string `json:"quality"`
+	Bitrate  int    `json:"bitrate"`
+	Size     int64  `json:"size"`
+	HasVideo bool   `json:"hasVideo"`
+	HasAudio bool   `json:"hasAudio"`
+}
+
+func hasVideo(f *youtube.Format) bool {
+	return strings.HasPrefix(f.MimeType, "video/")
+}
+
+func hasAudio(f *youtube.Format) bool {
+	return f.AudioChannels > 0
+}
+
+// formatExtension picks the file extension for a format's container.
+func formatExtension(f *youtube.Format) string {
+	switch {
+	case strings.HasPrefix(f.MimeType, "audio/mp4"):
+		return ".m4a"
+	case strings.HasPrefix(f.MimeType, "audio/webm"):
+		return ".weba"
+	case strings.HasPrefix(f.MimeType, "video/webm"):
+		return ".webm"
+	}
+	return ".mp4"
+}
+
+// formatRule is a parsed quality preference such as "best <=1080p mp4" or
+// "audio only m4a".
+type formatRule struct {
+	worst     bool
+	audioOnly bool
+	maxHeight int
+	container string // mp4, webm or m4a
+}
+
+func parseFormatRule(rule string) (formatRule, error) {
+	var r formatRule
+	rule = strings.ReplaceAll(strings.ToLower(rule), "≤", "<=")
+	for _, word := range strings.Fields(rule) {
+		switch word {
+		case "best", "only", "<=":
+		case "worst":
+			r.worst = true
+		case "audio":
+			r.audioOnly = true
+		case "mp4", "webm":
+			r.container = word
+		case "m4a":
+			r.audioOnly = true
+			r.container = "mp4"
+		default:
+			height, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(word, "<="), "p"))
+			if err != nil || height <= 0 {
+				return r, fmt.Errorf("unknown quality %q", word)
+			}
+			r.maxHeight = height
+		}
+	}
+	return r, nil
+}
+
+// selectFormat returns the format with the given itag or, without one, the
+// one that fits rule best. Video formats are only picked with their audio
+// track, there is nothing to merge separate streams with.
+func selectFormat(formats youtube.FormatList, itag int, rule string) (*youtube.Format, error) {
+	if itag > 0 {
+		for i := range formats {
+			if formats[i].ItagNo == itag {
+				return &formats[i], nil
+			}
+		}
+		return nil, fmt.Errorf("format %d is not available", itag)
+	}
+
+	r, err := parseFormatRule(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*youtube.Format
+	for i := range formats {
+		f := &formats[i]
+		if !hasAudio(f) || hasVideo(f) == r.audioOnly {
+			continue
+		}
+		if r.container != "" && !strings.Contains(f.MimeType, "/"+r.container) {
+			continue
+		}
+		if r.maxHeight > 0 && f.Height > r.maxHeight {
+			continue
+		}
+		candidates = append(candidates, f)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no format matches %q", rule)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Height != b.Height {
+			return a.Height > b.Height
+		}
+		return a.Bitrate > b.Bitrate
+	})
+	if r.worst {
+		return candidates[len(candidates)-1], nil
+	}
+	return candidates[0], nil
+}
+
+// YoutubeFormatsHandler lists the formats of the video in the url query.
+func (dm *DownloadManager) YoutubeFormatsHandler(c *gin.Context) {
+	videoUrl := c.Query("url")
+	if videoUrl == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url is required"})
+		return
+	}
+
+	video, err := dm.youtube.GetVideoContext(c.Request.Context(), videoUrl)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to analyze video: " + err.Error()})
+		return
+	}
+
+	formats := make([]youtubeFormat, 0, len(video.Formats))
+	for i := range video.Formats {
+		f := &video.Formats[i]
+		quality := f.QualityLabel
+		if quality == "" {
+			quality = f.AudioQuality
+		}
+		formats = append(formats, youtubeFormat{
+			Itag:     f.ItagNo,
+			MimeType: f.MimeType,
+			Quality:  quality,
+			Bitrate:  f.Bitrate,
+			Size:     f.ContentLength,
+			HasVideo: hasVideo(f),
+			HasAudio: hasAudio(f),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"title":    video.Title,
+		"duration": video.Duration.Seconds(),
+		"formats":  formats,
+	})
+}
+
+// youtubeResolver finds the stream URL of a YouTube video in the format
+// the task asks for.
+type youtubeResolver struct {
+	client youtubeClient
+}
+
+func (r *youtubeResolver) Name() string {
+	return "Youtube"
+}
+
+func (r *youtubeResolver) Match(u *neturl.URL) bool {
+	switch strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.") {
+	case "youtube.com", "m.youtube.com", "music.youtube.com", "youtube-nocookie.com", "youtu.be":
+		return true
+	}
+	return false
+}
+
+func (r *youtubeResolver) Resolve(ctx context.Context, videoUrl string, opts ResolveOptions) (*Resolution, error) {
+	video, err := r.client.GetVideoContext(ctx, videoUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to analyze video: %w", err)
+	}
+
+	format, err := selectFormat(video.Formats, opts.Itag, opts.Quality)
+	if err != nil {
+		return nil, fmt.Errorf("no downloadable formats found: %w", err)
+	}
+	log.Printf("Found format: %s, Quality: %s\n", format.MimeType, format.QualityLabel)
+
+	streamURL, err := r.client.GetStreamURLContext(ctx, video, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stream URL: %w", err)
+	}
+
+	variant := format.QualityLabel
+	if variant == "" {
+		variant = format.AudioQuality
+	}
+	res := &Resolution{
+		Urls:     []string{streamURL},
+		FileName: sanitizeFileName(video.Title) + formatExtension(format),
+		Variant:  fmt.Sprintf("%s %s (itag %d)", variant, format.MimeType, format.ItagNo),
+	}
+	if u, err := neturl.Parse(streamURL); err == nil {
+		res.Expires = urlExpiry(u)
+	}
+	return res, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kkdai/youtube/v2"
+)
+
+// fakeYoutubeClient serves videos and playlists from memory and hands out
+// stream URLs on media.example that expire an hour from now.
+type fakeYoutubeClient struct {
+	videos    map[string]*youtube.Video
+	playlists map[string]*youtube.Playlist
+	streamErr error
+}
+
+func (fc *fakeYoutubeClient) GetVideoContext(ctx context.Context, url string) (*youtube.Video, error) {
+	video, ok := fc.videos[url]
+	if !ok {
+		return nil, errors.New("video unavailable")
+	}
+	return video, nil
+}
+
+func (fc *fakeYoutubeClient) GetStreamURLContext(ctx context.Context, video *youtube.Video, format *youtube.Format) (string, error) {
+	if fc.streamErr != nil {
+		return "", fc.streamErr
+	}
+	return fmt.Sprintf("https://media.example/%s/%d?expire=%d", video.ID, format.ItagNo, time.Now().Add(time.Hour).Unix()), nil
+}
+
+func (fc *fakeYoutubeClient) GetPlaylistContext(ctx context.Context, url string) (*youtube.Playlist, error) {
+	playlist, ok := fc.playlists[url]
+	if !ok {
+		return nil, errors.New("playlist unavailable")
+	}
+	return playlist, nil
+}
+
+// testFormats mixes muxed, video-only and audio-only formats the way
+// YouTube lists them.
+var testFormats = youtube.FormatList{
+	{ItagNo: 18, MimeType: `video/mp4; codecs="avc1.42001E, mp4a.40.2"`, QualityLabel: "360p", Height: 360, Bitrate: 500_000, AudioChannels: 2},
+	{ItagNo: 22, MimeType: `video/mp4; codecs="avc1.64001F, mp4a.40.2"`, QualityLabel: "720p", Height: 720, Bitrate: 1_500_000, AudioChannels: 2},
+	{ItagNo: 43, MimeType: `video/webm; codecs="vp8.0, vorbis"`, QualityLabel: "360p", Height: 360, Bitrate: 600_000, AudioChannels: 2},
+	{ItagNo: 137, MimeType: `video/mp4; codecs="avc1.640028"`, QualityLabel: "1080p", Height: 1080, Bitrate: 4_000_000},
+	{ItagNo: 139, MimeType: `audio/mp4; codecs="mp4a.40.5"`, AudioQuality: "AUDIO_QUALITY_LOW", Bitrate: 48_000, AudioChannels: 2},
+	{ItagNo: 140, MimeType: `audio/mp4; codecs="mp4a.40.2"`, AudioQuality: "AUDIO_QUALITY_MEDIUM", Bitrate: 128_000, AudioChannels: 2},
+	{ItagNo: 251, MimeType: `audio/webm; codecs="opus"`, AudioQuality: "AUDIO_QUALITY_MEDIUM", Bitrate: 160_000, AudioChannels: 2},
+}
+
+func TestParseFormatRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		want    formatRule
+		wantErr bool
+	}{
+		{rule: "", want: formatRule{}},
+		{rule: "best", want: formatRule{}},
+		{rule: "worst", want: formatRule{worst: true}},
+		{rule: "best <=1080p mp4", want: formatRule{maxHeight: 1080, container: "mp4"}},
+		{rule: "Best ≤720p WEBM", want: formatRule{maxHeight: 720, container: "webm"}},
+		{rule: "<= 480", want: formatRule{maxHeight: 480}},
+		{rule: "audio only", want: formatRule{audioOnly: true}},
+		{rule: "audio only m4a", want: formatRule{audioOnly: true, container: "mp4"}},
+		{rule: "worst m4a", want: formatRule{worst: true, audioOnly: true, container: "mp4"}},
+		{rule: "4k", wantErr: true},
+		{rule: "0p", wantErr: true},
+		{rule: "best flac", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseFormatRule(tt.rule)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFormatRule(%q) error = %v, want error %v", tt.rule, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseFormatRule(%q) = %+v, want %+v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestSelectFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		itag     int
+		rule     string
+		wantItag int
+		wantErr  bool
+	}{
+		{name: "default is the best muxed format", wantItag: 22},
+		{name: "best", rule: "best", wantItag: 22},
+		{name: "worst goes by height then bitrate", rule: "worst", wantItag: 18},
+		{name: "height cap", rule: "best <=480p", wantItag: 43},
+		{name: "height cap and container", rule: "best ≤480p mp4", wantItag: 18},
+		{name: "container", rule: "webm", wantItag: 43},
+		{name: "audio only picks the highest bitrate", rule: "audio only", wantItag: 251},
+		{name: "audio only m4a", rule: "audio only m4a", wantItag: 140},
+		{name: "worst m4a", rule: "worst audio m4a", wantItag: 139},
+		{name: "video without audio is never picked by rule", rule: "best <=1080p", wantItag: 22},
+		{name: "itag overrides the rule", itag: 137, rule: "audio only", wantItag: 137},
+		{name: "unknown itag", itag: 999, wantErr: true},
+		{name: "nothing low enough", rule: "best <=144p", wantErr: true},
+		{name: "bad rule", rule: "best 8k", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectFormat(testFormats, tt.itag, tt.rule)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got itag %d, want an error", got.ItagNo)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ItagNo != tt.wantItag {
+				t.Errorf("got itag %d, want %d", got.ItagNo, tt.wantItag)
+			}
+		})
+	}
+}
+
+func TestYoutubeResolver(t *testing.T) {
+	const videoUrl = "https://www.youtube.com/watch?v=abc123"
+	client := &fakeYoutubeClient{videos: map[string]*youtube.Video{
+		videoUrl: {ID: "abc123", Title: "Live: A/B test", Formats: testFormats},
+	}}
+	r := &youtubeResolver{client: client}
+
+	res, err := r.Resolve(context.Background(), videoUrl, ResolveOptions{Quality: "audio only m4a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Urls) != 1 || !strings.HasPrefix(res.Urls[0], "https://media.example/abc123/140?") {
+		t.Errorf("Urls = %v, want the stream of itag 140", res.Urls)
+	}
+	if res.FileName != "Live_ A_B test.m4a" {
+		t.Errorf("FileName = %q", res.FileName)
+	}
+	if until := time.Until(res.Expires); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("Expires in %v, want an hour", until)
+	}
+
+	res, err = r.Resolve(context.Background(), videoUrl, ResolveOptions{Itag: 43})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.FileName != "Live_ A_B test.webm" {
+		t.Errorf("FileName = %q", res.FileName)
+	}
+
+	if _, err := r.Resolve(context.Background(), "https://youtu.be/missing", ResolveOptions{}); err == nil {
+		t.Error("resolved a video the client doesn't have")
+	}
+	if _, err := r.Resolve(context.Background(), videoUrl, ResolveOptions{Quality: "best <=144p"}); err == nil {
+		t.Error("resolved without a matching format")
+	}
+	client.streamErr = errors.New("signature decipher failed")
+	if _, err := r.Resolve(context.Background(), videoUrl, ResolveOptions{}); !errors.Is(err, client.streamErr) {
+		t.Errorf("got %v, want the stream URL error", err)
+	}
+}
+
+func TestYoutubeFormatsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const videoUrl = "https://youtu.be/abc123"
+	dm := &DownloadManager{youtube: &fakeYoutubeClient{videos: map[string]*youtube.Video{
+		videoUrl: {ID: "abc123", Title: "Clip", Duration: 90 * time.Second, Formats: testFormats},
+	}}}
+	r := gin.New()
+	r.GET("/youtube/formats", dm.YoutubeFormatsHandler)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/youtube/formats?url="+videoUrl, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Title    string          `json:"title"`
+		Duration float64         `json:"duration"`
+		Formats  []youtubeFormat `json:"formats"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Title != "Clip" || body.Duration != 90 || len(body.Formats) != len(testFormats) {
+		t.Fatalf("got %+v", body)
+	}
+	if f := body.Formats[3]; f.Itag != 137 || !f.HasVideo || f.HasAudio || f.Quality != "1080p" {
+		t.Errorf("video-only format listed as %+v", f)
+	}
+	if f := body.Formats[5]; f.Itag != 140 || f.HasVideo || !f.HasAudio || f.Quality != "AUDIO_QUALITY_MEDIUM" {
+		t.Errorf("audio format listed as %+v", f)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/youtube/formats?url=https://youtu.be/missing", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("missing video: status %d, want 502", rec.Code)
+	}
+}